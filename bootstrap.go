@@ -26,40 +26,91 @@ func bootstrap(force bool) {
 	dir := cwd + "/bootstrapping/" //This won't work if we put the binary somewhere other than the root of the project
 
 	var info = map[string]map[string]string{
+		"label_type": {
+			"filename":       dir + "label-types.csv",
+			"drop":           "DROP TABLE IF EXISTS label_type",
+			"create_mysql":   "CREATE TABLE `label_type` ( `label_type_id` int(11) NOT NULL auto_increment, `household_id` int(11) NOT NULL DEFAULT 1, `name` varchar(20) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `display_order` int(11) NOT NULL DEFAULT 0, `multi_select` BOOLEAN NOT NULL DEFAULT 1, `version` int(11) NOT NULL DEFAULT 1, PRIMARY KEY (`label_type_id`), UNIQUE KEY `name` (`household_id`, `name`))",
+			"create_sqlite3": "CREATE TABLE `label_type` ( `label_type_id` INTEGER PRIMARY KEY, `household_id` INTEGER NOT NULL DEFAULT 1, `name` varchar(20) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `display_order` INTEGER NOT NULL DEFAULT 0, `multi_select` BOOLEAN NOT NULL DEFAULT 1, `version` INTEGER NOT NULL DEFAULT 1, UNIQUE (`household_id`, `name`))",
+			"insert":         "INSERT INTO label_type (label_type_id, name, icon, display_order, multi_select) VALUES (?, ?, ?, ?, ?)",
+		},
 		"label": {
 			"filename":       dir + "labels.csv",
 			"drop":           "DROP TABLE IF EXISTS label",
-			"create_mysql":   "CREATE TABLE `label` ( `label_id` int(11) NOT NULL auto_increment, `label` varchar(255) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `type` varchar(20) NOT NULL DEFAULT '', PRIMARY KEY  (`label_id`), KEY `label` (`label`))",
-			"create_sqlite3": "CREATE TABLE `label` ( `label_id` INTEGER PRIMARY KEY, `label` varchar(255) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `type` varchar(20) NOT NULL DEFAULT '')",
-			"insert":         "INSERT INTO label (label_id, label, icon, type) VALUES (?, ?, ?, ?)",
+			"create_mysql":   "CREATE TABLE `label` ( `label_id` int(11) NOT NULL auto_increment, `household_id` int(11) NOT NULL DEFAULT 1, `label` varchar(255) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `type_id` int(11) NOT NULL DEFAULT 0, `parent_id` int(11) NOT NULL DEFAULT 0, `version` int(11) NOT NULL DEFAULT 1, PRIMARY KEY  (`label_id`), KEY `label` (`household_id`, `label`), KEY `parent` (`parent_id`))",
+			"create_sqlite3": "CREATE TABLE `label` ( `label_id` INTEGER PRIMARY KEY, `household_id` INTEGER NOT NULL DEFAULT 1, `label` varchar(255) NOT NULL, `icon` varchar(255) NOT NULL DEFAULT '', `type_id` INTEGER NOT NULL DEFAULT 0, `parent_id` INTEGER NOT NULL DEFAULT 0, `version` INTEGER NOT NULL DEFAULT 1)",
+			"insert":         "INSERT INTO label (label_id, label, icon, type_id) VALUES (?, ?, ?, COALESCE((SELECT label_type_id FROM label_type WHERE household_id = 1 AND name = ?), 0))",
 		},
 		"recipe": {
 			"filename":       dir + "recipes.csv",
 			"drop":           "DROP TABLE IF EXISTS recipe",
-			"create_mysql":   "CREATE TABLE `recipe` ( `recipe_id` int(11) NOT NULL auto_increment, `title` varchar(255) NOT NULL, `recipe_body` text NOT NULL, `total_time` int(11) NOT NULL, `active_time` int(11)   NOT NULL, `deleted` BOOLEAN NOT NULL DEFAULT 0, `new` BOOLEAN NOT NULL DEFAULT 1, PRIMARY KEY  (`recipe_id`), KEY `title` (`title`))",
-			"create_sqlite3": "CREATE TABLE `recipe` ( `recipe_id` INTEGER PRIMARY KEY, `title` varchar(255) NOT NULL, `recipe_body` text NOT NULL, `total_time` int NOT NULL, `active_time` int   NOT NULL, `deleted` BOOLEAN NOT NULL DEFAULT 0, `new` BOOLEAN NOT NULL DEFAULT 1)",
+			"create_mysql":   "CREATE TABLE `recipe` ( `recipe_id` int(11) NOT NULL auto_increment, `household_id` int(11) NOT NULL DEFAULT 1, `title` varchar(255) NOT NULL, `recipe_body` text NOT NULL, `total_time` int(11) NOT NULL, `active_time` int(11)   NOT NULL, `deleted` BOOLEAN NOT NULL DEFAULT 0, `new` BOOLEAN NOT NULL DEFAULT 1, `version` int(11) NOT NULL DEFAULT 1, `created` bigint(20) NOT NULL DEFAULT 0, `last_cooked` bigint(20) NOT NULL DEFAULT 0, `deleted_at` bigint(20) NOT NULL DEFAULT 0, PRIMARY KEY  (`recipe_id`), KEY `household` (`household_id`), KEY `title` (`title`), KEY `trash` (`deleted`, `deleted_at`))",
+			"create_sqlite3": "CREATE TABLE `recipe` ( `recipe_id` INTEGER PRIMARY KEY, `household_id` INTEGER NOT NULL DEFAULT 1, `title` varchar(255) NOT NULL, `recipe_body` text NOT NULL, `total_time` int NOT NULL, `active_time` int   NOT NULL, `deleted` BOOLEAN NOT NULL DEFAULT 0, `new` BOOLEAN NOT NULL DEFAULT 1, `version` INTEGER NOT NULL DEFAULT 1, `created` INTEGER NOT NULL DEFAULT 0, `last_cooked` INTEGER NOT NULL DEFAULT 0, `deleted_at` INTEGER NOT NULL DEFAULT 0)",
 			"insert":         "INSERT INTO recipe (recipe_id, title, recipe_body, total_time, active_time, deleted, new) VALUES (?, ?, ?, ?, ?, ?, ?)",
 		},
 		"recipe_label": {
 			"filename":       dir + "recipe-label.csv",
 			"drop":           "DROP TABLE IF EXISTS recipe_label",
-			"create_mysql":   "CREATE TABLE `recipe_label` ( `recipe_id` bigint(20) NOT NULL, `label_id` int(11) NOT NULL, PRIMARY KEY  (`recipe_id`,`label_id`))",
-			"create_sqlite3": "CREATE TABLE `recipe_label` ( `recipe_id` bigint NOT NULL, `label_id` int NOT NULL, PRIMARY KEY  (`recipe_id`,`label_id`))",
+			"create_mysql":   "CREATE TABLE `recipe_label` ( `recipe_id` int(11) NOT NULL, `label_id` int(11) NOT NULL, PRIMARY KEY  (`recipe_id`,`label_id`), KEY `label` (`label_id`), CONSTRAINT `recipe_label_recipe` FOREIGN KEY (`recipe_id`) REFERENCES `recipe` (`recipe_id`) ON DELETE CASCADE, CONSTRAINT `recipe_label_label` FOREIGN KEY (`label_id`) REFERENCES `label` (`label_id`) ON DELETE CASCADE)",
+			"create_sqlite3": "CREATE TABLE `recipe_label` ( `recipe_id` bigint NOT NULL REFERENCES `recipe` (`recipe_id`) ON DELETE CASCADE, `label_id` int NOT NULL REFERENCES `label` (`label_id`) ON DELETE CASCADE, PRIMARY KEY  (`recipe_id`,`label_id`))",
 			"insert":         "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)",
 		},
+		"label_alias": {
+			"drop":           "DROP TABLE IF EXISTS label_alias",
+			"create_mysql":   "CREATE TABLE `label_alias` ( `household_id` int(11) NOT NULL, `alias` varchar(255) NOT NULL, `label_id` int(11) NOT NULL, PRIMARY KEY (`household_id`, `alias`), KEY `label` (`label_id`), CONSTRAINT `label_alias_label` FOREIGN KEY (`label_id`) REFERENCES `label` (`label_id`) ON DELETE CASCADE)",
+			"create_sqlite3": "CREATE TABLE `label_alias` ( `household_id` INTEGER NOT NULL, `alias` varchar(255) NOT NULL, `label_id` INTEGER NOT NULL REFERENCES `label` (`label_id`) ON DELETE CASCADE, PRIMARY KEY (`household_id`, `alias`))",
+		},
 		"note": {
 			"filename":       dir + "notes.csv",
 			"drop":           "DROP TABLE IF EXISTS note",
-			"create_mysql":   "CREATE TABLE `note` ( `note_id` bigint(20) NOT NULL AUTO_INCREMENT, `recipe_id` bigint(20) NOT NULL, `create_date` bigint(20) NOT NULL, `note` TEXT NOT NULL, `flagged` BOOLEAN NOT NULL DEFAULT 0, PRIMARY KEY (`note_id`), KEY `recipe` (`recipe_id`))",
-			"create_sqlite3": "CREATE TABLE `note` ( `note_id` INTEGER PRIMARY KEY, `recipe_id` INTEGER NOT NULL, `create_date` TEXT NOT NULL, `note` TEXT NOT NULL, `flagged` BOOLEAN DEFAULT FALSE)",
+			"create_mysql":   "CREATE TABLE `note` ( `note_id` bigint(20) NOT NULL AUTO_INCREMENT, `household_id` int(11) NOT NULL DEFAULT 1, `recipe_id` int(11) NOT NULL, `create_date` bigint(20) NOT NULL, `note` TEXT NOT NULL, `flagged` BOOLEAN NOT NULL DEFAULT 0, `version` int(11) NOT NULL DEFAULT 1, PRIMARY KEY (`note_id`), KEY `recipe` (`recipe_id`), CONSTRAINT `note_recipe` FOREIGN KEY (`recipe_id`) REFERENCES `recipe` (`recipe_id`) ON DELETE CASCADE)",
+			"create_sqlite3": "CREATE TABLE `note` ( `note_id` INTEGER PRIMARY KEY, `household_id` INTEGER NOT NULL DEFAULT 1, `recipe_id` INTEGER NOT NULL REFERENCES `recipe` (`recipe_id`) ON DELETE CASCADE, `create_date` TEXT NOT NULL, `note` TEXT NOT NULL, `flagged` BOOLEAN DEFAULT FALSE, `version` INTEGER NOT NULL DEFAULT 1)",
 			"insert":         "INSERT INTO note (note_id, recipe_id, create_date, note, flagged) VALUES (?, ?, ?, ?, ?)",
 		},
 		"user": {
 			"filename":       dir + "users.csv",
 			"drop":           "DROP TABLE IF EXISTS user",
-			"create_mysql":   "CREATE TABLE `user` ( `user_id` bigint(20) NOT NULL AUTO_INCREMENT, `username` varchar(63) NOT NULL, `password` varchar(255), `plaintext_pw_bootstrapping_only` varchar(255) NOT NULL, `administrator` BOOLEAN NOT NULL DEFAULT 0, PRIMARY KEY (`user_id`), KEY `username` (`username`))",
-			"create_sqlite3": "CREATE TABLE `user` ( `user_id` INTEGER PRIMARY KEY, `username` varchar(63) NOT NULL, `password` varchar(255), `plaintext_pw_bootstrapping_only` varchar(255) NOT NULL, `administrator` BOOLEAN NOT NULL DEFAULT 0)",
-			"insert":         "INSERT INTO user (user_id, username, password, plaintext_pw_bootstrapping_only, administrator) VALUES (?, ?, ?, ?, ?)",
+			"create_mysql":   "CREATE TABLE `user` ( `user_id` bigint(20) NOT NULL AUTO_INCREMENT, `username` varchar(63) NOT NULL, `password` varchar(255), `plaintext_pw_bootstrapping_only` varchar(255) NOT NULL, `unit_system` varchar(10) NOT NULL DEFAULT '', `default_servings` int(11) NOT NULL DEFAULT 0, PRIMARY KEY (`user_id`), KEY `username` (`username`))",
+			"create_sqlite3": "CREATE TABLE `user` ( `user_id` INTEGER PRIMARY KEY, `username` varchar(63) NOT NULL, `password` varchar(255), `plaintext_pw_bootstrapping_only` varchar(255) NOT NULL, `unit_system` varchar(10) NOT NULL DEFAULT '', `default_servings` int NOT NULL DEFAULT 0)",
+			"insert":         "INSERT INTO user (user_id, username, password, plaintext_pw_bootstrapping_only) VALUES (?, ?, ?, ?)",
+		},
+		"household": {
+			"filename":       dir + "households.csv",
+			"drop":           "DROP TABLE IF EXISTS household",
+			"create_mysql":   "CREATE TABLE `household` ( `household_id` int(11) NOT NULL AUTO_INCREMENT, `name` varchar(63) NOT NULL, `invite_code` varchar(32) NOT NULL, PRIMARY KEY (`household_id`), UNIQUE KEY `invite_code` (`invite_code`))",
+			"create_sqlite3": "CREATE TABLE `household` ( `household_id` INTEGER PRIMARY KEY, `name` varchar(63) NOT NULL, `invite_code` varchar(32) NOT NULL UNIQUE)",
+			"insert":         "INSERT INTO household (household_id, name, invite_code) VALUES (?, ?, ?)",
+		},
+		"household_user": {
+			"filename":       dir + "household-users.csv",
+			"drop":           "DROP TABLE IF EXISTS household_user",
+			"create_mysql":   "CREATE TABLE `household_user` ( `household_id` int(11) NOT NULL, `user_id` bigint(20) NOT NULL, `role` varchar(20) NOT NULL DEFAULT 'viewer', PRIMARY KEY (`household_id`, `user_id`), KEY `user` (`user_id`))",
+			"create_sqlite3": "CREATE TABLE `household_user` ( `household_id` INTEGER NOT NULL, `user_id` INTEGER NOT NULL, `role` varchar(20) NOT NULL DEFAULT 'viewer', PRIMARY KEY (`household_id`, `user_id`))",
+			"insert":         "INSERT INTO household_user (household_id, user_id, role) VALUES (?, ?, ?)",
+		},
+		"user_identity": {
+			"drop":           "DROP TABLE IF EXISTS user_identity",
+			"create_mysql":   "CREATE TABLE `user_identity` ( `issuer` varchar(255) NOT NULL, `subject` varchar(255) NOT NULL, `user_id` bigint(20) NOT NULL, `created` bigint(20) NOT NULL, PRIMARY KEY (`issuer`, `subject`), KEY `user` (`user_id`))",
+			"create_sqlite3": "CREATE TABLE `user_identity` ( `issuer` varchar(255) NOT NULL, `subject` varchar(255) NOT NULL, `user_id` INTEGER NOT NULL, `created` INTEGER NOT NULL, PRIMARY KEY (`issuer`, `subject`))",
+		},
+		"api_key": {
+			"drop":           "DROP TABLE IF EXISTS api_key",
+			"create_mysql":   "CREATE TABLE `api_key` ( `key_id` bigint(20) NOT NULL AUTO_INCREMENT, `user_id` bigint(20) NOT NULL, `household_id` int(11) NOT NULL, `name` varchar(63) NOT NULL, `prefix` varchar(15) NOT NULL, `key_hash` char(64) NOT NULL, `scope` varchar(10) NOT NULL, `created` bigint(20) NOT NULL, `expires` bigint(20) NOT NULL DEFAULT 0, `last_used` bigint(20) NOT NULL DEFAULT 0, PRIMARY KEY (`key_id`), UNIQUE KEY `key_hash` (`key_hash`), KEY `user` (`user_id`))",
+			"create_sqlite3": "CREATE TABLE `api_key` ( `key_id` INTEGER PRIMARY KEY, `user_id` INTEGER NOT NULL, `household_id` INTEGER NOT NULL, `name` varchar(63) NOT NULL, `prefix` varchar(15) NOT NULL, `key_hash` char(64) NOT NULL UNIQUE, `scope` varchar(10) NOT NULL, `created` INTEGER NOT NULL, `expires` INTEGER NOT NULL DEFAULT 0, `last_used` INTEGER NOT NULL DEFAULT 0)",
+		},
+		"login_lockout": {
+			"drop":           "DROP TABLE IF EXISTS login_lockout",
+			"create_mysql":   "CREATE TABLE `login_lockout` ( `scope` varchar(10) NOT NULL, `subject` varchar(255) NOT NULL, `failures` int(11) NOT NULL DEFAULT 0, `last_failure` bigint(20) NOT NULL DEFAULT 0, `locked_until` bigint(20) NOT NULL DEFAULT 0, PRIMARY KEY (`scope`, `subject`))",
+			"create_sqlite3": "CREATE TABLE `login_lockout` ( `scope` varchar(10) NOT NULL, `subject` varchar(255) NOT NULL, `failures` int NOT NULL DEFAULT 0, `last_failure` INTEGER NOT NULL DEFAULT 0, `locked_until` INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (`scope`, `subject`))",
+		},
+		"audit_log": {
+			"drop":           "DROP TABLE IF EXISTS audit_log",
+			"create_mysql":   "CREATE TABLE `audit_log` ( `audit_id` bigint(20) NOT NULL AUTO_INCREMENT, `household_id` int(11) NOT NULL DEFAULT 0, `actor_id` bigint(20) NOT NULL DEFAULT 0, `action` varchar(63) NOT NULL, `entity_type` varchar(31) NOT NULL DEFAULT '', `entity_id` bigint(20) NOT NULL DEFAULT 0, `before_json` TEXT NOT NULL, `after_json` TEXT NOT NULL, `created` bigint(20) NOT NULL, PRIMARY KEY (`audit_id`), KEY `household` (`household_id`, `audit_id`), KEY `actor` (`actor_id`), KEY `entity` (`entity_type`, `entity_id`), KEY `created` (`created`))",
+			"create_sqlite3": "CREATE TABLE `audit_log` ( `audit_id` INTEGER PRIMARY KEY, `household_id` INTEGER NOT NULL DEFAULT 0, `actor_id` INTEGER NOT NULL DEFAULT 0, `action` varchar(63) NOT NULL, `entity_type` varchar(31) NOT NULL DEFAULT '', `entity_id` INTEGER NOT NULL DEFAULT 0, `before_json` TEXT NOT NULL, `after_json` TEXT NOT NULL, `created` INTEGER NOT NULL)",
+		},
+		"schema_version": {
+			"drop":           "DROP TABLE IF EXISTS schema_version",
+			"create_mysql":   "CREATE TABLE `schema_version` ( `version` int(11) NOT NULL)",
+			"create_sqlite3": "CREATE TABLE `schema_version` ( `version` INTEGER NOT NULL)",
 		},
 	}
 
@@ -68,6 +119,17 @@ func bootstrap(force bool) {
 		panic(fmt.Sprintf("error creating transaction? %v", err))
 	}
 
+	// Tables with foreign keys go first so they don't block dropping the
+	// tables they reference
+	for _, table := range []string{"note", "recipe_label", "label_alias"} {
+		if _, err := tx.Exec(info[table]["drop"]); err != nil {
+			fmt.Println("Error dropping: ", err)
+		}
+	}
+
+	fmt.Println("Initializing Label Types")
+	initializeTable(tx, info["label_type"])
+
 	fmt.Println("Initializing Labels")
 	initializeTable(tx, info["label"])
 
@@ -77,12 +139,39 @@ func bootstrap(force bool) {
 	fmt.Println("Initializing Recipe-Label")
 	initializeTable(tx, info["recipe_label"])
 
+	fmt.Println("Initializing Label Aliases")
+	initializeTable(tx, info["label_alias"])
+
 	fmt.Println("Initializing Notes")
 	initializeTable(tx, info["note"])
 
 	fmt.Println("Initializing Users")
 	initializeTable(tx, info["user"])
 
+	fmt.Println("Initializing Households")
+	initializeTable(tx, info["household"])
+
+	fmt.Println("Initializing Household Members")
+	initializeTable(tx, info["household_user"])
+
+	fmt.Println("Initializing User Identities")
+	initializeTable(tx, info["user_identity"])
+
+	fmt.Println("Initializing API Keys")
+	initializeTable(tx, info["api_key"])
+
+	fmt.Println("Initializing Login Lockouts")
+	initializeTable(tx, info["login_lockout"])
+
+	fmt.Println("Initializing Audit Log")
+	initializeTable(tx, info["audit_log"])
+
+	fmt.Println("Initializing Schema Version")
+	initializeTable(tx, info["schema_version"])
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", schemaVersion); err != nil {
+		fmt.Println("Error recording schema version:", err)
+	}
+
 	tx.Commit()
 }
 
@@ -94,6 +183,10 @@ func initializeTable(tx *sql.Tx, info map[string]string) {
 		fmt.Println("Error creating: ", err)
 	}
 
+	if info["filename"] == "" {
+		return // Nothing to load
+	}
+
 	file, err := os.Open(info["filename"])
 	if err != nil {
 		fmt.Println("Error opening bootstrapping file:", err)
@@ -119,7 +212,7 @@ func initializeTable(tx *sql.Tx, info map[string]string) {
 		}
 
 		id := record[0]
-		if id == "label_id" || id == "recipe_id" || id == "user_id" || id == "note_id" {
+		if id == "label_id" || id == "label_type_id" || id == "recipe_id" || id == "user_id" || id == "note_id" || id == "household_id" {
 			continue //skip headers
 		}
 
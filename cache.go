@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedResponses bounds the public cache; paging and field selection
+// make the number of distinct URLs unbounded
+const maxCachedResponses = 256
+
+// responseCache holds whole responses to public GETs. Any admin change to
+// recipes or labels empties it, so it never serves anything stale; it only
+// saves recomputing listings between changes.
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]cachedResponse
+	generation int
+	modified   time.Time
+}
+
+type cachedResponse struct {
+	header   http.Header
+	body     []byte
+	modified time.Time
+}
+
+var publicCache = &responseCache{entries: map[string]cachedResponse{}, modified: time.Now()}
+
+// invalidate drops every cached response and marks the data as changed now
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]cachedResponse{}
+	c.generation++
+	c.modified = time.Now()
+}
+
+func (c *responseCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+// snapshot returns the current generation and when it started
+func (c *responseCache) snapshot() (int, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation, c.modified
+}
+
+// put stores a response unless the cache was invalidated while it was
+// being built, in which case it may already be out of date
+func (c *responseCache) put(key string, generation int, entry cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= maxCachedResponses {
+		c.entries = map[string]cachedResponse{}
+	}
+	c.entries[key] = entry
+}
+
+// cachedPublic serves a public GET route from publicCache, adding
+// Cache-Control and Last-Modified and answering conditional requests
+func cachedPublic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.URL.RequestURI()
+		entry, ok := publicCache.get(key)
+		if !ok {
+			generation, modified := publicCache.snapshot()
+			// Build the full response even if the client already has it
+			plain := r.Clone(r.Context())
+			plain.Header.Del("If-None-Match")
+			plain.Header.Del("If-Modified-Since")
+			rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+			next.ServeHTTP(rec, plain)
+
+			if rec.status != http.StatusOK {
+				rec.replay(w)
+				return
+			}
+			entry = cachedResponse{header: rec.header, body: rec.body.Bytes(), modified: modified}
+			publicCache.put(key, generation, entry)
+		}
+		serveCached(w, r, entry)
+	})
+}
+
+func serveCached(w http.ResponseWriter, r *http.Request, entry cachedResponse) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Last-Modified", entry.modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", publicCacheControl())
+
+	if notModified(r, w.Header().Get("ETag"), entry.modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(entry.body)
+}
+
+// notModified evaluates If-None-Match, or failing that If-Modified-Since
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etag != "" && etagListed(header, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+func publicCacheControl() string {
+	if conf.PublicCacheMaxAge > 0 {
+		return fmt.Sprintf("public, max-age=%d", conf.PublicCacheMaxAge)
+	}
+	return "public, no-cache"
+}
+
+// cacheControl sets a route group's Cache-Control header
+func cacheControl(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", value)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// invalidatesPublicCache empties publicCache after any successful admin
+// change to recipes, labels or the trash
+func invalidatesPublicCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if r.Method == http.MethodGet || sw.Status() >= 400 {
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/admin/recipe") || strings.HasPrefix(r.URL.Path, "/admin/label") || strings.HasPrefix(r.URL.Path, "/admin/trash") {
+			publicCache.invalidate()
+		}
+	})
+}
+
+// statusWriter remembers the status a handler sent
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Status is the status sent, which is 200 if the handler never said
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// responseRecorder captures a response so it can be cached
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status = status
+		rec.wrote = true
+	}
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(p)
+}
+
+func (rec *responseRecorder) replay(w http.ResponseWriter) {
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate, gzip;q=1.0":     "gzip",
+		"deflate":                 "deflate",
+		"gzip;q=0, deflate":       "deflate",
+		"br, *":                   "gzip",
+		"*, gzip;q=0":             "deflate",
+		"identity":                "",
+		"GZIP ; q=0.5, identity ": "gzip",
+	}
+	for header, want := range tests {
+		if got := acceptedEncoding(header); got != want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+	large := `[` + strings.Repeat(`{"Title": "Soup"},`, 200) + `{}]`
+	handler := compressResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(large[:500]))
+			w.Write([]byte(large[500:]))
+		case "/small":
+			w.Write([]byte(`{"ok": true}`))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte{0}, 2*minCompressSize))
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	get := func(path string, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for encoding, reader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil },
+	} {
+		rr := get("/large", encoding)
+		if rr.Header().Get("Content-Encoding") != encoding || rr.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Expected %s encoding and Vary, got headers %v", encoding, rr.Header())
+		}
+		body, err := reader(rr.Body)
+		if err != nil {
+			t.Fatalf("Could not read %s body: %v", encoding, err)
+		}
+		if plain, _ := io.ReadAll(body); string(plain) != large {
+			t.Errorf("%s body did not round-trip: got %d bytes, want %d", encoding, len(plain), len(large))
+		}
+	}
+
+	if rr := get("/large", ""); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != large {
+		t.Errorf("Expected an uncompressed body without Accept-Encoding")
+	}
+	if rr := get("/small", "gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != `{"ok": true}` {
+		t.Errorf("Expected small bodies to be sent as is, got %q", rr.Body.String())
+	}
+	if rr := get("/image", "gzip"); rr.Header().Get("Content-Encoding") != "" || rr.Body.Len() != 2*minCompressSize {
+		t.Errorf("Expected images to be sent as is")
+	}
+	if rr := get("/empty", "gzip"); rr.Code != http.StatusNoContent || rr.Body.Len() != 0 || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Expected a bare 204, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+}
+
+func TestPublicCache(t *testing.T) {
+	setupIntegrationTest()
+	publicCache.invalidate()
+	list := cachedPublic(wrappedHandler(getRecipeList))
+	create := invalidatesPublicCache(wrappedHandler(createNewRecipe))
+	get := func(header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/recipes/", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		list.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := get("", "")
+	if first.Code != http.StatusOK || first.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Fatalf("Expected a 200 with Cache-Control, got %d %v", first.Code, first.Header())
+	}
+	modified, err := http.ParseTime(first.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Expected a Last-Modified header, got %v", err)
+	}
+
+	// Changes made behind the cache's back aren't seen...
+	db.Exec("UPDATE recipe SET title = 'Sneaky' WHERE household_id = 1")
+	if again := get("", ""); again.Body.String() != first.Body.String() {
+		t.Errorf("Expected the cached listing, got a fresh one")
+	}
+	if rr := get("If-Modified-Since", modified.Format(http.TimeFormat)); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, got %d", rr.Code)
+	}
+	if rr := get("If-None-Match", first.Header().Get("ETag")); rr.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-None-Match, got %d", rr.Code)
+	}
+
+	// ...and failed admin requests leave it alone...
+	rr := httptest.NewRecorder()
+	create.ServeHTTP(rr, jsonRequest("POST", "/admin/recipe/", `{"title": ""}`))
+	if rr.Code != http.StatusBadRequest || get("", "").Body.String() != first.Body.String() {
+		t.Errorf("Expected a rejected create (got %d) to leave the cache alone", rr.Code)
+	}
+
+	// ...but admin changes empty it
+	time.Sleep(time.Second) // Last-Modified has one-second resolution
+	rr = httptest.NewRecorder()
+	create.ServeHTTP(rr, jsonRequest("POST", "/admin/recipe/", `{"title": "Fresh", "activeTime": 1, "totalTime": 2}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected the recipe to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	fresh := get("If-Modified-Since", modified.Format(http.TimeFormat))
+	if fresh.Code != http.StatusOK || !strings.Contains(fresh.Body.String(), "Fresh") || !strings.Contains(fresh.Body.String(), "Sneaky") {
+		t.Errorf("Expected a fresh listing after the change, got %d: %.100s", fresh.Code, fresh.Body.String())
+	}
+	if fresh.Header().Get("Last-Modified") == first.Header().Get("Last-Modified") {
+		t.Errorf("Expected Last-Modified to move on after the change")
+	}
+}
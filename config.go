@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// envPrefix starts the environment variable for every configuration field:
+// DbDSN is GORECIPES_DB_DSN, OIDCClientID is GORECIPES_OIDC_CLIENT_ID
+const envPrefix = "GORECIPES_"
+
+// secretFields can also be read from the file named by the field of the same
+// name plus "File", and are never printed
+var secretFields = []string{"DbDSN", "JwtSecret", "OIDCClientSecret"}
+
+// loadConfiguration layers the config file (if there is one), environment
+// variables and secret files into c, in that order. A missing file is only
+// an error if required.
+func loadConfiguration(c *configuration, filename string, required bool) error {
+	if err := readConfiguration(c, filename); err != nil {
+		if required || !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := applyEnvironment(c, os.LookupEnv); err != nil {
+		return err
+	}
+	return readSecretFiles(c)
+}
+
+func readConfiguration(c *configuration, configFilename string) error {
+	file, err := os.Open(configFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	return decoder.Decode(&c)
+}
+
+// envName is the environment variable that overrides a configuration field
+func envName(field string) string {
+	var name strings.Builder
+	runes := []rune(field)
+	for i, r := range runes {
+		// A word starts at an upper-case letter after a lower-case one, or
+		// at the last upper-case letter of an acronym followed by lower case
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return envPrefix + name.String()
+}
+
+// applyEnvironment overrides c's fields with any environment variables set
+// for them. Lists are comma-separated. Every unparsable value is reported.
+func applyEnvironment(c *configuration, lookup func(string) (string, bool)) error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := envName(field.Name)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be true or false", name))
+				continue
+			}
+			v.Field(i).SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer", name))
+				continue
+			}
+			v.Field(i).SetInt(int64(n))
+		case reflect.Slice:
+			list := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			v.Field(i).Set(reflect.ValueOf(list))
+		default:
+			panic(fmt.Sprintf("applyEnvironment: unsupported field type %v", field.Type))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readSecretFiles fills each secret from its file, if one is named. A
+// trailing newline, which most editors and secret stores add, is dropped.
+func readSecretFiles(c *configuration) error {
+	var errs []error
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range secretFields {
+		filename := v.FieldByName(name + "File").String()
+		if filename == "" {
+			continue
+		}
+		if v.FieldByName(name).String() != "" {
+			errs = append(errs, fmt.Errorf("set %s or %sFile, not both", name, name))
+			continue
+		}
+		secret, err := os.ReadFile(filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%sFile: %w", name, err))
+			continue
+		}
+		v.FieldByName(name).SetString(strings.TrimRight(string(secret), "\r\n"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateConfiguration reports everything wrong with c at once
+func validateConfiguration(c configuration) error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.DbDialect != "sqlite3" && c.DbDialect != "mysql" {
+		fail("DbDialect must be \"sqlite3\" or \"mysql\"")
+	}
+	if c.DbDSN == "" {
+		fail("DbDSN is required")
+	}
+	if c.JwtSecret == "" {
+		fail("JwtSecret is required")
+	}
+	if !c.Debug && len(c.Origins) == 0 {
+		fail("Origins are required when not running under debug")
+	}
+
+	if scheme := strings.ToLower(c.PasswordScheme); scheme != "" && scheme != schemeBcrypt && scheme != schemeArgon2id {
+		fail("PasswordScheme must be %q or %q", schemeBcrypt, schemeArgon2id)
+	}
+	if c.BcryptCost != 0 && (c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost) {
+		fail("BcryptCost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if c.OIDCIssuer != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		fail("OIDCClientID and OIDCRedirectURL are required when OIDCIssuer is set")
+	}
+	if c.OIDCDefaultRole != "" {
+		if err := validateRole(Role(strings.ToLower(c.OIDCDefaultRole))); err != nil {
+			fail("OIDCDefaultRole: %v", err)
+		}
+	}
+
+	for _, allowed := range c.MetricsAllowFrom {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			fail("MetricsAllowFrom: %q is not an IP address or CIDR", allowed)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		fail("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if c.UnixSocketMode != "" {
+		if _, err := strconv.ParseUint(c.UnixSocketMode, 8, 32); err != nil {
+			fail("UnixSocketMode must be an octal file mode like \"0660\"")
+		}
+	}
+
+	if c.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+			fail("LogLevel must be \"debug\", \"info\", \"warn\" or \"error\"")
+		}
+	}
+	if format := strings.ToLower(c.LogFormat); format != "" && format != "text" && format != "json" {
+		fail("LogFormat must be \"text\" or \"json\"")
+	}
+
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Field(i); field.Kind() == reflect.Int && field.Int() < 0 {
+			fail("%s must not be negative", v.Type().Field(i).Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// redactedConfiguration is c as JSON with its secrets blanked out, for
+// printing. Only the password is hidden in a database DSN.
+func redactedConfiguration(c configuration) string {
+	for _, name := range secretFields {
+		field := reflect.ValueOf(&c).Elem().FieldByName(name)
+		if field.String() == "" {
+			continue
+		}
+		if name == "DbDSN" {
+			field.SetString(redactDSN(field.String()))
+		} else {
+			field.SetString("REDACTED")
+		}
+	}
+	out, _ := json.MarshalIndent(c, "", "\t")
+	return string(out)
+}
+
+// redactDSN hides the password in a "user:password@..." DSN or URL
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			return u.String()
+		}
+	}
+	at := strings.LastIndex(dsn, "@")
+	colon := strings.Index(dsn, ":")
+	if at < 0 || colon < 0 || colon > at {
+		return dsn
+	}
+	return dsn[:colon+1] + "REDACTED" + dsn[at:]
+}
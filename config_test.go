@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"Debug":                 "GORECIPES_DEBUG",
+		"DbDSN":                 "GORECIPES_DB_DSN",
+		"JwtSecretFile":         "GORECIPES_JWT_SECRET_FILE",
+		"OIDCClientID":          "GORECIPES_OIDC_CLIENT_ID",
+		"LoginMaxFailuresPerIP": "GORECIPES_LOGIN_MAX_FAILURES_PER_IP",
+		"TLSCertFile":           "GORECIPES_TLS_CERT_FILE",
+	}
+	for field, want := range tests {
+		if got := envName(field); got != want {
+			t.Errorf("envName(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestLoadConfigurationLayers(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "gorecipes.conf")
+	os.WriteFile(configFile, []byte(`{"DbDialect": "sqlite3", "DbDSN": "file.db", "BcryptCost": 12, "Origins": ["http://a"]}`), 0600)
+	secretFile := filepath.Join(dir, "jwt")
+	os.WriteFile(secretFile, []byte("from-a-file\n"), 0600)
+
+	t.Setenv("GORECIPES_DB_DSN", "env.db")
+	t.Setenv("GORECIPES_DEBUG", "true")
+	t.Setenv("GORECIPES_ORIGINS", "http://b, http://c")
+	t.Setenv("GORECIPES_JWT_SECRET_FILE", secretFile)
+
+	var c configuration
+	if err := loadConfiguration(&c, configFile, true); err != nil {
+		t.Fatalf("loadConfiguration() returned error: %v", err)
+	}
+	if c.DbDialect != "sqlite3" || c.BcryptCost != 12 {
+		t.Errorf("Expected values from the file to stay, got %+v", c)
+	}
+	if c.DbDSN != "env.db" || !c.Debug || !reflect.DeepEqual(c.Origins, []string{"http://b", "http://c"}) {
+		t.Errorf("Expected the environment to override the file, got %+v", c)
+	}
+	if c.JwtSecret != "from-a-file" {
+		t.Errorf("Expected JwtSecret from its file, got %q", c.JwtSecret)
+	}
+
+	// The default file is optional; one asked for by name is not
+	var fromEnv configuration
+	if err := loadConfiguration(&fromEnv, filepath.Join(dir, "missing.conf"), false); err != nil || fromEnv.DbDSN != "env.db" {
+		t.Errorf("Expected a missing optional file to be skipped, got %v and %+v", err, fromEnv)
+	}
+	if err := loadConfiguration(&fromEnv, filepath.Join(dir, "missing.conf"), true); err == nil {
+		t.Errorf("Expected an error for a missing required file")
+	}
+
+	// Every problem is reported, not just the first
+	t.Setenv("GORECIPES_BCRYPT_COST", "high")
+	t.Setenv("GORECIPES_DEBUG", "maybe")
+	t.Setenv("GORECIPES_JWT_SECRET", "also-set")
+	err := loadConfiguration(&configuration{}, configFile, true)
+	for _, want := range []string{"GORECIPES_BCRYPT_COST must be an integer", "GORECIPES_DEBUG must be true or false"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error %q, got %v", want, err)
+		}
+	}
+	t.Setenv("GORECIPES_BCRYPT_COST", "12")
+	t.Setenv("GORECIPES_DEBUG", "false")
+	if err := loadConfiguration(&configuration{}, configFile, true); err == nil || !strings.Contains(err.Error(), "set JwtSecret or JwtSecretFile, not both") {
+		t.Errorf("Expected an error for a secret set twice, got %v", err)
+	}
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	valid := configuration{DbDialect: "mysql", DbDSN: "u:p@tcp(db)/recipes", JwtSecret: "s", Origins: []string{"http://a"}}
+	if err := validateConfiguration(valid); err != nil {
+		t.Errorf("validateConfiguration() returned error for a valid config: %v", err)
+	}
+
+	invalid := configuration{
+		DbDialect:          "postgres",
+		BcryptCost:         99,
+		OIDCIssuer:         "https://idp",
+		OIDCDefaultRole:    "overlord",
+		TLSCertFile:        "cert.pem",
+		UnixSocketMode:     "rw",
+		ReadTimeoutSeconds: -1,
+		LogLevel:           "loud",
+		LogFormat:          "xml",
+		MetricsAllowFrom:   []string{"10.0.0.0/8", "prometheus"},
+	}
+	err := validateConfiguration(invalid)
+	if err == nil {
+		t.Fatalf("validateConfiguration() accepted an invalid config")
+	}
+	for _, want := range []string{"DbDialect", "DbDSN is required", "JwtSecret is required", "Origins", "BcryptCost", "OIDCClientID", "OIDCDefaultRole", "TLSKeyFile", "UnixSocketMode", "ReadTimeoutSeconds must not be negative", "LogLevel", "LogFormat", `MetricsAllowFrom: "prometheus"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error about %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestRedactedConfiguration(t *testing.T) {
+	c := configuration{
+		DbDSN:            "gorecipes:hunter2@tcp(db:3306)/recipes?charset=utf8mb4",
+		JwtSecret:        "deadbeef",
+		OIDCClientSecret: "shh",
+		OIDCClientID:     "gorecipes-web",
+	}
+	out := redactedConfiguration(c)
+	for _, secret := range []string{"hunter2", "deadbeef", "shh"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("Expected %q to be redacted from:\n%s", secret, out)
+		}
+	}
+	for _, kept := range []string{"gorecipes:REDACTED@tcp(db:3306)/recipes", "gorecipes-web"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("Expected %q in:\n%s", kept, out)
+		}
+	}
+	if c.JwtSecret != "deadbeef" {
+		t.Errorf("redactedConfiguration() should not change its argument")
+	}
+
+	for dsn, want := range map[string]string{
+		"recipes_sqlite.db":         "recipes_sqlite.db",
+		"mysql://u:pw@db/recipes":   "mysql://u:REDACTED@db/recipes",
+		"user:p@ss@tcp(db)/recipes": "user:REDACTED@tcp(db)/recipes",
+		"file:test.db?cache=shared": "file:test.db?cache=shared",
+	} {
+		if got := redactDSN(dsn); got != want {
+			t.Errorf("redactDSN(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
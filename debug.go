@@ -10,7 +10,7 @@ import (
 func debugRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !conf.Debug {
-			http.Error(w, "token validation only available for debugging", http.StatusForbidden)
+			writeError(w, r, &appError{http.StatusForbidden, "token validation only available for debugging", nil, "debug_disabled"})
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -22,7 +22,7 @@ func validateJwt(w http.ResponseWriter, r *http.Request) *appError {
 	tokenString := strings.TrimSpace(header)
 	_, err := jwtExtractClaims(tokenString)
 	if err != nil {
-		return &appError{http.StatusBadRequest, "invalid auth token", err}
+		return &appError{http.StatusBadRequest, "invalid auth token", err, "invalid_token"}
 	}
 	w.WriteHeader(http.StatusOK)
 	return nil
@@ -33,7 +33,7 @@ func getHash(w http.ResponseWriter, r *http.Request) *appError {
 	var password = r.FormValue("password")
 	hash, err := hashPassword(password)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "problem hashing password", err}
+		return &appError{http.StatusInternalServerError, "problem hashing password", err, "internal_error"}
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"hash": hash})
 	return nil
@@ -41,9 +41,9 @@ func getHash(w http.ResponseWriter, r *http.Request) *appError {
 
 func getJwt(w http.ResponseWriter, r *http.Request) *appError {
 	// Debug token with admin=true for testing
-	tokenStr, err := jwtGenerate(1, true)
+	tokenStr, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not sign token", err}
+		return &appError{http.StatusInternalServerError, "could not sign token", err, "internal_error"}
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokenStr})
 	return nil
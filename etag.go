@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionETag is the ETag for a recipe, label or note at a version
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersion returns the version a mutating request's If-Match header
+// expects, or 0 if any version will do. Only a single strong ETag from
+// versionETag (or "*") can be matched; anything else never matches.
+func ifMatchVersion(r *http.Request) (int, *appError) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if conf.RequireIfMatch {
+			return 0, &appError{http.StatusPreconditionRequired, "If-Match header is required", nil, "precondition_required"}
+		}
+		return 0, nil
+	}
+	if header == "*" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || version < 1 || !strings.HasPrefix(header, `"`) {
+		return 0, preconditionFailed(err)
+	}
+	return version, nil
+}
+
+// checkIfMatch is for handlers that have already loaded the current version
+func checkIfMatch(r *http.Request, current int) *appError {
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	if version != 0 && version != current {
+		return preconditionFailed(nil)
+	}
+	return nil
+}
+
+func preconditionFailed(err error) *appError {
+	return &appError{http.StatusPreconditionFailed, "resource has changed; reload and try again", err, "version_mismatch"}
+}
+
+// writeJSONWithETag encodes v with the given ETag, or a hash of the body if
+// etag is empty, and answers 304 Not Modified instead when the client's
+// If-None-Match already names it
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, etag string, v interface{}) {
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(v)
+	if etag == "" {
+		sum := sha256.Sum256(body.Bytes())
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+
+	w.Header().Set("ETag", etag)
+	if etagListed(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body.Bytes())
+}
+
+// etagListed does the weak comparison If-None-Match calls for
+func etagListed(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// integrityCheck finds one kind of row that the foreign keys (or household
+// scoping) should have ruled out
+type integrityCheck struct {
+	Name  string
+	Table string
+	Where string // selects the bad rows of Table
+}
+
+var integrityChecks = []integrityCheck{
+	{
+		Name:  "recipe-label links to missing recipes",
+		Table: "recipe_label",
+		Where: "NOT EXISTS (SELECT 1 FROM recipe WHERE recipe.recipe_id = recipe_label.recipe_id)",
+	},
+	{
+		Name:  "recipe-label links to missing labels",
+		Table: "recipe_label",
+		Where: "NOT EXISTS (SELECT 1 FROM label WHERE label.label_id = recipe_label.label_id)",
+	},
+	{
+		Name:  "recipe-label links across households",
+		Table: "recipe_label",
+		Where: "EXISTS (SELECT 1 FROM recipe JOIN label ON label.household_id <> recipe.household_id " +
+			"WHERE recipe.recipe_id = recipe_label.recipe_id AND label.label_id = recipe_label.label_id)",
+	},
+	{
+		Name:  "notes on missing recipes",
+		Table: "note",
+		Where: "NOT EXISTS (SELECT 1 FROM recipe WHERE recipe.recipe_id = note.recipe_id)",
+	},
+	{
+		Name:  "aliases of missing labels",
+		Table: "label_alias",
+		Where: "NOT EXISTS (SELECT 1 FROM label WHERE label.label_id = label_alias.label_id)",
+	},
+}
+
+// IntegrityProblem is how many rows failed one check, and whether they
+// were deleted
+type IntegrityProblem struct {
+	Check    string
+	Rows     int
+	Repaired bool
+}
+
+// checkIntegrity runs every check and, if repair is set, deletes the rows
+// that fail them, all in one transaction
+func checkIntegrity(ctx context.Context, repair bool) (problems []IntegrityProblem, err error) {
+	connect()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, check := range integrityChecks {
+		var rows int
+		if err = tx.GetContext(ctx, &rows, "SELECT count(*) FROM "+check.Table+" WHERE "+check.Where); err != nil {
+			return nil, fmt.Errorf("%s: %w", check.Name, err)
+		}
+		if rows == 0 {
+			continue
+		}
+		problem := IntegrityProblem{Check: check.Name, Rows: rows}
+		if repair {
+			if _, err = tx.ExecContext(ctx, "DELETE FROM "+check.Table+" WHERE "+check.Where); err != nil {
+				return nil, fmt.Errorf("repairing %s: %w", check.Name, err)
+			}
+			problem.Repaired = true
+		}
+		problems = append(problems, problem)
+	}
+	err = tx.Commit()
+	return problems, err
+}
+
+// fsck runs the integrity checks for --fsck and --repair, reporting to w.
+// It returns false if problems were found and left alone.
+func fsck(w io.Writer, repair bool) (bool, error) {
+	problems, err := checkIntegrity(context.Background(), repair)
+	if err != nil {
+		return false, err
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found")
+		return true, nil
+	}
+	for _, problem := range problems {
+		if problem.Repaired {
+			fmt.Fprintf(w, "%s: deleted %d\n", problem.Check, problem.Rows)
+		} else {
+			fmt.Fprintf(w, "%s: %d\n", problem.Check, problem.Rows)
+		}
+	}
+	if !repair {
+		fmt.Fprintln(w, "Run with --repair to delete them")
+	}
+	return repair, nil
+}
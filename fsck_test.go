@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	setupIntegrationTest()
+
+	var out bytes.Buffer
+	if ok, err := fsck(&out, false); !ok || err != nil || !strings.Contains(out.String(), "No problems") {
+		t.Fatalf("Expected the sample data to pass, got %v %v: %s", ok, err, out.String())
+	}
+
+	// Older databases don't have foreign keys to stop this
+	db.Exec("PRAGMA foreign_keys = OFF")
+	defer db.Exec("PRAGMA foreign_keys = ON")
+	db.Exec("INSERT INTO recipe_label (recipe_id, label_id) VALUES (9001, 1), (9002, 1), (1, 9001)")
+	db.Exec("INSERT INTO note (household_id, recipe_id, create_date, note) VALUES (1, 9001, 0, 'lost')")
+	db.Exec("INSERT INTO label (label_id, household_id, label) VALUES (500, 2, 'theirs')")
+	db.Exec("INSERT INTO recipe_label (recipe_id, label_id) VALUES (1, 500)")
+	db.Exec("INSERT INTO label_alias (household_id, alias, label_id) VALUES (1, 'gone', 9001)")
+
+	problems, err := checkIntegrity(context.Background(), false)
+	if err != nil {
+		t.Fatalf("checkIntegrity() returned error: %v", err)
+	}
+	want := map[string]int{
+		"recipe-label links to missing recipes": 2,
+		"recipe-label links to missing labels":  1,
+		"recipe-label links across households":  1,
+		"notes on missing recipes":              1,
+		"aliases of missing labels":             1,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d problems, got %+v", len(want), problems)
+	}
+	for _, problem := range problems {
+		if problem.Rows != want[problem.Check] || problem.Repaired {
+			t.Errorf("Expected %d unrepaired for %q, got %+v", want[problem.Check], problem.Check, problem)
+		}
+	}
+
+	out.Reset()
+	if ok, _ := fsck(&out, false); ok || !strings.Contains(out.String(), "--repair") {
+		t.Errorf("Expected --fsck to fail and suggest --repair, got %s", out.String())
+	}
+	out.Reset()
+	if ok, err := fsck(&out, true); !ok || err != nil || !strings.Contains(out.String(), "notes on missing recipes: deleted 1") {
+		t.Errorf("Expected --repair to succeed, got %v %v: %s", ok, err, out.String())
+	}
+	if problems, _ := checkIntegrity(context.Background(), false); len(problems) != 0 {
+		t.Errorf("Expected nothing left after repair, got %+v", problems)
+	}
+	if labels, _ := labelsByRecipeID(context.Background(), 1, 1); len(labels) != 1 {
+		t.Errorf("Expected repair to keep recipe 1's good link, got %v", labels)
+	}
+}
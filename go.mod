@@ -13,4 +13,7 @@ require (
 	golang.org/x/crypto v0.48.0
 )
 
-require github.com/lib/pq v1.10.7 // indirect
+require (
+	github.com/lib/pq v1.10.7 // indirect
+	golang.org/x/sys v0.41.0 // indirect
+)
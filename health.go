@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// readyTimeout bounds how long /readyz waits on the database
+const readyTimeout = 2 * time.Second
+
+// healthz reports that the process is up and serving; it checks nothing else
+func healthz(w http.ResponseWriter, r *http.Request) *appError {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok"})
+	return nil
+}
+
+// readyz reports whether the server can handle requests: the database
+// answers within readyTimeout and its schema is the one this build expects
+func readyz(w http.ResponseWriter, r *http.Request) *appError {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if db == nil {
+		return &appError{http.StatusServiceUnavailable, "Database is not connected", nil, "not_ready"}
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return &appError{http.StatusServiceUnavailable, "Database is unreachable", err, "not_ready"}
+	}
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return &appError{http.StatusServiceUnavailable, "Could not read the schema version", err, "not_ready"}
+	}
+	if version != schemaVersion {
+		message := fmt.Sprintf("Database schema is version %d, expected %d; run the migrations", version, schemaVersion)
+		return &appError{http.StatusServiceUnavailable, message, nil, "not_ready"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ready", "schemaVersion": version})
+	return nil
+}
+
+// getVersion reports what was built: the module version, Go version and,
+// when built from a checkout, the commit
+func getVersion(w http.ResponseWriter, r *http.Request) *appError {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return &appError{http.StatusInternalServerError, "Build information is unavailable", nil, "internal_error"}
+	}
+	version := map[string]interface{}{
+		"version":   info.Main.Version,
+		"goVersion": info.GoVersion,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version["revision"] = setting.Value
+		case "vcs.time":
+			version["time"] = setting.Value
+		case "vcs.modified":
+			version["modified"] = setting.Value == "true"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(version)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	conf = configuration{}
+	rr := httptest.NewRecorder()
+	newHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"ok"`) {
+		t.Errorf("Expected 200 ok, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Expected probes not to be cached, got %q", rr.Header().Get("Cache-Control"))
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	setupIntegrationTest()
+	ready := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		wrappedHandler(readyz).ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := ready(); rr.Code != http.StatusOK {
+		t.Errorf("Expected a freshly bootstrapped database to be ready, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	db.Exec("UPDATE schema_version SET version = ?", schemaVersion-1)
+	rr := ready()
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "run the migrations") {
+		t.Errorf("Expected 503 for an old schema, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	db.Exec("DROP TABLE schema_version")
+	if rr := ready(); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a schema_version table, got %d", rr.Code)
+	}
+
+	// A database that has gone away makes the server not ready, not crash
+	db.Close()
+	rr = ready()
+	var body struct {
+		Error struct{ Code string }
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if rr.Code != http.StatusServiceUnavailable || body.Error.Code != "not_ready" {
+		t.Errorf("Expected 503 not_ready for a closed database, got %d: %s", rr.Code, rr.Body.String())
+	}
+	db = nil
+}
+
+func TestVersion(t *testing.T) {
+	rr := httptest.NewRecorder()
+	wrappedHandler(getVersion).ServeHTTP(rr, httptest.NewRequest("GET", "/version", nil))
+	var version map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Expected JSON, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Code != http.StatusOK || !strings.HasPrefix(version["goVersion"].(string), "go") {
+		t.Errorf("Expected the Go version, got %d: %v", rr.Code, version)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -36,11 +39,12 @@ func setupTestRouter() *mux.Router {
 	privRouter.Use(authRequired)
 	privRouter.Handle("/recipes/", wrappedHandler(getAllRecipes)).Methods("GET")
 
-	// Admin-only mutating routes
+	// Mutating routes
 	adminRouter := router.PathPrefix("/admin").Subrouter()
 	adminRouter.Use(authRequired)
-	adminRouter.Use(adminRequired)
-	adminRouter.Handle("/recipe/", wrappedHandler(createNewRecipe)).Methods("POST")
+	adminRouter.Handle("/recipe/", requirePermission(PermEdit)(wrappedHandler(createNewRecipe))).Methods("POST")
+	adminRouter.Handle("/recipe/{id}/note/", requirePermission(PermContribute)(wrappedHandler(createNoteOnRecipe))).Methods("POST")
+	adminRouter.Handle("/recipe/{id}/hard", requirePermission(PermAdmin)(wrappedHandler(deleteRecipeHard))).Methods("DELETE")
 
 	return router
 }
@@ -53,7 +57,7 @@ func TestPrivRouteWithNonAdminToken(t *testing.T) {
 	router := setupTestRouter()
 
 	// Generate valid token for non-admin user
-	tokenStr, err := jwtGenerate(2, false)
+	tokenStr, err := jwtGenerate(2, RoleViewer, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -69,14 +73,14 @@ func TestPrivRouteWithNonAdminToken(t *testing.T) {
 	}
 }
 
-// TestAdminRouteWithNonAdminToken verifies that non-admin users get 403 on POST /admin/recipe/
+// TestAdminRouteWithNonAdminToken verifies that viewers get 403 on POST /admin/recipe/
 func TestAdminRouteWithNonAdminToken(t *testing.T) {
 	setupIntegrationTest()
 
 	router := setupTestRouter()
 
-	// Generate valid token for non-admin user (koko, ID=2)
-	tokenStr, err := jwtGenerate(2, false)
+	// Generate valid token for a viewer (guest, ID=4)
+	tokenStr, err := jwtGenerate(4, RoleViewer, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -89,12 +93,12 @@ func TestAdminRouteWithNonAdminToken(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	if w.Code != http.StatusForbidden {
-		t.Errorf("Expected status 403 for non-admin access to /admin/recipe/, got %d", w.Code)
+		t.Errorf("Expected status 403 for viewer access to /admin/recipe/, got %d", w.Code)
 	}
 
 	body := w.Body.String()
-	if !strings.Contains(body, "admin access required") {
-		t.Errorf("Expected 'admin access required' in response, got %q", body)
+	if !strings.Contains(body, "editor access required") {
+		t.Errorf("Expected 'editor access required' in response, got %q", body)
 	}
 }
 
@@ -105,7 +109,7 @@ func TestAdminRouteWithAdminToken(t *testing.T) {
 	router := setupTestRouter()
 
 	// Generate valid token for admin user (foo, ID=1)
-	tokenStr, err := jwtGenerate(1, true)
+	tokenStr, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -149,3 +153,136 @@ func TestAdminRouteWithoutToken(t *testing.T) {
 		t.Errorf("Expected 'missing auth token' in response, got %q", body)
 	}
 }
+
+// TestContributorCanAddNotesButNotHardDelete verifies the contributor role
+// reaches note creation but not admin-only routes
+func TestContributorCanAddNotesButNotHardDelete(t *testing.T) {
+	setupIntegrationTest()
+
+	router := setupTestRouter()
+
+	// koko (ID=2) is a contributor
+	tokenStr, err := jwtGenerate(2, RoleContributor, 1)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/admin/recipe/1/note/", strings.NewReader("text=needs+more+salt"))
+	req.Header.Set("x-access-token", tokenStr)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for contributor adding a note, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/recipe/1/hard", nil)
+	req.Header.Set("x-access-token", tokenStr)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for contributor hard delete, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "admin access required") {
+		t.Errorf("Expected 'admin access required' in response, got %q", w.Body.String())
+	}
+
+	// The recipe is still there
+	if _, err := recipeByID(context.Background(), 1, 1, false); err != nil {
+		t.Errorf("Recipe 1 should not have been deleted: %v", err)
+	}
+}
+
+// TestJSONErrorResponses verifies errors are JSON with stable codes when the
+// client accepts JSON, and plain text otherwise
+func TestJSONErrorResponses(t *testing.T) {
+	setupIntegrationTest()
+
+	router := setupTestRouter()
+	tokenStr, _ := jwtGenerate(1, RoleAdmin, 1)
+
+	type errorBody struct {
+		Error struct {
+			Code    string
+			Message string
+			Details []fieldError
+		}
+	}
+	send := func(req *http.Request) (*httptest.ResponseRecorder, errorBody) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var body errorBody
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("could not decode error body: %v", err)
+			}
+		}
+		return w, body
+	}
+
+	// Every invalid field is reported
+	req := httptest.NewRequest("POST", "/admin/recipe/", strings.NewReader("activeTime=soon&totalTime=30"))
+	req.Header.Set("x-access-token", tokenStr)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	w, body := send(req)
+	if w.Code != http.StatusBadRequest || body.Error.Code != "validation_failed" {
+		t.Fatalf("Expected 400 validation_failed, got %d %+v", w.Code, body)
+	}
+	want := []fieldError{{"title", "title is required"}, {"activeTime", "activeTime must be an integer"}}
+	if !reflect.DeepEqual(body.Error.Details, want) {
+		t.Errorf("Expected details %v, got %v", want, body.Error.Details)
+	}
+	if body.Error.Message != "title is required" {
+		t.Errorf("Expected first field's message, got %q", body.Error.Message)
+	}
+
+	// Old clients still get the plain-text message
+	req = httptest.NewRequest("POST", "/admin/recipe/", strings.NewReader("activeTime=soon&totalTime=30"))
+	req.Header.Set("x-access-token", tokenStr)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w, _ = send(req)
+	if w.Body.String() != "title is required\n" {
+		t.Errorf("Expected plain-text error, got %q", w.Body.String())
+	}
+
+	// Middleware errors use the same format
+	req = httptest.NewRequest("GET", "/priv/recipes/", nil)
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	w, body = send(req)
+	if w.Code != http.StatusUnauthorized || body.Error.Code != "auth_required" || body.Error.Message != "missing auth token" {
+		t.Errorf("Expected 401 auth_required, got %d %+v", w.Code, body)
+	}
+
+	viewerToken, _ := jwtGenerate(3, RoleViewer, 1)
+	req = httptest.NewRequest("DELETE", "/admin/recipe/1/hard", nil)
+	req.Header.Set("x-access-token", viewerToken)
+	req.Header.Set("Accept", "application/json")
+	w, body = send(req)
+	if w.Code != http.StatusForbidden || body.Error.Code != "insufficient_role" || body.Error.Details != nil {
+		t.Errorf("Expected 403 insufficient_role, got %d %+v", w.Code, body)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/plain", false},
+		{"application/json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/problem+json", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := acceptsJSON(req); got != tt.want {
+			t.Errorf("acceptsJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Recipe listings take these query parameters, all optional:
+//
+//	limit   recipes per page, up to maxRecipePageSize; without it every
+//	        recipe comes back at once
+//	sort    a key of recipeSortColumns, with a leading - for descending
+//	cursor  where the page starts, from a Link header
+//	fields  comma-separated Recipe fields to send; ID is always sent.
+//	        Notes are only loaded when asked for here
+//
+// Pages are linked with rel="next" and rel="prev" Link headers that keep
+// every other parameter, so clients only ever follow them.
+
+const maxRecipePageSize = 500
+
+// recipeFields are the Recipe fields fields= can pick, in output order
+var recipeFields = []string{"ID", "HouseholdID", "Title", "Body", "Time", "ActiveTime", "Deleted", "New", "Version", "Created", "LastCooked", "Labels", "Notes"}
+
+type recipeListing struct {
+	opts   RecipeListOptions
+	fields []string // nil sends every field
+}
+
+// parseRecipeListing reads a listing request's query parameters. Public
+// listings never include recipe bodies or notes.
+func parseRecipeListing(r *http.Request, private bool) (recipeListing, *appError) {
+	query := r.URL.Query()
+	listing := recipeListing{opts: RecipeListOptions{IncludeBody: private, WantLabels: true}}
+	var invalid validationErrors
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxRecipePageSize {
+			invalid.add("limit", fmt.Sprintf("limit must be an integer between 1 and %d", maxRecipePageSize))
+		}
+		listing.opts.Limit = limit
+	}
+	if v := query.Get("sort"); v != "" {
+		key := strings.TrimPrefix(v, "-")
+		if _, ok := recipeSortColumns[key]; !ok {
+			invalid.add("sort", "sort must be one of "+strings.Join(recipeSortKeys(), ", ")+", optionally prefixed with -")
+		}
+		listing.opts.SortKey = key
+		listing.opts.Descending = strings.HasPrefix(v, "-")
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			invalid.add("cursor", "cursor is not valid")
+		} else if cursor.SortKey != listing.opts.SortKey {
+			invalid.add("cursor", "cursor is for a different sort")
+		}
+		listing.opts.After = &cursor
+	}
+	for _, v := range query["label"] {
+		for _, id := range strings.Split(v, ",") {
+			labelID, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				invalid.add("label", "label must be a comma-separated list of label IDs")
+				break
+			}
+			listing.opts.LabelIDs = append(listing.opts.LabelIDs, labelID)
+		}
+	}
+	if v := query.Get("fields"); v != "" {
+		available := recipeFields
+		if !private {
+			available = []string{}
+			for _, name := range recipeFields {
+				if name != "Body" && name != "Notes" {
+					available = append(available, name)
+				}
+			}
+		}
+		listing.fields = []string{"ID"}
+		for _, name := range strings.Split(v, ",") {
+			field := matchField(strings.TrimSpace(name), available)
+			if field == "" {
+				invalid.add("fields", fmt.Sprintf("fields must be a comma-separated list of %s", strings.Join(available, ", ")))
+				break
+			}
+			if field != "ID" {
+				listing.fields = append(listing.fields, field)
+			}
+		}
+		listing.opts.IncludeBody = private && listing.wants("Body")
+		listing.opts.WantLabels = listing.wants("Labels")
+		listing.opts.WantNotes = private && listing.wants("Notes")
+	}
+	return listing, invalid.appError()
+}
+
+// recipeSortKeys lists the sort keys in a stable order for messages
+func recipeSortKeys() []string {
+	keys := []string{}
+	for key := range recipeSortColumns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// matchField finds name among fields, ignoring case
+func matchField(name string, fields []string) string {
+	for _, field := range fields {
+		if strings.EqualFold(name, field) {
+			return field
+		}
+	}
+	return ""
+}
+
+func (listing recipeListing) wants(field string) bool {
+	if listing.fields == nil {
+		return true
+	}
+	return matchField(field, listing.fields) != ""
+}
+
+func (listing recipeListing) paged() bool {
+	return listing.opts.Limit > 0 || listing.opts.After != nil
+}
+
+// writeRecipeListing sends a page of recipes with its Link headers. more
+// says whether the listing goes on past the page in the direction it was read.
+func writeRecipeListing(w http.ResponseWriter, r *http.Request, listing recipeListing, recipes []Recipe, more bool) {
+	if listing.paged() && len(recipes) > 0 {
+		backwards := listing.opts.After != nil && listing.opts.After.Before
+		// Whichever way we read, there's a page on the side we came from
+		if more || backwards {
+			next := cursorFor(recipes[len(recipes)-1], listing.opts.SortKey)
+			w.Header().Add("Link", pageLink(r, next, "next"))
+		}
+		if (backwards && more) || (!backwards && listing.opts.After != nil) {
+			prev := cursorFor(recipes[0], listing.opts.SortKey)
+			prev.Before = true
+			w.Header().Add("Link", pageLink(r, prev, "prev"))
+		}
+	}
+
+	if listing.fields == nil {
+		writeJSONWithETag(w, r, "", recipes)
+		return
+	}
+	trimmed := make([]map[string]interface{}, len(recipes))
+	for i, recipe := range recipes {
+		v := reflect.ValueOf(recipe)
+		trimmed[i] = make(map[string]interface{}, len(listing.fields))
+		for _, field := range listing.fields {
+			trimmed[i][field] = v.FieldByName(field).Interface()
+		}
+	}
+	writeJSONWithETag(w, r, "", trimmed)
+}
+
+// pageLink is a Link header value pointing at this listing from cursor on
+func pageLink(r *http.Request, cursor RecipeCursor, rel string) string {
+	query := r.URL.Query()
+	query.Set("cursor", encodeCursor(cursor))
+	target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf("<%s>; rel=%q", target.String(), rel)
+}
+
+func encodeCursor(cursor RecipeCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (RecipeCursor, error) {
+	var cursor RecipeCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return cursor, err
+	}
+	if cursor.SortKey != "title" {
+		if _, err := strconv.ParseInt(cursor.Value, 10, 64); err != nil {
+			return cursor, err
+		}
+	}
+	return cursor, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+var linkPattern = regexp.MustCompile(`<([^>]*)>; rel="(next|prev)"`)
+
+// listRecipes GETs /priv/recipes/ and returns the recipe IDs and Link targets
+func listRecipes(t *testing.T, target string) ([]int, map[string]string) {
+	t.Helper()
+	req := withClaims(httptest.NewRequest("GET", target, nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+	rr := httptest.NewRecorder()
+	if appErr := getAllRecipes(rr, req); appErr != nil {
+		t.Fatalf("getAllRecipes(%s) returned appError: %v", target, appErr)
+	}
+	var recipes []Recipe
+	if err := json.Unmarshal(rr.Body.Bytes(), &recipes); err != nil {
+		t.Fatalf("Could not decode %s: %v", target, err)
+	}
+	ids := []int{}
+	for _, recipe := range recipes {
+		ids = append(ids, recipe.ID)
+	}
+	links := map[string]string{}
+	for _, header := range rr.Header().Values("Link") {
+		for _, match := range linkPattern.FindAllStringSubmatch(header, -1) {
+			links[match[2]] = match[1]
+		}
+	}
+	return ids, links
+}
+
+func TestRecipeListingWalksEveryPage(t *testing.T) {
+	setupIntegrationTest()
+	// Give some recipes distinct created and cooked times; the rest tie at 0
+	db.Exec("UPDATE recipe SET created = recipe_id * 10 WHERE recipe_id % 3 = 0")
+	db.Exec("UPDATE recipe SET last_cooked = 100 WHERE recipe_id % 2 = 0")
+
+	for _, order := range []string{"", "&sort=title", "&sort=-title", "&sort=total_time", "&sort=-created", "&sort=last_cooked"} {
+		all, links := listRecipes(t, "/priv/recipes/?x=1"+order)
+		if len(links) != 0 {
+			t.Errorf("Unpaged listing %s should have no Link headers, got %v", order, links)
+		}
+
+		var forward []int
+		target := "/priv/recipes/?limit=4" + order
+		for pages := 0; target != ""; pages++ {
+			if pages > len(all) {
+				t.Fatalf("Paging %s never ended", order)
+			}
+			ids, links := listRecipes(t, target)
+			if len(ids) > 4 {
+				t.Errorf("Expected at most 4 recipes per page, got %d", len(ids))
+			}
+			if pages == 0 && links["prev"] != "" {
+				t.Errorf("First page %s should have no prev link", order)
+			}
+			forward = append(forward, ids...)
+			target = links["next"]
+			if target == "" && links["prev"] != "" {
+				// Walk back from the last page to check prev links too
+				var backward []int
+				for back := links["prev"]; back != ""; {
+					ids, links := listRecipes(t, back)
+					backward = append(ids, backward...)
+					back = links["prev"]
+				}
+				if want := forward[:len(forward)-len(ids)]; !reflect.DeepEqual(backward, want) {
+					t.Errorf("Paging back %s: expected %v, got %v", order, want, backward)
+				}
+			}
+		}
+		if !reflect.DeepEqual(forward, all) {
+			t.Errorf("Paging %s: expected %v, got %v", order, all, forward)
+		}
+	}
+}
+
+func TestRecipeListingSorts(t *testing.T) {
+	setupIntegrationTest()
+
+	recipes, _, err := recipeList(context.Background(), 1, RecipeListOptions{SortKey: "total_time", Descending: true})
+	if err != nil {
+		t.Fatalf("recipeList() returned error: %v", err)
+	}
+	sorted := sort.SliceIsSorted(recipes, func(i, j int) bool {
+		if recipes[i].Time != recipes[j].Time {
+			return recipes[i].Time > recipes[j].Time
+		}
+		return recipes[i].ID > recipes[j].ID
+	})
+	if !sorted {
+		t.Errorf("Expected recipes by total_time descending, then ID")
+	}
+	for _, recipe := range recipes {
+		if recipe.Body != "" || recipe.Labels != nil {
+			t.Fatalf("Expected no bodies or labels unless asked for, got %+v", recipe)
+		}
+	}
+
+	recipe, _ := createRecipe(context.Background(), 1, "Fresh", "", 1, 1, true, nil, nil)
+	if recipe.Created == 0 {
+		t.Errorf("Expected createRecipe to record when it was created")
+	}
+	if err := setRecipeNewFlag(context.Background(), 1, recipe.ID, false, 0); err != nil {
+		t.Fatalf("setRecipeNewFlag() returned error: %v", err)
+	}
+	recipes, _, _ = recipeList(context.Background(), 1, RecipeListOptions{SortKey: "last_cooked", Descending: true, Limit: 1})
+	if len(recipes) != 1 || recipes[0].ID != recipe.ID || recipes[0].LastCooked == 0 {
+		t.Errorf("Expected the recipe just cooked first, got %+v", recipes)
+	}
+}
+
+func TestRecipeListingFields(t *testing.T) {
+	setupIntegrationTest()
+
+	req := withClaims(httptest.NewRequest("GET", "/priv/recipes/?limit=2&fields=title,LABELS", nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+	rr := httptest.NewRecorder()
+	if appErr := getAllRecipes(rr, req); appErr != nil {
+		t.Fatalf("getAllRecipes() returned appError: %v", appErr)
+	}
+	var recipes []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &recipes)
+	if len(recipes) != 2 {
+		t.Fatalf("Expected 2 recipes, got %d", len(recipes))
+	}
+	for _, recipe := range recipes {
+		keys := []string{}
+		for key := range recipe {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, []string{"ID", "Labels", "Title"}) {
+			t.Errorf("Expected only ID, Labels and Title, got %v", keys)
+		}
+	}
+
+	// Notes only come when asked for
+	noted, _ := createRecipe(context.Background(), 1, "Noted", "", 1, 1, false, nil, []string{"double it"})
+	for fields, want := range map[string]int{"": 0, "&fields=Title,Notes": 1} {
+		req := withClaims(httptest.NewRequest("GET", "/priv/recipes/?sort=-created&limit=1"+fields, nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+		rr = httptest.NewRecorder()
+		getAllRecipes(rr, req)
+		var page []Recipe
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		if len(page) != 1 || page[0].ID != noted.ID || len(page[0].Notes) != want {
+			t.Errorf("Expected recipe %d with %d notes for %q, got %+v", noted.ID, want, fields, page)
+		}
+	}
+
+	// Public listings never send bodies or notes
+	for _, fields := range []string{"body", "notes"} {
+		appErr := getRecipeList(httptest.NewRecorder(), httptest.NewRequest("GET", "/recipes/?fields="+fields, nil))
+		if appErr == nil || appErr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 asking the public listing for %s, got %v", fields, appErr)
+		}
+	}
+}
+
+func TestRecipeListingFiltersByLabel(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+
+	// poultry > chicken (1), turkey (37); recipe 1 is chicken and recipes 2
+	// and 3 turkey, and of those only recipe 3 is a main (36)
+	createRecipeLabel(ctx, 2, 37)
+	createRecipeLabel(ctx, 3, 37)
+	poultry, _ := createLabel(ctx, 1, "poultry")
+	for _, id := range []int{1, 37} {
+		label, _ := labelByID(ctx, 1, id)
+		updateLabel(ctx, 1, id, label.Label, label.Icon, label.Type, poultry.ID, 0)
+	}
+	target := "/priv/recipes/?label=" + strconv.Itoa(poultry.ID)
+
+	for query, want := range map[string][]int{
+		"/priv/recipes/?label=1":      {1},
+		target:                        {1, 2, 3},
+		target + "&label=36":          {3},
+		"/priv/recipes/?label=1,9999": {},
+	} {
+		if got, _ := listRecipes(t, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", query, want, got)
+		}
+	}
+
+	// Paging keeps the filter
+	all, _ := listRecipes(t, target)
+	var paged []int
+	for page := target + "&limit=1"; page != ""; {
+		ids, links := listRecipes(t, page)
+		paged = append(paged, ids...)
+		page = links["next"]
+	}
+	if !reflect.DeepEqual(paged, all) {
+		t.Errorf("Expected paging to return %v, got %v", all, paged)
+	}
+}
+
+func TestRecipeListingRejectsBadParams(t *testing.T) {
+	setupIntegrationTest()
+
+	titleCursor := encodeCursor(RecipeCursor{SortKey: "title", Value: "Soup", ID: 3})
+	for _, query := range []string{
+		"limit=0", "limit=501", "limit=ten",
+		"sort=rating", "sort=body",
+		"cursor=not-a-cursor", "cursor=" + titleCursor, "sort=created&cursor=" + titleCursor,
+		"cursor=" + encodeCursor(RecipeCursor{SortKey: "created", Value: "soon", ID: 3}) + "&sort=created",
+		"fields=Title,Secret",
+		"label=chicken", "label=1,",
+	} {
+		req := withClaims(httptest.NewRequest("GET", "/priv/recipes/?"+query, nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+		appErr := getAllRecipes(httptest.NewRecorder(), req)
+		if appErr == nil || appErr.Code != http.StatusBadRequest || appErr.ErrCode != "validation_failed" {
+			t.Errorf("Expected 400 validation_failed for %s, got %v", query, appErr)
+		}
+	}
+}
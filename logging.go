@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestInfo is what the logging middleware learns about a request as it
+// goes through the handlers; authentication fills in the caller
+type requestInfo struct {
+	ID          string
+	UserID      int
+	HouseholdID int
+}
+
+// setupLogging makes the configured logger the default. The level is
+// LogLevel, or debug under --debug and info otherwise; the format is
+// LogFormat, "text" (the default) or "json".
+func setupLogging(w io.Writer) {
+	level := slog.LevelInfo
+	if conf.Debug {
+		level = slog.LevelDebug
+	}
+	if conf.LogLevel != "" {
+		level.UnmarshalText([]byte(conf.LogLevel)) // checked by validateConfiguration
+	}
+	options := &slog.HandlerOptions{Level: level}
+	if strings.EqualFold(conf.LogFormat, "json") {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, options)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, options)))
+	}
+}
+
+// requestIDs tags every request with an ID, taken from the X-Request-ID
+// header when a proxy has already assigned one, and echoes it back so
+// clients can quote it when reporting a problem
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		info := &requestInfo{ID: id}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info)))
+	})
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, so a client
+// can't inject anything odd into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestInfoFrom returns the info stored by requestIDs, or nil
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// requestLog is the logger for everything done on behalf of r
+func requestLog(r *http.Request) *slog.Logger {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return slog.Default().With("request_id", info.ID)
+	}
+	return slog.Default()
+}
+
+// noteCaller records who is making a request, for the access log
+func noteCaller(r *http.Request, claims *CustomClaims) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.UserID = claims.UserID
+		info.HouseholdID = claims.EffectiveHouseholdID()
+	}
+}
+
+// accessLog logs one line per request once it's been handled
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.Status()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", clientIP(r)),
+		}
+		if info := requestInfoFrom(r.Context()); info != nil && info.UserID != 0 {
+			attrs = append(attrs, slog.Int("user_id", info.UserID), slog.Int("household_id", info.HouseholdID))
+		}
+		requestLog(r).LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// logAppError logs an error a handler returned: server errors as errors,
+// and the client's mistakes at info so they don't page anyone
+func logAppError(r *http.Request, e *appError) {
+	level := slog.LevelInfo
+	if e.Code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{slog.Int("status", e.Code), slog.String("code", e.ErrCode)}
+	if e.Error != nil {
+		attrs = append(attrs, slog.String("error", e.Error.Error()))
+	}
+	requestLog(r).LogAttrs(r.Context(), level, e.Message, attrs...)
+}
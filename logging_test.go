@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	setupIntegrationTest()
+	conf.Origins = []string{"http://localhost"}
+	conf.LogFormat = "json"
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	setupLogging(&logs)
+	handler := newHandler()
+
+	// An ID from upstream is kept, and quoted in the error and the logs
+	req := httptest.NewRequest("GET", "/priv/recipe/1/", nil)
+	req.Header.Set("X-Request-ID", "upstream-42")
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get("X-Request-ID") != "upstream-42" {
+		t.Errorf("Expected the request ID to be echoed, got %q", rr.Header().Get("X-Request-ID"))
+	}
+	var body struct {
+		Error struct{ RequestID string }
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if body.Error.RequestID != "upstream-42" {
+		t.Errorf("Expected the request ID in the error body, got %s", rr.Body.String())
+	}
+	entries := logEntries(t, &logs)
+	if len(entries) != 2 || entries[0]["msg"] != "missing auth token" || entries[1]["msg"] != "request" {
+		t.Fatalf("Expected an error and an access log entry, got %v", entries)
+	}
+	for _, entry := range entries {
+		if entry["request_id"] != "upstream-42" {
+			t.Errorf("Expected every entry to carry the request ID, got %v", entry)
+		}
+	}
+	if entries[1]["status"] != 401.0 || entries[1]["path"] != "/priv/recipe/1/" {
+		t.Errorf("Expected the access log to record the request, got %v", entries[1])
+	}
+
+	// An unusable ID is replaced, and the access log names the caller
+	token, _ := jwtGenerate(1, RoleAdmin, 1)
+	req = httptest.NewRequest("GET", "/priv/recipe/1/", nil)
+	req.Header.Set("X-Request-ID", "has spaces")
+	req.Header.Set("x-access-token", token)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	id := rr.Header().Get("X-Request-ID")
+	if id == "" || id == "has spaces" {
+		t.Errorf("Expected a fresh request ID, got %q", id)
+	}
+	entries = logEntries(t, &logs)
+	access := entries[len(entries)-1]
+	if access["request_id"] != id || access["user_id"] != 1.0 || access["household_id"] != 1.0 || access["status"] != 200.0 {
+		t.Errorf("Expected the access log to name the caller, got %v", access)
+	}
+}
+
+func logEntries(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON log lines, got %q", line)
+		}
+		entries = append(entries, entry)
+	}
+	logs.Reset()
+	return entries
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := map[string]bool{
+		"":                       false,
+		"f0e1d2c3":               true,
+		"req-1/2:3":              true,
+		"two words":              false,
+		"new\nline":              false,
+		strings.Repeat("x", 129): false,
+	}
+	for id, want := range tests {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+	if id := newRequestID(); !validRequestID(id) || id == newRequestID() {
+		t.Errorf("Expected distinct valid IDs, got %q", id)
+	}
+}
+
+func TestHandlerErrorsUseLogLevels(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	conf = configuration{LogFormat: "json", LogLevel: "warn"}
+	cause := errors.New("disk on fire")
+	setupLogging(&logs)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	wrappedHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		return &appError{http.StatusBadRequest, "bad", nil, "invalid_request"}
+	}).ServeHTTP(httptest.NewRecorder(), req)
+	if logs.Len() != 0 {
+		t.Errorf("Expected client errors to be below warn, got %s", logs.String())
+	}
+	wrappedHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		return &appError{http.StatusInternalServerError, "broken", cause, "internal_error"}
+	}).ServeHTTP(httptest.NewRecorder(), req)
+	if entries := logEntries(t, &logs); len(entries) != 1 || entries[0]["level"] != "ERROR" || entries[0]["error"] != cause.Error() {
+		t.Errorf("Expected the server error to be logged with its cause, got %v", entries)
+	}
+}
+
+func TestTokensAreNotLogged(t *testing.T) {
+	setupJwtConfig()
+	conf.LogLevel = "debug"
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	setupLogging(&logs)
+
+	token, _ := jwtGenerate(1, RoleAdmin, 1)
+	if !strings.Contains(logs.String(), "generated token") {
+		t.Fatalf("Expected token generation to be logged at debug, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), token) {
+		t.Error("Expected the token itself to be left out of the logs")
+	}
+}
@@ -1,27 +1,133 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
 type configuration struct {
-	Debug     bool
-	DbDialect string
-	DbDSN     string
-	JwtSecret string
-	Origins   []string
+	Debug          bool
+	DbDialect      string
+	DbDSN          string
+	DbDSNFile      string
+	JwtSecret      string
+	JwtSecretFile  string
+	Origins        []string
+	Operators      []string // usernames who run the deployment, not just a household
+	PasswordScheme string
+	BcryptCost     int
+
+	LoginMaxFailures       int
+	LoginMaxFailuresPerIP  int
+	LoginLockoutSeconds    int
+	LoginLockoutMaxSeconds int
+	TrustProxyHeaders      bool
+	MetricsAllowFrom       []string // IPs and CIDRs that may scrape /metrics; loopback only by default
+	RequireIfMatch         bool
+	PublicCacheMaxAge      int
+	LogLevel               string // "debug", "info", "warn" or "error"
+	LogFormat              string // "text" or "json"
+
+	Listen                 string // ":8080" by default, or "unix:/path/to.sock"
+	UnixSocketMode         string
+	TLSCertFile            string
+	TLSKeyFile             string
+	ReadTimeoutSeconds     int
+	WriteTimeoutSeconds    int
+	IdleTimeoutSeconds     int
+	ShutdownTimeoutSeconds int
+	RequestTimeoutSeconds  int
+
+	TrashRetentionDays        int
+	TrashPurgeIntervalMinutes int
+
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCClientSecretFile string
+	OIDCRedirectURL      string
+	OIDCAutoProvision    bool
+	OIDCDefaultRole      string
 }
 
+// appError is returned by handlers. Code is the HTTP status; ErrCode is the
+// stable, machine-readable code clients should match on instead of Message.
 type appError struct {
 	Code    int
 	Message string
 	Error   error
+	ErrCode string
+}
+
+// fieldError describes one invalid request field
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationErrors collects every invalid field in a request so clients can
+// report them all at once. Used as an appError's Error, it becomes the
+// details of the JSON error body.
+type validationErrors []fieldError
+
+func (v validationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, f := range v {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (v *validationErrors) add(field string, message string) {
+	*v = append(*v, fieldError{field, message})
+}
+
+func (v validationErrors) has(field string) bool {
+	for _, f := range v {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// sortBy puts the errors in the order their fields are declared in a
+// request struct, so the first error is the same whichever path found it
+func (v validationErrors) sortBy(request reflect.Type) {
+	order := make(map[string]int)
+	for i := 0; i < request.NumField(); i++ {
+		order[strings.Split(request.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	sort.SliceStable(v, func(i, j int) bool { return order[v[i].Field] < order[v[j].Field] })
+}
+
+// appError returns nil if no fields were invalid. The plain-text message is
+// the first field's, which is what clients saw before fields were collected.
+func (v validationErrors) appError() *appError {
+	if len(v) == 0 {
+		return nil
+	}
+	return &appError{http.StatusBadRequest, v[0].Message, v, "validation_failed"}
+}
+
+// invalidField is a validation error for a single field
+func invalidField(field string, message string) *appError {
+	return validationErrors{{field, message}}.appError()
 }
 
 type wrappedHandler func(w http.ResponseWriter, r *http.Request) *appError
@@ -31,50 +137,125 @@ var conf configuration
 func main() {
 	initApp()
 
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	if err := serve(newHandler(), stop); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// newHandler builds the router and wraps it in the middleware every
+// request goes through
+func newHandler() http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
+
+	// Probes for load balancers and orchestrators; never authenticated,
+	// though /metrics only answers the addresses in MetricsAllowFrom
+	probes := cacheControl("no-store")
+	router.Handle("/healthz", probes(wrappedHandler(healthz))).Methods("GET")
+	router.Handle("/readyz", probes(wrappedHandler(readyz))).Methods("GET")
+	router.Handle("/version", probes(wrappedHandler(getVersion))).Methods("GET")
+	router.Handle("/metrics", probes(wrappedHandler(getMetrics))).Methods("GET")
+
+	// Every request is counted and timed, including ones that match no route
+	router.Use(instrumentRequests)
+	router.NotFoundHandler = instrumentRequests(http.NotFoundHandler())
+	router.MethodNotAllowedHandler = instrumentRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+
 	router.Handle("/login/", wrappedHandler(login)).Methods("POST")
+	router.Handle("/login/oidc/", wrappedHandler(oidcLogin)).Methods("GET")
+	router.Handle("/login/oidc/callback", wrappedHandler(oidcCallback)).Methods("GET")
 
-	router.Handle("/recipes/", wrappedHandler(getRecipeList)).Methods("GET")
-	router.Handle("/labels/", wrappedHandler(getAllLabels)).Methods("GET")
+	router.Handle("/recipes/", cachedPublic(wrappedHandler(getRecipeList))).Methods("GET")
+	router.Handle("/labels/", cachedPublic(wrappedHandler(getAllLabels))).Methods("GET")
+	router.Handle("/labels/types/", cachedPublic(wrappedHandler(getLabelTypes))).Methods("GET")
 	router.Handle("/recipe/{id}/labels/", wrappedHandler(getLabelsForRecipe)).Methods("GET")
 	//router.Handle("/labels/{id}/recipes", wrappedHandler(getRecipesForLabel)).Methods("GET")
 
 	// Read-only authenticated routes
 	privRouter := router.PathPrefix("/priv").Subrouter()
-	privRouter.Use(authRequired)
+	privRouter.Use(authRequired, cacheControl("private, no-cache"))
 	privRouter.Handle("/recipes/", wrappedHandler(getAllRecipes)).Methods("GET")
 	privRouter.Handle("/recipe/{id}/", wrappedHandler(getRecipeByID)).Methods("GET")
 	privRouter.Handle("/recipe/{id}/notes/", wrappedHandler(getNotesForRecipe)).Methods("GET")
 
-	// Admin-only mutating routes
+	// Account routes for the logged-in user
+	privRouter.Handle("/me/", wrappedHandler(getCurrentUser)).Methods("GET")
+	privRouter.Handle("/me", wrappedHandler(updateCurrentUserSettings)).Methods("PUT")
+	privRouter.Handle("/me/password", wrappedHandler(changePassword)).Methods("PUT")
+	privRouter.Handle("/me/api-keys/", wrappedHandler(getAPIKeys)).Methods("GET")
+	privRouter.Handle("/me/api-keys/", wrappedHandler(createNewAPIKey)).Methods("POST")
+	privRouter.Handle("/me/api-keys/{id}", wrappedHandler(revokeAPIKey)).Methods("DELETE")
+	privRouter.Handle("/me/oidc/link", wrappedHandler(linkOIDCIdentity)).Methods("POST")
+
+	// Household membership routes
+	privRouter.Handle("/households/", wrappedHandler(getHouseholds)).Methods("GET")
+	privRouter.Handle("/households/join", wrappedHandler(joinHousehold)).Methods("POST")
+	privRouter.Handle("/household/{id}/switch", wrappedHandler(switchHousehold)).Methods("POST")
+
+	// Mutating routes. Everything here requires authentication; each route
+	// additionally requires the permission its role-based middleware names.
 	adminRouter := router.PathPrefix("/admin").Subrouter()
-	adminRouter.Use(authRequired)
-	adminRouter.Use(adminRequired)
+	adminRouter.Use(authRequired, cacheControl("no-store"), invalidatesPublicCache)
+	contribute := requirePermission(PermContribute)
+	edit := requirePermission(PermEdit)
+	admin := requirePermission(PermAdmin)
 
 	// Recipe routes
-	adminRouter.Handle("/recipe/{id}/", wrappedHandler(deleteRecipeSoft)).Methods("DELETE")
-	adminRouter.Handle("/recipe/{id}/hard", wrappedHandler(deleteRecipeHard)).Methods("DELETE")
-	adminRouter.Handle("/recipe/{id}/restore", wrappedHandler(recipeRestore)).Methods("PUT")
-	adminRouter.Handle("/recipe/{id}/mark_cooked", wrappedHandler(flagRecipeCooked)).Methods("PUT")
-	adminRouter.Handle("/recipe/{id}/mark_new", wrappedHandler(unFlagRecipeCooked)).Methods("PUT")
-	adminRouter.Handle("/recipe/{id}", wrappedHandler(updateExistingRecipe)).Methods("PUT")
-	adminRouter.Handle("/recipe/", wrappedHandler(createNewRecipe)).Methods("POST")
+	adminRouter.Handle("/recipe/{id}/", edit(wrappedHandler(deleteRecipeSoft))).Methods("DELETE")
+	adminRouter.Handle("/recipe/{id}/hard", admin(wrappedHandler(deleteRecipeHard))).Methods("DELETE")
+	adminRouter.Handle("/recipe/{id}/restore", edit(wrappedHandler(recipeRestore))).Methods("PUT")
+
+	// Trash routes
+	adminRouter.Handle("/trash/", edit(wrappedHandler(getTrash))).Methods("GET")
+	adminRouter.Handle("/trash/{id}/restore", edit(wrappedHandler(recipeRestore))).Methods("PUT")
+	adminRouter.Handle("/trash/{id}", admin(wrappedHandler(deleteFromTrash))).Methods("DELETE")
+	adminRouter.Handle("/recipe/{id}/mark_cooked", contribute(wrappedHandler(flagRecipeCooked))).Methods("PUT")
+	adminRouter.Handle("/recipe/{id}/mark_new", contribute(wrappedHandler(unFlagRecipeCooked))).Methods("PUT")
+	adminRouter.Handle("/recipe/{id}", edit(wrappedHandler(updateExistingRecipe))).Methods("PUT")
+	adminRouter.Handle("/recipe/{id}", edit(wrappedHandler(patchRecipe))).Methods("PATCH")
+	adminRouter.Handle("/recipe/", edit(wrappedHandler(createNewRecipe))).Methods("POST")
+	adminRouter.Handle("/recipe/{id}/copy/{household_id}", edit(wrappedHandler(copyRecipeToHousehold))).Methods("POST")
 
 	// Recipe-label routes
-	adminRouter.Handle("/recipe/{recipe_id}/label/{label_id}", wrappedHandler(tagRecipe)).Methods("PUT")
-	adminRouter.Handle("/recipe/{recipe_id}/label/{label_id}", wrappedHandler(untagRecipe)).Methods("DELETE")
+	adminRouter.Handle("/recipe/{recipe_id}/label/{label_id}", edit(wrappedHandler(tagRecipe))).Methods("PUT")
+	adminRouter.Handle("/recipe/{recipe_id}/label/{label_id}", edit(wrappedHandler(untagRecipe))).Methods("DELETE")
+
+	// User routes
+	adminRouter.Handle("/users/", admin(wrappedHandler(getUsers))).Methods("GET")
+	adminRouter.Handle("/user/{id}/role", admin(wrappedHandler(editUserRole))).Methods("PUT")
+
+	// Household routes
+	adminRouter.Handle("/households/", admin(wrappedHandler(createNewHousehold))).Methods("POST")
+	adminRouter.Handle("/household/invite", admin(wrappedHandler(getHouseholdInvite))).Methods("GET")
+	adminRouter.Handle("/household/invite", admin(wrappedHandler(regenerateHouseholdInvite))).Methods("PUT")
+
+	// Audit log
+	adminRouter.Handle("/audit/", admin(wrappedHandler(getAuditLog))).Methods("GET")
+
+	// Login lockout routes
+	adminRouter.Handle("/lockouts/", admin(wrappedHandler(getLockouts))).Methods("GET")
+	adminRouter.Handle("/lockout/{scope}/{subject}", admin(wrappedHandler(removeLockout))).Methods("DELETE")
 
 	// Label routes
-	adminRouter.Handle("/label/id/{label_id}", wrappedHandler(editLabel)).Methods("PUT")
-	adminRouter.Handle("/label/id/{label_id}", wrappedHandler(removeLabel)).Methods("DELETE")
-	adminRouter.Handle("/label/{label_name}", wrappedHandler(addLabel)).Methods("PUT")
+	adminRouter.Handle("/label/id/{label_id}", edit(wrappedHandler(editLabel))).Methods("PUT")
+	adminRouter.Handle("/label/id/{label_id}", edit(wrappedHandler(removeLabel))).Methods("DELETE")
+	adminRouter.Handle("/label/{label_name}", edit(wrappedHandler(addLabel))).Methods("PUT")
+	adminRouter.Handle("/label/{id}/merge-into/{target_id}", edit(wrappedHandler(mergeLabels))).Methods("POST")
+
+	// Label type routes
+	adminRouter.Handle("/label-type/", edit(wrappedHandler(createNewLabelType))).Methods("POST")
+	adminRouter.Handle("/label-type/{id}", edit(wrappedHandler(editLabelType))).Methods("PUT")
+	adminRouter.Handle("/label-type/{id}", edit(wrappedHandler(removeLabelType))).Methods("DELETE")
 
 	// Note routes
-	adminRouter.Handle("/recipe/{id}/note/", wrappedHandler(createNoteOnRecipe)).Methods("POST")
-	adminRouter.Handle("/note/{id}", wrappedHandler(removeNote)).Methods("DELETE")
-	adminRouter.Handle("/note/{id}", wrappedHandler(editNote)).Methods("PUT")
-	adminRouter.Handle("/note/{id}/flag", wrappedHandler(flagNote)).Methods("PUT")
-	adminRouter.Handle("/note/{id}/unflag", wrappedHandler(unFlagNote)).Methods("PUT")
+	adminRouter.Handle("/recipe/{id}/note/", contribute(wrappedHandler(createNoteOnRecipe))).Methods("POST")
+	adminRouter.Handle("/note/{id}", edit(wrappedHandler(removeNote))).Methods("DELETE")
+	adminRouter.Handle("/note/{id}", edit(wrappedHandler(editNote))).Methods("PUT")
+	adminRouter.Handle("/note/{id}/flag", contribute(wrappedHandler(flagNote))).Methods("PUT")
+	adminRouter.Handle("/note/{id}/unflag", contribute(wrappedHandler(unFlagNote))).Methods("PUT")
 
 	debugRouter := router.PathPrefix("/debug").Subrouter()
 	debugRouter.Use(debugRequired)
@@ -82,22 +263,27 @@ func main() {
 	debugRouter.Handle("/checkToken/", wrappedHandler(validateJwt)).Methods("GET")
 	debugRouter.Handle("/hashPassword/", wrappedHandler(getHash)).Methods("POST")
 
+	// Response headers browser clients need to read: ETag to send back as
+	// If-Match, Link to follow listing pages, Retry-After when locked out and
+	// X-Request-ID to quote when reporting a problem
+	exposedHeaders := []string{"ETag", "Link", "Retry-After", "X-Request-ID"}
 	var corsOptions cors.Options
 	if conf.Debug {
 		corsOptions = cors.Options{
 			AllowedHeaders: []string{"*"},
-			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			ExposedHeaders: exposedHeaders,
 			Debug:          true,
 		}
 	} else {
 		corsOptions = cors.Options{
-			AllowedHeaders: []string{"x-access-token"},
+			AllowedHeaders: []string{"x-access-token", "Authorization", "Content-Type", "If-Match", "If-None-Match", "X-Request-ID"},
 			AllowedOrigins: conf.Origins,
-			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			ExposedHeaders: exposedHeaders,
 		}
 	}
-	handler := cors.New(corsOptions).Handler(router)
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	return requestIDs(accessLog(cors.New(corsOptions).Handler(compressResponses(requestDeadline(router)))))
 }
 
 func initApp() {
@@ -105,37 +291,132 @@ func initApp() {
 	doBootstrap := flag.Bool("bootstrap", false, "bootstrap db  with tables and sample data")
 	force := flag.Bool("force", false, "force bootstrapping even if DB already exists")
 	debug := flag.Bool("debug", false, "produce debugging output")
+	printConfig := flag.Bool("print-config", false, "print the configuration, with secrets redacted, and exit")
+	doFsck := flag.Bool("fsck", false, "check the database for orphaned label links, notes and label aliases, and exit")
+	repair := flag.Bool("repair", false, "like --fsck, but delete what it finds")
 	flag.Parse()
 
-	if err := readConfiguration(&conf, *configFilename); err != nil {
-		panic(fmt.Sprintf("Error reading config: %v", err))
+	// Without --config, gorecipes.conf is optional: the environment may
+	// supply everything
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := loadConfiguration(&conf, *configFilename, set["config"]); err != nil {
+		log.Fatalf("Error reading config: %v", err)
 	}
-
-	conf.Debug = *debug
-
-	if conf.Debug {
-		fmt.Println("Loaded config:")
-		fmt.Println(conf)
+	if set["debug"] {
+		conf.Debug = *debug
 	}
 
-	if conf.JwtSecret == "" {
-		panic("JWT Secret is a required config")
+	if *printConfig {
+		fmt.Println(redactedConfiguration(conf))
 	}
-
-	if !conf.Debug && len(conf.Origins) == 0 {
-		panic("You must provide allowed origins for CORS when not running under debug")
+	if err := validateConfiguration(conf); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if *printConfig {
+		os.Exit(0)
+	}
+	setupLogging(os.Stdout)
+	slog.Debug("loaded config", "config", redactedConfiguration(conf))
+	if conf.Debug {
+		source := "the Debug setting"
+		if set["debug"] {
+			source = "--debug"
+		}
+		slog.Warn("debug mode is on; /debug/ routes hand out admin tokens and CORS allows any origin", "enabled_by", source)
 	}
 
 	connect()
+	if err := db.Ping(); err != nil {
+		slog.Warn("database is unreachable; not ready until it is", "error", err)
+	}
 	if *doBootstrap {
 		bootstrap(*force)
 	}
+	if *doFsck || *repair {
+		ok, err := fsck(os.Stdout, *repair)
+		if err != nil {
+			log.Fatalf("Error checking database: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 }
 
 func (fn wrappedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn(w, r); err != nil { // Note this is specifically our *appError
-		http.Error(w, err.Message, err.Code)
-		fmt.Printf("%v\n", err.Error)
+		// Whatever failed, it was because the request ran out of time
+		if errors.Is(err.Error, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			err = &appError{http.StatusServiceUnavailable, "request took too long; try again later", err.Error, "timeout"}
+		}
+		writeError(w, r, err)
+		logAppError(r, err)
 		return
 	}
 }
+
+// writeError sends an appError to the client: as a JSON body
+// `{"error": {"code", "message", "details"}}` when the client accepts JSON,
+// and as the bare message in plain text otherwise, which is what older
+// clients expect.
+func writeError(w http.ResponseWriter, r *http.Request, e *appError) {
+	if !acceptsJSON(r) {
+		http.Error(w, e.Message, e.Code)
+		return
+	}
+
+	body := struct {
+		Code      string      `json:"code"`
+		Message   string      `json:"message"`
+		Details   interface{} `json:"details,omitempty"`
+		RequestID string      `json:"requestId,omitempty"`
+	}{e.ErrCode, e.Message, nil, ""}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		body.RequestID = info.ID
+	}
+	if body.Code == "" {
+		body.Code = errorCodeForStatus(e.Code)
+	}
+	var fields validationErrors
+	if errors.As(e.Error, &fields) {
+		body.Details = fields
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
+
+// acceptsJSON reports whether the Accept header asks for JSON
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCodeForStatus is the fallback code for errors that don't set one
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "auth_required"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusTooManyRequests:
+		return "too_many_attempts"
+	default:
+		return "internal_error"
+	}
+}
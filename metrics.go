@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram; Prometheus' defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []uint64 // counts per latencyBuckets bound, not cumulative
+	sum     float64
+	count   uint64
+}
+
+// metrics is everything /metrics reports apart from the database pool,
+// which is read from db.Stats() when scraped. Series are keyed by their
+// rendered labels, e.g. `method="GET",route="/recipes/",status="200"`.
+var metrics = struct {
+	sync.Mutex
+	requests  map[string]uint64
+	durations map[string]*histogram
+	logins    map[string]uint64
+}{
+	requests:  map[string]uint64{},
+	durations: map[string]*histogram{},
+	logins:    map[string]uint64{},
+}
+
+// instrumentRequests counts requests and times them by route template (so
+// /priv/recipe/{id}/ is one series, not one per recipe) and status
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		observeRequest(r.Method, routeTemplate(r), sw.Status(), time.Since(start))
+	})
+}
+
+// routeTemplate is the path template of the route that matched r, or
+// "unmatched"
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+func observeRequest(method string, route string, status int, elapsed time.Duration) {
+	labels := metricLabels("method", method, "route", route)
+	seconds := elapsed.Seconds()
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.requests[labels+fmt.Sprintf(`,status="%d"`, status)]++
+	h := metrics.durations[labels]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		metrics.durations[labels] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// countLogin records a login attempt; method is "password" or "oidc" and
+// result is "success", "failure" or "locked"
+func countLogin(method string, result string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.logins[metricLabels("method", method, "result", result)]++
+}
+
+// metricLabels renders name/value pairs as Prometheus labels
+func metricLabels(pairs ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	labels := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], escape.Replace(pairs[i+1])))
+	}
+	return strings.Join(labels, ",")
+}
+
+// metricsAllowed reports whether the client may scrape /metrics. The
+// metrics give away every route's traffic and the login failure rate, so
+// only loopback may unless MetricsAllowFrom says otherwise.
+func metricsAllowed(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return false // e.g. a Unix socket peer that didn't forward an address
+	}
+	if len(conf.MetricsAllowFrom) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, allowed := range conf.MetricsAllowFrom {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMetrics serves everything in the Prometheus text format
+func getMetrics(w http.ResponseWriter, r *http.Request) *appError {
+	if !metricsAllowed(r) {
+		return &appError{http.StatusForbidden, "metrics are not available from this address", nil, "metrics_forbidden"}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+	return nil
+}
+
+func writeMetrics(w io.Writer) {
+	metrics.Lock()
+	writeMetricHeader(w, "gorecipes_http_requests_total", "counter", "HTTP requests by method, route and status.")
+	for _, labels := range sortedKeys(metrics.requests) {
+		fmt.Fprintf(w, "gorecipes_http_requests_total{%s} %d\n", labels, metrics.requests[labels])
+	}
+
+	writeMetricHeader(w, "gorecipes_http_request_duration_seconds", "histogram", "HTTP request latency by method and route.")
+	for _, labels := range sortedKeys(metrics.durations) {
+		h := metrics.durations[labels]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "gorecipes_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bound, cumulative)
+		}
+		fmt.Fprintf(w, "gorecipes_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "gorecipes_http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "gorecipes_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	writeMetricHeader(w, "gorecipes_logins_total", "counter", "Login attempts by method and result.")
+	for _, labels := range sortedKeys(metrics.logins) {
+		fmt.Fprintf(w, "gorecipes_logins_total{%s} %d\n", labels, metrics.logins[labels])
+	}
+	metrics.Unlock()
+
+	if db == nil {
+		return
+	}
+	stats := db.Stats()
+	for _, series := range []struct {
+		name  string
+		kind  string
+		help  string
+		value float64
+	}{
+		{"gorecipes_db_max_open_connections", "gauge", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"gorecipes_db_open_connections", "gauge", "Established connections, in use and idle.", float64(stats.OpenConnections)},
+		{"gorecipes_db_in_use_connections", "gauge", "Connections currently in use.", float64(stats.InUse)},
+		{"gorecipes_db_idle_connections", "gauge", "Idle connections.", float64(stats.Idle)},
+		{"gorecipes_db_wait_count_total", "counter", "Times a query waited for a connection.", float64(stats.WaitCount)},
+		{"gorecipes_db_wait_duration_seconds_total", "counter", "Time spent waiting for a connection.", stats.WaitDuration.Seconds()},
+		{"gorecipes_db_max_idle_closed_total", "counter", "Connections closed because of SetMaxIdleConns.", float64(stats.MaxIdleClosed)},
+		{"gorecipes_db_max_idle_time_closed_total", "counter", "Connections closed because of SetConnMaxIdleTime.", float64(stats.MaxIdleTimeClosed)},
+		{"gorecipes_db_max_lifetime_closed_total", "counter", "Connections closed because of SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed)},
+	} {
+		writeMetricHeader(w, series.name, series.kind, series.help)
+		fmt.Fprintf(w, "%s %g\n", series.name, series.value)
+	}
+}
+
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
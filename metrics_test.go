@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	setupIntegrationTest()
+	conf.Origins = []string{"http://localhost"}
+	metrics.Lock()
+	metrics.requests = map[string]uint64{}
+	metrics.durations = map[string]*histogram{}
+	metrics.logins = map[string]uint64{}
+	metrics.Unlock()
+
+	handler := newHandler()
+	send := func(method string, target string, form url.Values) {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("GET", "/recipes/", nil)
+	send("GET", "/recipes/", nil)
+	send("GET", "/priv/recipe/1/", nil)
+	send("GET", "/priv/recipe/2/", nil)
+	send("GET", "/no/such/route", nil)
+	send("POST", "/login/", url.Values{"username": {"foo"}, "password": {"bar"}})
+	send("POST", "/login/", url.Values{"username": {"foo"}, "password": {"wrong"}})
+
+	rr := httptest.NewRecorder()
+	scrape := httptest.NewRequest("GET", "/metrics", nil)
+	scrape.RemoteAddr = "127.0.0.1:9090"
+	handler.ServeHTTP(rr, scrape)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Expected Prometheus text, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, want := range []string{
+		`gorecipes_http_requests_total{method="GET",route="/recipes/",status="200"} 2`,
+		`gorecipes_http_requests_total{method="GET",route="/priv/recipe/{id}/",status="401"} 2`,
+		`gorecipes_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`gorecipes_http_requests_total{method="POST",route="/login/",status="403"} 1`,
+		`gorecipes_http_request_duration_seconds_bucket{method="GET",route="/recipes/",le="+Inf"} 2`,
+		`gorecipes_http_request_duration_seconds_count{method="GET",route="/priv/recipe/{id}/"} 2`,
+		`gorecipes_logins_total{method="password",result="success"} 1`,
+		`gorecipes_logins_total{method="password",result="failure"} 1`,
+		"# TYPE gorecipes_http_request_duration_seconds histogram",
+		"gorecipes_db_max_open_connections 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsAllowFrom(t *testing.T) {
+	setupIntegrationTest()
+
+	tests := []struct {
+		allowFrom  []string
+		trustProxy bool
+		remoteAddr string
+		forwarded  string
+		want       bool
+	}{
+		{nil, false, "127.0.0.1:9090", "", true},
+		{nil, false, "[::1]:9090", "", true},
+		{nil, false, "192.0.2.1:9090", "", false},
+		{nil, false, "@", "", false}, // Unix socket
+		{nil, true, "127.0.0.1:9090", "192.0.2.1", false},
+		{[]string{"10.0.0.0/8"}, false, "10.1.2.3:9090", "", true},
+		{[]string{"10.0.0.0/8"}, false, "127.0.0.1:9090", "", false},
+		{[]string{"192.0.2.7"}, true, "@", "192.0.2.7", true},
+	}
+	for _, tt := range tests {
+		conf.MetricsAllowFrom = tt.allowFrom
+		conf.TrustProxyHeaders = tt.trustProxy
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		rr := httptest.NewRecorder()
+		appErr := getMetrics(rr, req)
+		if got := appErr == nil; got != tt.want {
+			t.Errorf("MetricsAllowFrom %v, %s forwarded %q: allowed = %v, want %v", tt.allowFrom, tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+		if appErr != nil && appErr.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for a refused scrape, got %v", appErr)
+		}
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	if got := metricLabels("route", `/a"b\c`, "status", "200"); got != `route="/a\"b\\c",status="200"` {
+		t.Errorf("metricLabels() = %s", got)
+	}
+}
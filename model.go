@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var db *sqlx.DB
 
+// schemaVersion is the version of the schema this build expects to find in
+// the schema_version table. Bump it, and write a migration that updates the
+// table, whenever the schema changes.
+const schemaVersion = 7
+
 /*********
  * TYPES *
  *********/
@@ -22,373 +31,1795 @@ var db *sqlx.DB
 type User struct {
 	ID                int `db:"user_id"`
 	Username          string
-	HashedPassword    string `db:"password"`
-	PlaintextPassword string `db:"plaintext_pw_bootstrapping_only"`
-	Administrator     bool   `db:"administrator"`
+	HashedPassword    string `db:"password" json:"-"`
+	PlaintextPassword string `db:"plaintext_pw_bootstrapping_only" json:"-"`
+	Role              Role   `db:"role"` // in the household the user was loaded for
+	UnitSystem        string `db:"unit_system"`
+	DefaultServings   int    `db:"default_servings"`
+}
+
+/*Household - a family or group that owns its own recipes, labels and notes */
+type Household struct {
+	ID         int `db:"household_id"`
+	Name       string
+	InviteCode string `db:"invite_code" json:",omitempty"`
 }
 
 /*Recipe - basic unit of the recipe database */
 type Recipe struct {
-	ID         int `db:"recipe_id"`
-	Title      string
-	Body       string `db:"recipe_body"`
-	Time       int    `db:"total_time"`
-	ActiveTime int    `db:"active_time"`
-	Deleted    bool
-	New        bool
-	Labels     []Label
-	Notes      []Note
+	ID          int `db:"recipe_id"`
+	HouseholdID int `db:"household_id"`
+	Title       string
+	Body        string `db:"recipe_body"`
+	Time        int    `db:"total_time"`
+	ActiveTime  int    `db:"active_time"`
+	Deleted     bool
+	New         bool
+	Version     int
+	Created     int64
+	LastCooked  int64 `db:"last_cooked"`                  // 0 if never marked cooked
+	DeletedAt   int64 `db:"deleted_at" json:",omitempty"` // when it went in the trash
+	Labels      []Label
+	Notes       []Note
+}
+
+/*RecipeListOptions - which recipes to list, in what order, and how much to load */
+type RecipeListOptions struct {
+	SortKey     string // a key of recipeSortColumns; empty sorts by ID
+	Descending  bool
+	Limit       int // 0 means no limit
+	After       *RecipeCursor
+	LabelIDs    []int // only recipes with each of these labels, or a label below it
+	IncludeBody bool
+	WantLabels  bool
+	WantNotes   bool
+}
+
+/*RecipeCursor - a recipe's position in a sorted listing, where a page starts */
+type RecipeCursor struct {
+	SortKey string `json:"s"`
+	Value   string `json:"v"` // the recipe's sort column, as a string
+	ID      int    `json:"id"`
+	Before  bool   `json:"b,omitempty"` // the page ends before it instead
+}
+
+// recipeSortColumns maps each sort key clients can use to its column
+var recipeSortColumns = map[string]string{
+	"title":       "title",
+	"total_time":  "total_time",
+	"active_time": "active_time",
+	"created":     "created",
+	"last_cooked": "last_cooked",
 }
 
 /*Label - a taxonomic tag for recipes */
 type Label struct {
-	ID    int `db:"label_id"`
-	Label string
-	Icon  string
-	Type  string
+	ID          int `db:"label_id"`
+	HouseholdID int `db:"household_id"`
+	Label       string
+	Icon        string
+	TypeID      int    `db:"type_id"` // 0 if it has no type
+	Type        string // the type's name, joined from label_type
+	ParentID    int    `db:"parent_id"` // 0 at the top level
+	Version     int
+	Aliases     []string `db:"-" json:",omitempty"` // names merged into it; only loaded by merges
+}
+
+/*LabelType - a kind of label, like "protein"; the filter sidebar groups by it */
+type LabelType struct {
+	ID           int `db:"label_type_id"`
+	HouseholdID  int `db:"household_id"`
+	Name         string
+	Icon         string
+	DisplayOrder int  `db:"display_order"`
+	MultiSelect  bool `db:"multi_select"` // whether the sidebar lets you pick several at once
+	Version      int
+}
+
+/*LabelGroup - a label type and its labels, for the filter sidebar */
+type LabelGroup struct {
+	Type   *LabelType `json:",omitempty"` // nil for labels without a type
+	Labels []Label
 }
 
 /*Note - a note attached to a recipe */
 type Note struct {
-	ID       int `db:"note_id"`
-	RecipeId int `db:"recipe_id"`
-	Created  int `db:"create_date"`
-	Note     string
-	Flagged  bool
+	ID          int `db:"note_id"`
+	HouseholdID int `db:"household_id"`
+	RecipeId    int `db:"recipe_id"`
+	Created     int `db:"create_date"`
+	Note        string
+	Flagged     bool
+	Version     int
+}
+
+/*Lockout - failed login tracking for a username or client IP */
+type Lockout struct {
+	Scope       string
+	Subject     string
+	Failures    int
+	LastFailure int64 `db:"last_failure"`
+	LockedUntil int64 `db:"locked_until"`
+}
+
+/*AuditEntry - a record of a security-relevant or mutating action */
+type AuditEntry struct {
+	ID          int `db:"audit_id"`
+	HouseholdID int `db:"household_id"`
+	ActorID     int `db:"actor_id"`
+	Action      string
+	EntityType  string `db:"entity_type"`
+	EntityID    int    `db:"entity_id"`
+	Before      string `db:"before_json"`
+	After       string `db:"after_json"`
+	Created     int64
+}
+
+/*AuditFilter - which audit entries to return. Zero values match everything. */
+type AuditFilter struct {
+	HouseholdID int
+	ActorID     *int // nil matches any actor; 0 is the system/anonymous actor
+	EntityType  string
+	EntityID    int
+	Action      string
+	Since       int64 // inclusive, unix seconds
+	Until       int64 // exclusive, unix seconds
+	Limit       int
+	Offset      int
+}
+
+/*APIKey - a long-lived credential for scripts, stored hashed */
+type APIKey struct {
+	ID          int `db:"key_id"`
+	UserID      int `db:"user_id"`
+	HouseholdID int `db:"household_id"`
+	Name        string
+	Prefix      string
+	KeyHash     string `db:"key_hash" json:"-"`
+	Scope       string
+	Created     int64
+	Expires     int64 // 0 means the key never expires
+	LastUsed    int64 `db:"last_used"`
 }
 
 /*************
  * FUNCTIONS *
  *************/
 // Load //
-func activeRecipes(includeBody bool) ([]Recipe, error) {
-	var recipes []Recipe
-	var q string
-	if includeBody {
-		q = "SELECT * FROM recipe WHERE deleted = 0"
-		// TODO can we populate the labels and recipes at the same time?
-		//q = "SELECT recipe.*, label.* FROM recipe join recipe_label using(recipe_id) join label using(label_id)"
-	} else {
-		q = "SELECT recipe_id, title, total_time, active_time FROM recipe WHERE deleted = 0"
+func activeRecipes(ctx context.Context, householdID int, includeBody bool) ([]Recipe, error) {
+	recipes, _, err := recipeList(ctx, householdID, RecipeListOptions{IncludeBody: includeBody, WantLabels: true})
+	return recipes, err
+}
+
+// trashedRecipes lists a household's deleted recipes, most recently deleted
+// first, without their bodies
+func trashedRecipes(ctx context.Context, householdID int) ([]Recipe, error) {
+	recipes := []Recipe{}
+	q := `SELECT recipe_id, household_id, title, total_time, active_time, deleted, new, version, created, last_cooked, deleted_at
+		FROM recipe WHERE household_id = ? AND deleted = 1 ORDER BY deleted_at DESC, recipe_id`
+	connect()
+	err := db.SelectContext(ctx, &recipes, q, householdID)
+	return recipes, err
+}
+
+// recipeList returns a household's active recipes in sort order, reading
+// at most opts.Limit from the cursor on; more reports whether the listing
+// continues past them in the direction read. Ties sort by ID so cursors
+// never skip or repeat a recipe.
+func recipeList(ctx context.Context, householdID int, opts RecipeListOptions) (recipes []Recipe, more bool, err error) {
+	column := "recipe_id"
+	if opts.SortKey != "" {
+		var ok bool
+		if column, ok = recipeSortColumns[opts.SortKey]; !ok {
+			return nil, false, fmt.Errorf("unknown sort key %q", opts.SortKey)
+		}
+	}
+	columns := "recipe_id, household_id, title, total_time, active_time, deleted, new, version, created, last_cooked"
+	if opts.IncludeBody {
+		columns += ", recipe_body"
+	}
+
+	// Reading backwards flips the order; the page is reversed again below
+	descending := opts.Descending
+	backwards := opts.After != nil && opts.After.Before
+	if backwards {
+		descending = !descending
+	}
+	direction, compare := "ASC", ">"
+	if descending {
+		direction, compare = "DESC", "<"
 	}
+
+	q := "SELECT " + columns + " FROM recipe WHERE household_id = ? AND deleted = 0"
+	args := []interface{}{householdID}
+	if len(opts.LabelIDs) > 0 {
+		var labels []Label
+		if labels, err = allLabels(ctx, householdID); err != nil {
+			return nil, false, err
+		}
+		for _, id := range opts.LabelIDs {
+			labeled := " AND recipe_id IN (SELECT recipe_id FROM recipe_label WHERE label_id IN (?))"
+			if q, args, err = sqlx.In(q+labeled, append(args, labelFamily(labels, id))...); err != nil {
+				return nil, false, err
+			}
+		}
+		q = db.Rebind(q)
+	}
+	if opts.After != nil {
+		var value interface{} = opts.After.Value
+		if column != "title" {
+			if value, err = strconv.ParseInt(opts.After.Value, 10, 64); err != nil {
+				return nil, false, err
+			}
+		}
+		if column == "recipe_id" {
+			q += fmt.Sprintf(" AND recipe_id %s ?", compare)
+			args = append(args, opts.After.ID)
+		} else {
+			q += fmt.Sprintf(" AND (%[1]s %[2]s ? OR (%[1]s = ? AND recipe_id %[2]s ?))", column, compare)
+			args = append(args, value, value, opts.After.ID)
+		}
+	}
+	q += fmt.Sprintf(" ORDER BY %s %s", column, direction)
+	if column != "recipe_id" {
+		q += ", recipe_id " + direction
+	}
+	if opts.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, opts.Limit+1)
+	}
+
 	connect()
-	err := db.Select(&recipes, q)
+	if err = db.SelectContext(ctx, &recipes, q, args...); err != nil {
+		return nil, false, err
+	}
+	if opts.Limit > 0 && len(recipes) > opts.Limit {
+		recipes, more = recipes[:opts.Limit], true
+	}
+	if backwards {
+		for i, j := 0, len(recipes)-1; i < j; i, j = i+1, j-1 {
+			recipes[i], recipes[j] = recipes[j], recipes[i]
+		}
+	}
+
+	// A listing of every recipe can find their labels and notes without
+	// naming each one
+	all := opts.Limit == 0 && opts.After == nil && len(opts.LabelIDs) == 0
+	if opts.WantLabels {
+		if err = loadLabels(ctx, householdID, recipes, all); err != nil {
+			return nil, false, err
+		}
+	}
+	if opts.WantNotes {
+		if err = loadNotes(ctx, householdID, recipes, all); err != nil {
+			return nil, false, err
+		}
+	}
+	return recipes, more, nil
+}
+
+// cursorFor returns the cursor just past recipe in a listing sorted by key
+func cursorFor(recipe Recipe, sortKey string) RecipeCursor {
+	cursor := RecipeCursor{SortKey: sortKey, ID: recipe.ID}
+	switch sortKey {
+	case "title":
+		cursor.Value = recipe.Title
+	case "total_time":
+		cursor.Value = strconv.Itoa(recipe.Time)
+	case "active_time":
+		cursor.Value = strconv.Itoa(recipe.ActiveTime)
+	case "created":
+		cursor.Value = strconv.FormatInt(recipe.Created, 10)
+	case "last_cooked":
+		cursor.Value = strconv.FormatInt(recipe.LastCooked, 10)
+	default:
+		cursor.Value = strconv.Itoa(recipe.ID)
+	}
+	return cursor
+}
+
+// loadLabels fills in the labels of every recipe in one query. all says
+// recipes are all the household's active recipes.
+func loadLabels(ctx context.Context, householdID int, recipes []Recipe, all bool) error {
+	if len(recipes) == 0 {
+		return nil
+	}
+	var rows []struct {
+		RecipeID int `db:"recipe_id"`
+		Label
+	}
+	q := "SELECT recipe_label.recipe_id, " + labelColumns + " JOIN recipe_label USING(label_id) WHERE label.household_id = ? AND "
+	q, args, err := inRecipes(q+"recipe_label.recipe_id", []interface{}{householdID}, householdID, recipes, all)
 	if err != nil {
-		return recipes, err
+		return err
 	}
 
-	var savedErr error
-	//TODO load in labels for each recipe
-	for i, recipe := range recipes {
-		labels, err := labelsByRecipeID(recipe.ID)
-		if err != nil {
-			savedErr = err
-			fmt.Println("error loading labels for recipe", recipe.ID, err)
+	connect()
+	if err := db.SelectContext(ctx, &rows, q, args...); err != nil {
+		return err
+	}
+	index := recipeIndex(recipes)
+	for _, row := range rows {
+		if i, ok := index[row.RecipeID]; ok {
+			recipes[i].Labels = append(recipes[i].Labels, row.Label)
 		}
-		recipe.Labels = labels
-		recipes[i] = recipe
 	}
-	return recipes, savedErr
+	return nil
+}
+
+// loadNotes is loadLabels for notes, which come back oldest first
+func loadNotes(ctx context.Context, householdID int, recipes []Recipe, all bool) error {
+	if len(recipes) == 0 {
+		return nil
+	}
+	var notes []Note
+	q, args, err := inRecipes("SELECT * FROM note WHERE household_id = ? AND recipe_id", []interface{}{householdID}, householdID, recipes, all)
+	if err != nil {
+		return err
+	}
+
+	connect()
+	if err := db.SelectContext(ctx, &notes, q+" ORDER BY note_id", args...); err != nil {
+		return err
+	}
+	index := recipeIndex(recipes)
+	for _, note := range notes {
+		if i, ok := index[note.RecipeId]; ok {
+			recipes[i].Notes = append(recipes[i].Notes, note)
+		}
+	}
+	return nil
+}
+
+// inRecipes finishes a query ending in a recipe_id column by restricting it
+// to recipes: by ID, or with a subquery when they're all the household's
+// active recipes so the query stays the same size however many there are
+func inRecipes(q string, args []interface{}, householdID int, recipes []Recipe, all bool) (string, []interface{}, error) {
+	if all {
+		q += " IN (SELECT recipe_id FROM recipe WHERE household_id = ? AND deleted = 0)"
+		return q, append(args, householdID), nil
+	}
+	ids := make([]int, len(recipes))
+	for i, recipe := range recipes {
+		ids[i] = recipe.ID
+	}
+	q, args, err := sqlx.In(q+" IN (?)", append(args, ids)...)
+	if err != nil {
+		return "", nil, err
+	}
+	connect()
+	return db.Rebind(q), args, nil
+}
+
+// recipeIndex maps recipe IDs to their place in recipes
+func recipeIndex(recipes []Recipe) map[int]int {
+	index := make(map[int]int, len(recipes))
+	for i, recipe := range recipes {
+		index[recipe.ID] = i
+	}
+	return index
 }
 
-func recipeByID(id int, wantLabels bool) (Recipe, error) {
+func recipeByID(ctx context.Context, householdID int, id int, wantLabels bool) (Recipe, error) {
 	var recipe Recipe
 	var labels []Label
-	q := "SELECT * FROM recipe WHERE recipe_id = ?"
+	q := "SELECT * FROM recipe WHERE household_id = ? AND recipe_id = ?"
 
 	connect()
-	err := db.Get(&recipe, q, id)
+	err := db.GetContext(ctx, &recipe, q, householdID, id)
 	if wantLabels == true && err == nil {
-		labels, err = labelsByRecipeID(id)
+		labels, err = labelsByRecipeID(ctx, householdID, id)
 		recipe.Labels = labels
 	}
 	return recipe, err
 }
 
-func labelByID(id int) (Label, error) {
+// labelColumns selects labels with their type's name; queries go on to
+// join or filter
+const labelColumns = `label.*, COALESCE(label_type.name, '') AS type
+	FROM label LEFT JOIN label_type ON label_type.label_type_id = label.type_id`
+
+func labelByID(ctx context.Context, householdID int, id int) (Label, error) {
 	var label Label
-	q := "SELECT * FROM label WHERE label_id = ?"
+	q := "SELECT " + labelColumns + " WHERE label.household_id = ? AND label_id = ?"
 
 	connect()
-	err := db.Get(&label, q, id)
+	err := db.GetContext(ctx, &label, q, householdID, id)
 	return label, err
 }
 
-func labelByName(name string) (Label, error) {
+// labelNamed selects the household's label with a name, or failing that the
+// label that name was merged into. It takes labelNamedArgs.
+const labelNamed = `label.household_id = ? AND (label.label = ? OR label.label_id IN
+	(SELECT label_id FROM label_alias WHERE household_id = ? AND alias = ?))
+	ORDER BY label.label <> ? LIMIT 1`
+
+func labelNamedArgs(householdID int, name string) []interface{} {
+	return []interface{}{householdID, name, householdID, name, name}
+}
+
+// labelByName returns the household's label with this name, resolving
+// aliases left by merges to the label they were merged into
+func labelByName(ctx context.Context, householdID int, name string) (Label, error) {
 	var label Label
-	q := "SELECT * FROM label WHERE label = ?"
+	q := "SELECT " + labelColumns + " WHERE " + labelNamed
 
 	connect()
-	err := db.Get(&label, q, name)
+	err := db.GetContext(ctx, &label, q, labelNamedArgs(householdID, name)...)
 	return label, err
 }
 
-func labelsByRecipeID(id int) ([]Label, error) {
+func labelAliases(ctx context.Context, householdID int, labelID int) ([]string, error) {
+	aliases := []string{}
+	q := "SELECT alias FROM label_alias WHERE household_id = ? AND label_id = ? ORDER BY alias"
+
+	connect()
+	err := db.SelectContext(ctx, &aliases, q, householdID, labelID)
+	return aliases, err
+}
+
+func labelsByRecipeID(ctx context.Context, householdID int, id int) ([]Label, error) {
 	var labels []Label
-	q := "SELECT label.* FROM label join recipe_label using(label_id) WHERE recipe_id = ?"
+	q := "SELECT " + labelColumns + " JOIN recipe_label USING(label_id) WHERE label.household_id = ? AND recipe_id = ?"
 
 	connect()
-	err := db.Select(&labels, q, id)
+	err := db.SelectContext(ctx, &labels, q, householdID, id)
 	return labels, err
 }
 
-func getNoteByID(id int) (Note, error) {
-	note := Note{}
-	q := "SELECT * FROM note WHERE note_id = ?"
+func allLabels(ctx context.Context, householdID int) ([]Label, error) {
+	var labels []Label
+	q := "SELECT " + labelColumns + " WHERE label.household_id = ? ORDER BY label.label_id"
 
 	connect()
-	err := db.Get(&note, q, id)
-	return note, err
+	err := db.SelectContext(ctx, &labels, q, householdID)
+	return labels, err
 }
 
-func notesByRecipeID(recipe_id int) ([]Note, error) {
-	var notes []Note
-	q := "SELECT * FROM note WHERE recipe_id = ?"
+// labelFamily returns id and the IDs of every label below it in labels
+func labelFamily(labels []Label, id int) []int {
+	children := map[int][]int{}
+	for _, label := range labels {
+		children[label.ParentID] = append(children[label.ParentID], label.ID)
+	}
+	family := []int{id}
+	seen := map[int]bool{id: true}
+	for i := 0; i < len(family); i++ {
+		for _, child := range children[family[i]] {
+			if !seen[child] {
+				seen[child] = true
+				family = append(family, child)
+			}
+		}
+	}
+	return family
+}
+
+func labelTypes(ctx context.Context, householdID int) ([]LabelType, error) {
+	types := []LabelType{}
+	q := "SELECT * FROM label_type WHERE household_id = ? ORDER BY display_order, name"
 
 	connect()
-	err := db.Select(&notes, q, recipe_id)
-	return notes, err
+	err := db.SelectContext(ctx, &types, q, householdID)
+	return types, err
 }
 
-func userByName(username string) (User, error) {
-	var user User
-	q := "SELECT * FROM user WHERE username = ?"
+func labelTypeByID(ctx context.Context, householdID int, id int) (LabelType, error) {
+	var labelType LabelType
+	q := "SELECT * FROM label_type WHERE household_id = ? AND label_type_id = ?"
+
 	connect()
-	err := db.Get(&user, q, username)
-	return user, err
+	err := db.GetContext(ctx, &labelType, q, householdID, id)
+	return labelType, err
 }
 
-func recipeLabelExists(recipeID int, labelID int) (bool, error) {
-	var exists []bool
-	q := "SELECT count(*) FROM recipe_label WHERE recipe_id = ? and label_id = ?"
+func labelTypeByName(ctx context.Context, householdID int, name string) (LabelType, error) {
+	var labelType LabelType
+	q := "SELECT * FROM label_type WHERE household_id = ? AND name = ?"
+
 	connect()
-	err := db.Select(&exists, q, recipeID, labelID)
-	return exists[0], err
+	err := db.GetContext(ctx, &labelType, q, householdID, name)
+	return labelType, err
 }
 
-// Create //
-func createLabel(labelName string) (Label, error) {
-	q := "INSERT INTO label (label) VALUES (?)"
-	connect()
-	_, err := db.Exec(q, labelName)
+// labelsByType groups the household's labels under their types in display
+// order, with labels that have no type last
+func labelsByType(ctx context.Context, householdID int) ([]LabelGroup, error) {
+	types, err := labelTypes(ctx, householdID)
 	if err != nil {
-		return Label{}, err
+		return nil, err
 	}
-	label, err := labelByName(labelName)
+	labels, err := allLabels(ctx, householdID)
 	if err != nil {
-		return Label{}, err
+		return nil, err
 	}
-	fmt.Printf("created new label %s(%d)\n", label.Label, label.ID)
-	return label, nil
-}
 
-func createRecipe(title string, body string, activeTime int, totalTime int) (Recipe, error) {
-	q := "INSERT INTO recipe (title, recipe_body, active_time, total_time, new) VALUES (?, ?, ?, ?, ?)"
-	connect()
-	result, err := db.Exec(q, title, body, activeTime, totalTime, false)
-	if err != nil {
-		return Recipe{}, err
+	groups := make([]LabelGroup, len(types))
+	index := map[int]int{}
+	for i := range types {
+		groups[i] = LabelGroup{Type: &types[i], Labels: []Label{}}
+		index[types[i].ID] = i
 	}
-	recipeID, err := result.LastInsertId()
-	if err != nil {
-		return Recipe{}, err
+	untyped := LabelGroup{Labels: []Label{}}
+	for _, label := range labels {
+		if i, ok := index[label.TypeID]; ok {
+			groups[i].Labels = append(groups[i].Labels, label)
+		} else {
+			untyped.Labels = append(untyped.Labels, label)
+		}
+	}
+	if len(untyped.Labels) > 0 {
+		groups = append(groups, untyped)
 	}
-	return recipeByID(int(recipeID), false)
+	return groups, nil
 }
 
-func createRecipeLabel(recipeID int, labelID int) error {
-	q := "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)"
+func getNoteByID(ctx context.Context, householdID int, id int) (Note, error) {
+	note := Note{}
+	q := "SELECT * FROM note WHERE household_id = ? AND note_id = ?"
+
 	connect()
-	_, err := db.Exec(q, recipeID, labelID)
-	if err == nil {
-		fmt.Printf("linked recipe %d to label %d\n", recipeID, labelID)
-	}
-	return err
+	err := db.GetContext(ctx, &note, q, householdID, id)
+	return note, err
 }
 
-func createNote(recipeID int, note string) (Note, error) {
-	epoch := time.Now().Unix()
-	q := "INSERT INTO note (recipe_id, note, create_date) VALUES (?, ?, ?)"
+func notesByRecipeID(ctx context.Context, householdID int, recipe_id int) ([]Note, error) {
+	var notes []Note
+	q := "SELECT * FROM note WHERE household_id = ? AND recipe_id = ?"
+
 	connect()
-	result, err := db.Exec(q, recipeID, note, epoch)
-	if err != nil {
-		return Note{}, err
-	}
-	noteID, err := result.LastInsertId()
-	if err != nil {
-		return Note{}, err
-	}
-	return getNoteByID(int(noteID))
+	err := db.SelectContext(ctx, &notes, q, householdID, recipe_id)
+	return notes, err
 }
 
-// Edit //
-func updateRecipe(recipeId int, title string, body string, activeTime int, totalTime int, isNew bool) error {
-	q := `UPDATE recipe SET
-		title = ?,
-		recipe_body = ?,
-		active_time = ?,
-		total_time = ?,
-		new = ?
-		WHERE recipe_id = ?`
+func userByName(ctx context.Context, username string) (User, error) {
+	var user User
+	q := "SELECT * FROM user WHERE username = ?"
 	connect()
-	_, err := db.Exec(q, title, body, activeTime, totalTime, isNew, recipeId)
-	return err
+	err := db.GetContext(ctx, &user, q, username)
+	return user, err
 }
 
-func setNoteFlag(noteID int, flag bool) error {
-	q := "UPDATE note SET flagged = ? WHERE note_id = ?"
+func userByIdentity(ctx context.Context, issuer string, subject string) (User, error) {
+	var user User
+	q := "SELECT user.* FROM user JOIN user_identity USING(user_id) WHERE issuer = ? AND subject = ?"
 	connect()
-	_, err := db.Exec(q, flag, noteID)
-	return err
+	err := db.GetContext(ctx, &user, q, issuer, subject)
+	return user, err
 }
 
-func setNoteText(noteID int, text string) error {
-	q := "UPDATE note SET note = ? WHERE note_id = ?"
+// allUsers lists the members of a household with their roles in it
+func allUsers(ctx context.Context, householdID int) ([]User, error) {
+	users := []User{}
+	q := `SELECT user.*, household_user.role FROM user JOIN household_user USING (user_id)
+		WHERE household_id = ? ORDER BY user_id`
 	connect()
-	_, err := db.Exec(q, text, noteID)
-	return err
+	err := db.SelectContext(ctx, &users, q, householdID)
+	return users, err
 }
 
-func softDeleteRecipe(recipeId int) error {
-	q := "UPDATE recipe SET deleted = 1 WHERE recipe_id = ?"
+// householdUser loads a member of a household with their role in it;
+// users who aren't members get sql.ErrNoRows
+func householdUser(ctx context.Context, householdID int, userID int) (User, error) {
+	var user User
+	q := `SELECT user.*, household_user.role FROM user JOIN household_user USING (user_id)
+		WHERE household_id = ? AND user_id = ?`
 	connect()
-	_, err := db.Exec(q, recipeId)
-	return err
+	err := db.GetContext(ctx, &user, q, householdID, userID)
+	return user, err
 }
 
-func unDeleteRecipe(recipeId int) error {
-	q := "UPDATE recipe SET deleted = 0 WHERE recipe_id = ?"
+// userByID loads a user without a role, since roles belong to household
+// memberships; use householdUser for that
+func userByID(ctx context.Context, id int) (User, error) {
+	var user User
+	q := "SELECT * FROM user WHERE user_id = ?"
 	connect()
-	_, err := db.Exec(q, recipeId)
-	return err
+	err := db.GetContext(ctx, &user, q, id)
+	return user, err
 }
 
-func setRecipeNewFlag(recipeID int, isNew bool) error {
-	q := "UPDATE recipe SET new = ? WHERE recipe_id = ?"
+func householdByID(ctx context.Context, id int) (Household, error) {
+	var household Household
+	q := "SELECT * FROM household WHERE household_id = ?"
 	connect()
-	_, err := db.Exec(q, isNew, recipeID)
-	return err
+	err := db.GetContext(ctx, &household, q, id)
+	return household, err
 }
 
-func updateLabel(labelID int, newName string, icon string, labelType string) error {
-	// Validate icon
-	if err := validateIcon(icon); err != nil {
-		return err
-	}
-
-	// Validate type
-	if err := validateType(labelType); err != nil {
-		return err
-	}
+func householdByInviteCode(ctx context.Context, code string) (Household, error) {
+	var household Household
+	q := "SELECT * FROM household WHERE invite_code = ?"
+	connect()
+	err := db.GetContext(ctx, &household, q, code)
+	return household, err
+}
 
-	// Fetch existing label to check if it exists (uses labelByID from model.go:103)
-	existing, err := labelByID(labelID)
-	if err != nil {
-		return err // Returns sql.ErrNoRows if not found
-	}
+func householdsForUser(ctx context.Context, userID int) ([]Household, error) {
+	households := []Household{}
+	q := `SELECT household.household_id, household.name FROM household
+		JOIN household_user USING(household_id) WHERE user_id = ? ORDER BY household_id`
+	connect()
+	err := db.SelectContext(ctx, &households, q, userID)
+	return households, err
+}
 
-	// Normalize new name to lowercase
-	normalizedName := strings.ToLower(newName)
+// householdRole returns the user's role in a household; users who aren't
+// members get sql.ErrNoRows
+func householdRole(ctx context.Context, householdID int, userID int) (Role, error) {
+	var role Role
+	q := "SELECT role FROM household_user WHERE household_id = ? AND user_id = ?"
+	connect()
+	err := db.GetContext(ctx, &role, q, householdID, userID)
+	return role, err
+}
 
-	// Normalize type to lowercase
-	normalizedType := strings.ToLower(labelType)
+func isHouseholdMember(ctx context.Context, householdID int, userID int) (bool, error) {
+	var count int
+	q := "SELECT COUNT(*) FROM household_user WHERE household_id = ? AND user_id = ?"
+	connect()
+	err := db.GetContext(ctx, &count, q, householdID, userID)
+	return count > 0, err
+}
 
-	// Check for name conflicts if name is changing
-	if normalizedName != existing.Label {
-		var count int
-		q := "SELECT COUNT(*) FROM label WHERE LOWER(label) = ? AND label_id != ?"
-		connect()
-		err := db.Get(&count, q, normalizedName, labelID)
-		if err != nil {
-			return err
-		}
-		if count > 0 {
-			return fmt.Errorf("label name already exists: %s: %w", newName, ErrLabelConflict)
-		}
+func lockoutFor(ctx context.Context, scope string, subject string) (Lockout, error) {
+	var lockout Lockout
+	q := "SELECT * FROM login_lockout WHERE scope = ? AND subject = ?"
+	connect()
+	err := db.GetContext(ctx, &lockout, q, scope, subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Lockout{Scope: scope, Subject: subject}, nil
 	}
+	return lockout, err
+}
 
-	// Update all three fields
-	q := "UPDATE label SET label = ?, icon = ?, type = ? WHERE label_id = ?"
+// allLockouts lists every lockout in the deployment, by username and by IP
+func allLockouts(ctx context.Context) ([]Lockout, error) {
+	lockouts := []Lockout{}
+	q := "SELECT * FROM login_lockout ORDER BY locked_until DESC, last_failure DESC"
 	connect()
-	_, err = db.Exec(q, normalizedName, icon, normalizedType, labelID)
-	return err
+	err := db.SelectContext(ctx, &lockouts, q)
+	return lockouts, err
 }
 
-// Delete //
-func deleteNote(noteID int) error {
-	q := "DELETE FROM note WHERE note_id = ?"
+// memberLockouts lists the username lockouts of a household's members. IP
+// lockouts belong to no household, so only allLockouts has them.
+func memberLockouts(ctx context.Context, householdID int) ([]Lockout, error) {
+	lockouts := []Lockout{}
+	q := `SELECT * FROM login_lockout WHERE scope = ? AND subject IN
+		(SELECT LOWER(username) FROM user JOIN household_user USING (user_id) WHERE household_id = ?)
+		ORDER BY locked_until DESC, last_failure DESC`
 	connect()
-	_, err := db.Exec(q, noteID)
-	if err == nil {
-		fmt.Printf("deleted note %d\n", noteID)
-	}
-	return err
+	err := db.SelectContext(ctx, &lockouts, q, lockoutScopeUser, householdID)
+	return lockouts, err
 }
 
-func deleteRecipeLabel(recipeID int, labelID int) error {
-	q := "DELETE FROM recipe_label WHERE recipe_id = ? AND label_id = ?"
+func apiKeysForUser(ctx context.Context, userID int) ([]APIKey, error) {
+	keys := []APIKey{}
+	q := "SELECT * FROM api_key WHERE user_id = ? ORDER BY key_id"
 	connect()
-	_, err := db.Exec(q, recipeID, labelID)
-	if err == nil {
-		fmt.Printf("unlinked label %d from recipe %d\n", labelID, recipeID)
-	}
-	return err
+	err := db.SelectContext(ctx, &keys, q, userID)
+	return keys, err
 }
 
-func deleteLabel(labelID int) error {
+func apiKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	q := "SELECT * FROM api_key WHERE key_hash = ?"
 	connect()
+	err := db.GetContext(ctx, &key, q, hash)
+	return key, err
+}
 
-	// Start transaction for atomic deletion
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+// auditEntries returns a page of matching audit entries, newest first, and
+// the total number of matches
+func auditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, int, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if filter.HouseholdID != 0 {
+		where = append(where, "household_id = ?")
+		args = append(args, filter.HouseholdID)
+	}
+	if filter.ActorID != nil {
+		where = append(where, "actor_id = ?")
+		args = append(args, *filter.ActorID)
+	}
+	if filter.EntityType != "" {
+		where = append(where, "entity_type = ?")
+		args = append(args, filter.EntityType)
 	}
+	if filter.EntityID != 0 {
+		where = append(where, "entity_id = ?")
+		args = append(args, filter.EntityID)
+	}
+	if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Since != 0 {
+		where = append(where, "created >= ?")
+		args = append(args, filter.Since)
+	}
+	if filter.Until != 0 {
+		where = append(where, "created < ?")
+		args = append(args, filter.Until)
+	}
+	conditions := strings.Join(where, " AND ")
 
-	// Ensure transaction is always closed
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+	connect()
+	var total int
+	if err := db.GetContext(ctx, &total, "SELECT COUNT(*) FROM audit_log WHERE "+conditions, args...); err != nil {
+		return nil, 0, err
+	}
+
+	entries := []AuditEntry{}
+	q := "SELECT * FROM audit_log WHERE " + conditions + " ORDER BY audit_id DESC LIMIT ? OFFSET ?"
+	err := db.SelectContext(ctx, &entries, q, append(args, filter.Limit, filter.Offset)...)
+	return entries, total, err
+}
+
+func recipeLabelExists(ctx context.Context, recipeID int, labelID int) (bool, error) {
+	var exists []bool
+	q := "SELECT count(*) FROM recipe_label WHERE recipe_id = ? and label_id = ?"
+	connect()
+	err := db.SelectContext(ctx, &exists, q, recipeID, labelID)
+	return exists[0], err
+}
 
-	// First unlink all recipes
-	_, err = tx.Exec("DELETE FROM recipe_label WHERE label_id = ?", labelID)
+// Create //
+func createLabel(ctx context.Context, householdID int, labelName string) (Label, error) {
+	q := "INSERT INTO label (household_id, label) VALUES (?, ?)"
+	connect()
+	_, err := db.ExecContext(ctx, q, householdID, labelName)
 	if err != nil {
-		return err
+		return Label{}, err
 	}
+	return labelByName(ctx, householdID, labelName)
+}
 
-	// Then delete the label itself
-	result, err := tx.Exec("DELETE FROM label WHERE label_id = ?", labelID)
+func createLabelType(ctx context.Context, householdID int, labelType LabelType) (LabelType, error) {
+	labelType.Name = strings.ToLower(labelType.Name)
+	if err := validateLabelType(ctx, householdID, labelType); err != nil {
+		return LabelType{}, err
+	}
+	q := "INSERT INTO label_type (household_id, name, icon, display_order, multi_select) VALUES (?, ?, ?, ?, ?)"
+	connect()
+	_, err := db.ExecContext(ctx, q, householdID, labelType.Name, labelType.Icon, labelType.DisplayOrder, labelType.MultiSelect)
 	if err != nil {
-		return err
+		return LabelType{}, err
 	}
+	return labelTypeByName(ctx, householdID, labelType.Name)
+}
 
-	// Check if label existed
-	rows, err := result.RowsAffected()
-	if err != nil {
+// validateLabelType checks a label type's fields, and that no other type in
+// the household has its name
+func validateLabelType(ctx context.Context, householdID int, labelType LabelType) error {
+	if labelType.Name == "" {
+		return fmt.Errorf("name is required: %w", ErrTypeValidation)
+	}
+	if err := validateType(labelType.Name); err != nil {
 		return err
 	}
-	if rows == 0 {
-		err = sql.ErrNoRows
+	if err := validateIcon(labelType.Icon); err != nil {
 		return err
 	}
-
-	// Commit transaction
-	err = tx.Commit()
-	if err != nil {
+	var count int
+	q := "SELECT COUNT(*) FROM label_type WHERE household_id = ? AND name = ? AND label_type_id != ?"
+	connect()
+	if err := db.GetContext(ctx, &count, q, householdID, labelType.Name, labelType.ID); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("label type already exists: %s: %w", labelType.Name, ErrLabelTypeConflict)
+	}
+	return nil
+}
+
+// createRecipe inserts a recipe along with its labels, by name, and notes.
+// Labels the household doesn't have yet are created. It's all or nothing.
+func createRecipe(ctx context.Context, householdID int, title string, body string, activeTime int, totalTime int, isNew bool, labelNames []string, notes []string) (Recipe, error) {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Recipe{}, err
+	}
+	defer tx.Rollback()
+
+	q := "INSERT INTO recipe (household_id, title, recipe_body, active_time, total_time, new, created) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.ExecContext(ctx, q, householdID, title, body, activeTime, totalTime, isNew, time.Now().Unix())
+	if err != nil {
+		return Recipe{}, err
+	}
+	recipeID, err := result.LastInsertId()
+	if err != nil {
+		return Recipe{}, err
+	}
+	if err := linkLabelsByName(ctx, tx, householdID, recipeID, labelNames); err != nil {
+		return Recipe{}, err
+	}
+	epoch := time.Now().Unix()
+	for _, note := range notes {
+		q := "INSERT INTO note (household_id, recipe_id, note, create_date) VALUES (?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, q, householdID, recipeID, note, epoch); err != nil {
+			return Recipe{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Recipe{}, err
+	}
+	return recipeByID(ctx, householdID, int(recipeID), len(labelNames) > 0)
+}
+
+func createRecipeLabel(ctx context.Context, recipeID int, labelID int) error {
+	q := "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)"
+	connect()
+	_, err := db.ExecContext(ctx, q, recipeID, labelID)
+	return err
+}
+
+func createNote(ctx context.Context, householdID int, recipeID int, note string) (Note, error) {
+	epoch := time.Now().Unix()
+	q := "INSERT INTO note (household_id, recipe_id, note, create_date) VALUES (?, ?, ?, ?)"
+	connect()
+	result, err := db.ExecContext(ctx, q, householdID, recipeID, note, epoch)
+	if err != nil {
+		return Note{}, err
+	}
+	noteID, err := result.LastInsertId()
+	if err != nil {
+		return Note{}, err
+	}
+	return getNoteByID(ctx, householdID, int(noteID))
+}
+
+func createAPIKey(ctx context.Context, userID int, householdID int, name string, scope string, keyHash string, prefix string, expires int64) (APIKey, error) {
+	if err := validateAPIKeyName(name); err != nil {
+		return APIKey{}, err
+	}
+	if err := validateAPIKeyScope(scope); err != nil {
+		return APIKey{}, err
+	}
+
+	q := `INSERT INTO api_key (user_id, household_id, name, prefix, key_hash, scope, created, expires)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	connect()
+	result, err := db.ExecContext(ctx, q, userID, householdID, name, prefix, keyHash, scope, time.Now().Unix(), expires)
+	if err != nil {
+		return APIKey{}, err
+	}
+	keyID, err := result.LastInsertId()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	var key APIKey
+	err = db.GetContext(ctx, &key, "SELECT * FROM api_key WHERE key_id = ?", keyID)
+	return key, err
+}
+
+func linkIdentity(ctx context.Context, issuer string, subject string, userID int) error {
+	q := "INSERT INTO user_identity (issuer, subject, user_id, created) VALUES (?, ?, ?, ?)"
+	connect()
+	_, err := db.ExecContext(ctx, q, issuer, subject, userID, time.Now().Unix())
+	return err
+}
+
+// createIdentityUser provisions a user who signs in through an external
+// identity provider. They get no local password, so /login/ never works for
+// them until they set one.
+func createIdentityUser(ctx context.Context, issuer string, subject string, username string, role Role, householdID int) (User, error) {
+	if err := validateRole(role); err != nil {
+		return User{}, err
+	}
+
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	q := "INSERT INTO user (username, password, plaintext_pw_bootstrapping_only) VALUES (?, '', '')"
+	result, err := tx.ExecContext(ctx, q, username)
+	if err != nil {
+		return User{}, err
+	}
+	userID, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	q = "INSERT INTO user_identity (issuer, subject, user_id, created) VALUES (?, ?, ?, ?)"
+	if _, err := tx.ExecContext(ctx, q, issuer, subject, userID, time.Now().Unix()); err != nil {
+		return User{}, err
+	}
+	q = "INSERT INTO household_user (household_id, user_id, role) VALUES (?, ?, ?)"
+	if _, err := tx.ExecContext(ctx, q, householdID, userID, role); err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return userByID(ctx, int(userID))
+}
+
+// recordAudit adds an entry to the audit log. householdID is the household
+// whose admins can read it; 0 is for events that belong to no household.
+func recordAudit(ctx context.Context, householdID int, actorID int, action string, entityType string, entityID int, before interface{}, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	q := `INSERT INTO audit_log (household_id, actor_id, action, entity_type, entity_id, before_json, after_json, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	connect()
+	_, err = db.ExecContext(ctx, q, householdID, actorID, action, entityType, entityID, beforeJSON, afterJSON, time.Now().Unix())
+	return err
+}
+
+// recordLoginFailure bumps the failure count for a username or IP and, once
+// the count passes the configured threshold, locks it out with exponential
+// backoff. Failures older than the maximum lockout are forgotten.
+func recordLoginFailure(ctx context.Context, scope string, subject string, now time.Time) (Lockout, error) {
+	connect()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Lockout{}, err
+	}
+	defer tx.Rollback()
+
+	var lockout Lockout
+	q := "SELECT * FROM login_lockout WHERE scope = ? AND subject = ?"
+	err = tx.GetContext(ctx, &lockout, q, scope, subject)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Lockout{}, err
+	}
+
+	if !exists || now.Unix()-lockout.LastFailure > int64(loginLockoutMax().Seconds()) {
+		lockout = Lockout{Scope: scope, Subject: subject}
+	}
+	lockout.Failures++
+	lockout.LastFailure = now.Unix()
+	if d := lockoutDuration(scope, lockout.Failures); d > 0 {
+		lockout.LockedUntil = now.Add(d).Unix()
+	}
+
+	if exists {
+		q = "UPDATE login_lockout SET failures = ?, last_failure = ?, locked_until = ? WHERE scope = ? AND subject = ?"
+	} else {
+		q = "INSERT INTO login_lockout (failures, last_failure, locked_until, scope, subject) VALUES (?, ?, ?, ?, ?)"
+	}
+	_, err = tx.ExecContext(ctx, q, lockout.Failures, lockout.LastFailure, lockout.LockedUntil, scope, subject)
+	if err != nil {
+		return Lockout{}, err
+	}
+	return lockout, tx.Commit()
+}
+
+// createHousehold creates a household with its owner as its admin
+func createHousehold(ctx context.Context, name string, ownerID int) (Household, error) {
+	code, err := newInviteCode()
+	if err != nil {
+		return Household{}, err
+	}
+
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Household{}, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO household (name, invite_code) VALUES (?, ?)", name, code)
+	if err != nil {
+		return Household{}, err
+	}
+	householdID, err := result.LastInsertId()
+	if err != nil {
+		return Household{}, err
+	}
+	q := "INSERT INTO household_user (household_id, user_id, role) VALUES (?, ?, ?)"
+	_, err = tx.ExecContext(ctx, q, householdID, ownerID, RoleAdmin)
+	if err != nil {
+		return Household{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Household{}, err
+	}
+	return householdByID(ctx, int(householdID))
+}
+
+// addHouseholdMember adds a user to a household as a viewer, whatever role
+// they have elsewhere; existing members keep their role
+func addHouseholdMember(ctx context.Context, householdID int, userID int) error {
+	member, err := isHouseholdMember(ctx, householdID, userID)
+	if err != nil || member {
+		return err
+	}
+	q := "INSERT INTO household_user (household_id, user_id, role) VALUES (?, ?, ?)"
+	connect()
+	_, err = db.ExecContext(ctx, q, householdID, userID, RoleViewer)
+	return err
+}
+
+// copyRecipe copies a recipe and its labels into another household. Labels
+// are matched by name in the target household and created if missing; notes
+// stay behind since they're specific to the family that wrote them.
+func copyRecipe(ctx context.Context, fromHouseholdID int, recipeID int, toHouseholdID int) (Recipe, error) {
+	source, err := recipeByID(ctx, fromHouseholdID, recipeID, true)
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Recipe{}, err
+	}
+	defer tx.Rollback()
+
+	q := "INSERT INTO recipe (household_id, title, recipe_body, active_time, total_time, new, created) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	result, err := tx.ExecContext(ctx, q, toHouseholdID, source.Title, source.Body, source.ActiveTime, source.Time, true, time.Now().Unix())
+	if err != nil {
+		return Recipe{}, err
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return Recipe{}, err
+	}
+
+	for _, label := range source.Labels {
+		labelID, err := findOrCreateLabel(ctx, tx, toHouseholdID, label)
+		if err != nil {
+			return Recipe{}, err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)", newID, labelID)
+		if err != nil {
+			return Recipe{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Recipe{}, err
+	}
+	return recipeByID(ctx, toHouseholdID, int(newID), true)
+}
+
+// findOrCreateLabel returns the ID of the household's label with this
+// label's name (or alias), creating it (with this label's icon, and type if
+// the household has one by that name) if needed
+func findOrCreateLabel(ctx context.Context, tx *sql.Tx, householdID int, label Label) (int64, error) {
+	var labelID int64
+	err := tx.QueryRowContext(ctx, "SELECT label_id FROM label WHERE "+labelNamed, labelNamedArgs(householdID, label.Label)...).Scan(&labelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		q := `INSERT INTO label (household_id, label, icon, type_id) VALUES (?, ?, ?,
+			COALESCE((SELECT label_type_id FROM label_type WHERE household_id = ? AND name = ?), 0))`
+		result, err := tx.ExecContext(ctx, q, householdID, label.Label, label.Icon, householdID, label.Type)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+	return labelID, err
+}
+
+func linkLabelsByName(ctx context.Context, tx *sql.Tx, householdID int, recipeID int64, labelNames []string) error {
+	linked := map[int64]bool{} // a name and its alias are the same label
+	for _, name := range labelNames {
+		labelID, err := findOrCreateLabel(ctx, tx, householdID, Label{Label: name})
+		if err != nil {
+			return err
+		}
+		if linked[labelID] {
+			continue
+		}
+		linked[labelID] = true
+		_, err = tx.ExecContext(ctx, "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)", recipeID, labelID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Edit //
+
+// versionMatches ends the WHERE clause of every versioned UPDATE or DELETE.
+// It takes the expected version twice; 0 matches any version.
+const versionMatches = "(? = 0 OR version = ?)"
+
+// checkVersion turns an UPDATE or DELETE that matched no rows despite an
+// expected version into ErrVersionConflict
+func checkVersion(result sql.Result, err error, version int) error {
+	if err != nil || version == 0 {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// checkFound is checkVersion for changes to a single row that must exist:
+// matching no rows without a version is sql.ErrNoRows
+func checkFound(result sql.Result, err error, version int) error {
+	if err != nil || version != 0 {
+		return checkVersion(result, err, version)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// touchTypedLabels bumps the versions of a type's labels, and of their
+// recipes, which embed the type's name
+func touchTypedLabels(ctx context.Context, tx *sql.Tx, typeID int) error {
+	q := `UPDATE recipe SET version = version + 1 WHERE recipe_id IN
+		(SELECT recipe_id FROM recipe_label JOIN label USING (label_id) WHERE label.type_id = ?)`
+	if _, err := tx.ExecContext(ctx, q, typeID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE label SET version = version + 1 WHERE type_id = ?", typeID)
+	return err
+}
+
+func touchLabeledRecipes(ctx context.Context, tx *sql.Tx, labelID int) error {
+	q := "UPDATE recipe SET version = version + 1 WHERE recipe_id IN (SELECT recipe_id FROM recipe_label WHERE label_id = ?)"
+	_, err := tx.ExecContext(ctx, q, labelID)
+	return err
+}
+
+// updateRecipe replaces a recipe's fields. If labelNames is non-nil the
+// recipe's labels are replaced too, creating any the household doesn't have.
+// A non-zero version must match the recipe's current one.
+func updateRecipe(ctx context.Context, householdID int, recipeId int, title string, body string, activeTime int, totalTime int, isNew bool, labelNames []string, version int) error {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `UPDATE recipe SET
+		title = ?,
+		recipe_body = ?,
+		active_time = ?,
+		total_time = ?,
+		new = ?,
+		version = version + 1
+		WHERE household_id = ? AND recipe_id = ? AND ` + versionMatches
+	result, err := tx.ExecContext(ctx, q, title, body, activeTime, totalTime, isNew, householdID, recipeId, version, version)
+	if err := checkFound(result, err, version); err != nil {
+		return err
+	}
+	if labelNames != nil {
+		q = "DELETE FROM recipe_label WHERE recipe_id IN (SELECT recipe_id FROM recipe WHERE household_id = ? AND recipe_id = ?)"
+		if _, err := tx.ExecContext(ctx, q, householdID, recipeId); err != nil {
+			return err
+		}
+		if err := linkLabelsByName(ctx, tx, householdID, int64(recipeId), labelNames); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func setNoteFlag(ctx context.Context, householdID int, noteID int, flag bool, version int) error {
+	q := "UPDATE note SET flagged = ?, version = version + 1 WHERE household_id = ? AND note_id = ? AND " + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, flag, householdID, noteID, version, version)
+	return checkFound(result, err, version)
+}
+
+func setNoteText(ctx context.Context, householdID int, noteID int, text string, version int) error {
+	q := "UPDATE note SET note = ?, version = version + 1 WHERE household_id = ? AND note_id = ? AND " + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, text, householdID, noteID, version, version)
+	return checkFound(result, err, version)
+}
+
+// softDeleteRecipe moves a recipe to the trash. Deleting it again keeps the
+// time it was first deleted.
+func softDeleteRecipe(ctx context.Context, householdID int, recipeId int, version int) error {
+	q := `UPDATE recipe SET deleted_at = CASE WHEN deleted = 1 THEN deleted_at ELSE ? END, deleted = 1, version = version + 1
+		WHERE household_id = ? AND recipe_id = ? AND ` + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, time.Now().Unix(), householdID, recipeId, version, version)
+	return checkFound(result, err, version)
+}
+
+func unDeleteRecipe(ctx context.Context, householdID int, recipeId int, version int) error {
+	q := "UPDATE recipe SET deleted = 0, deleted_at = 0, version = version + 1 WHERE household_id = ? AND recipe_id = ? AND " + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, householdID, recipeId, version, version)
+	return checkFound(result, err, version)
+}
+
+func setRecipeNewFlag(ctx context.Context, householdID int, recipeID int, isNew bool, version int) error {
+	// Marking a recipe cooked also records when
+	q := "UPDATE recipe SET new = ?, last_cooked = CASE WHEN ? THEN last_cooked ELSE ? END, version = version + 1 WHERE household_id = ? AND recipe_id = ? AND " + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, isNew, isNew, time.Now().Unix(), householdID, recipeID, version, version)
+	return checkFound(result, err, version)
+}
+
+// touchRecipe bumps a recipe's version for changes stored outside the
+// recipe row, like its labels
+func touchRecipe(ctx context.Context, tx *sql.Tx, householdID int, recipeID int, version int) error {
+	q := "UPDATE recipe SET version = version + 1 WHERE household_id = ? AND recipe_id = ? AND " + versionMatches
+	result, err := tx.ExecContext(ctx, q, householdID, recipeID, version, version)
+	return checkFound(result, err, version)
+}
+
+// labelRecipe links a label to a recipe and bumps the recipe's version
+// together, so a version conflict leaves the recipe unlabeled
+func labelRecipe(ctx context.Context, householdID int, recipeID int, labelID int, version int) error {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := touchRecipe(ctx, tx, householdID, recipeID, version); err != nil {
+		return err
+	}
+	q := "INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)"
+	if _, err := tx.ExecContext(ctx, q, recipeID, labelID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// unlabelRecipe removes a label from a recipe and bumps the recipe's
+// version together; labels of other households are left alone
+func unlabelRecipe(ctx context.Context, householdID int, recipeID int, labelID int, version int) error {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := touchRecipe(ctx, tx, householdID, recipeID, version); err != nil {
+		return err
+	}
+	q := `DELETE FROM recipe_label WHERE recipe_id = ? AND label_id = ?
+		AND label_id IN (SELECT label_id FROM label WHERE household_id = ?)`
+	if _, err := tx.ExecContext(ctx, q, recipeID, labelID, householdID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setHouseholdInviteCode(ctx context.Context, householdID int, code string) error {
+	q := "UPDATE household SET invite_code = ? WHERE household_id = ?"
+	connect()
+	_, err := db.ExecContext(ctx, q, code, householdID)
+	return err
+}
+
+// updateLabel sets a label's name, icon, type (by name; it must be one of
+// the household's label types, or empty) and parent label (0 for none)
+func updateLabel(ctx context.Context, householdID int, labelID int, newName string, icon string, labelType string, parentID int, version int) error {
+	// Validate icon
+	if err := validateIcon(icon); err != nil {
+		return err
+	}
+
+	// Validate type
+	if err := validateType(labelType); err != nil {
+		return err
+	}
+
+	// Fetch existing label to check if it exists
+	existing, err := labelByID(ctx, householdID, labelID)
+	if err != nil {
+		return err // Returns sql.ErrNoRows if not found
+	}
+
+	// Normalize new name to lowercase
+	normalizedName := strings.ToLower(newName)
+
+	// Look the type up by its normalized name
+	var typeID int
+	if labelType != "" {
+		found, err := labelTypeByName(ctx, householdID, strings.ToLower(labelType))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("unknown label type %q: %w", labelType, ErrTypeValidation)
+		} else if err != nil {
+			return err
+		}
+		typeID = found.ID
+	}
+
+	// The parent must be another of the household's labels, and not one
+	// below this one
+	if parentID != 0 && parentID != existing.ParentID {
+		labels, err := allLabels(ctx, householdID)
+		if err != nil {
+			return err
+		}
+		if err := validateParent(labels, labelID, parentID); err != nil {
+			return err
+		}
+	}
+
+	// Check for name conflicts if name is changing
+	if normalizedName != existing.Label {
+		var count int
+		q := "SELECT COUNT(*) FROM label WHERE household_id = ? AND LOWER(label) = ? AND label_id != ?"
+		connect()
+		err := db.GetContext(ctx, &count, q, householdID, normalizedName, labelID)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("label name already exists: %s: %w", newName, ErrLabelConflict)
+		}
+	}
+
+	// Update every field. Recipes embed their labels, so their versions
+	// change too.
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := "UPDATE label SET label = ?, icon = ?, type_id = ?, parent_id = ?, version = version + 1 WHERE household_id = ? AND label_id = ? AND " + versionMatches
+	result, err := tx.ExecContext(ctx, q, normalizedName, icon, typeID, parentID, householdID, labelID, version, version)
+	if err := checkVersion(result, err, version); err != nil {
+		return err
+	}
+	if err := touchLabeledRecipes(ctx, tx, labelID); err != nil {
+		return err
+	}
+	// A label renamed to an alias takes the name back from the label it
+	// pointed to
+	if _, err := tx.ExecContext(ctx, "DELETE FROM label_alias WHERE household_id = ? AND alias = ?", householdID, normalizedName); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateLabelType replaces the fields of the label type with labelType's
+// ID. A non-zero version must match its current one.
+func updateLabelType(ctx context.Context, householdID int, labelType LabelType, version int) error {
+	labelType.Name = strings.ToLower(labelType.Name)
+	existing, err := labelTypeByID(ctx, householdID, labelType.ID)
+	if err != nil {
+		return err
+	}
+	if err := validateLabelType(ctx, householdID, labelType); err != nil {
 		return err
 	}
 
-	fmt.Printf("deleted label %d and unlinked all recipes\n", labelID)
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	q := `UPDATE label_type SET name = ?, icon = ?, display_order = ?, multi_select = ?, version = version + 1
+		WHERE household_id = ? AND label_type_id = ? AND ` + versionMatches
+	result, err := tx.ExecContext(ctx, q, labelType.Name, labelType.Icon, labelType.DisplayOrder, labelType.MultiSelect,
+		householdID, labelType.ID, version, version)
+	if err := checkVersion(result, err, version); err != nil {
+		return err
+	}
+	if labelType.Name != existing.Name {
+		if err := touchTypedLabels(ctx, tx, labelType.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// mergeLabel moves every recipe labeled with one label to another, deletes
+// the first and keeps its name, and any aliases it had, as aliases of the
+// second. Recipes that had both end up with one link. It's all or nothing;
+// a non-zero version must match the merged label's.
+func mergeLabel(ctx context.Context, householdID int, labelID int, targetID int, version int) (err error) {
+	connect()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var label, target Label
+	q := "SELECT * FROM label WHERE household_id = ? AND label_id = ?"
+	if err = tx.GetContext(ctx, &label, q, householdID, labelID); err != nil {
+		return err
+	}
+	if err = tx.GetContext(ctx, &target, q, householdID, targetID); err != nil {
+		return err
+	}
+	if version != 0 && label.Version != version {
+		err = ErrVersionConflict
+		return err
+	}
+
+	// The merged label's children move to the target. If the target was
+	// below the merged label it takes the merged label's place, so there's
+	// no loop.
+	var labels []Label
+	if err = tx.SelectContext(ctx, &labels, "SELECT label_id, parent_id FROM label WHERE household_id = ?", householdID); err != nil {
+		return err
+	}
+	for _, id := range labelFamily(labels, labelID) {
+		if id == targetID {
+			if _, err = tx.ExecContext(ctx, "UPDATE label SET parent_id = ? WHERE label_id = ?", label.ParentID, targetID); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE label SET parent_id = ?, version = version + 1 WHERE parent_id = ? AND label_id != ?", targetID, labelID, targetID); err != nil {
+		return err
+	}
+
+	if err = touchLabeledRecipes(ctx, tx.Tx, labelID); err != nil {
+		return err
+	}
+	q = `INSERT INTO recipe_label (recipe_id, label_id)
+		SELECT recipe_id, ? FROM recipe_label WHERE label_id = ?
+		AND recipe_id NOT IN (SELECT recipe_id FROM recipe_label WHERE label_id = ?)`
+	if _, err = tx.ExecContext(ctx, q, targetID, labelID, targetID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recipe_label WHERE label_id = ?", labelID); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE label_alias SET label_id = ? WHERE label_id = ?", targetID, labelID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM label_alias WHERE household_id = ? AND alias = ?", householdID, label.Label); err != nil {
+		return err
+	}
+	q = "INSERT INTO label_alias (household_id, alias, label_id) VALUES (?, ?, ?)"
+	if _, err = tx.ExecContext(ctx, q, householdID, label.Label, targetID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM label WHERE label_id = ?", labelID); err != nil {
+		return err
+	}
+	// The target's aliases are part of it
+	if _, err = tx.ExecContext(ctx, "UPDATE label SET version = version + 1 WHERE label_id = ?", targetID); err != nil {
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
+
+func setUserPassword(ctx context.Context, userID int, hashedPassword string) error {
+	q := "UPDATE user SET password = ? WHERE user_id = ?"
+	connect()
+	_, err := db.ExecContext(ctx, q, hashedPassword, userID)
+	return err
+}
+
+// setUserRole changes a member's role in the household, leaving their roles
+// in other households alone; users who aren't members get sql.ErrNoRows
+func setUserRole(ctx context.Context, householdID int, userID int, role Role) error {
+	if err := validateRole(role); err != nil {
+		return err
+	}
+
+	q := "UPDATE household_user SET role = ? WHERE household_id = ? AND user_id = ?"
+	connect()
+	result, err := db.ExecContext(ctx, q, role, householdID, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func updateUserPreferences(ctx context.Context, userID int, unitSystem string, defaultServings int) error {
+	if err := validateUnitSystem(unitSystem); err != nil {
+		return err
+	}
+	if err := validateServings(defaultServings); err != nil {
+		return err
+	}
+
+	q := "UPDATE user SET unit_system = ?, default_servings = ? WHERE user_id = ?"
+	connect()
+	_, err := db.ExecContext(ctx, q, strings.ToLower(unitSystem), defaultServings, userID)
+	return err
+}
+
+func touchAPIKey(ctx context.Context, keyID int, now time.Time) error {
+	q := "UPDATE api_key SET last_used = ? WHERE key_id = ?"
+	connect()
+	_, err := db.ExecContext(ctx, q, now.Unix(), keyID)
+	return err
+}
+
+// Delete //
+func deleteNote(ctx context.Context, householdID int, noteID int, version int) error {
+	q := "DELETE FROM note WHERE household_id = ? AND note_id = ? AND " + versionMatches
+	connect()
+	result, err := db.ExecContext(ctx, q, householdID, noteID, version, version)
+	return checkFound(result, err, version)
+}
+
+func deleteAPIKey(ctx context.Context, userID int, keyID int) error {
+	q := "DELETE FROM api_key WHERE user_id = ? AND key_id = ?"
+	connect()
+	result, err := db.ExecContext(ctx, q, userID, keyID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// clearLockout clears any lockout in the deployment
+func clearLockout(ctx context.Context, scope string, subject string) error {
+	q := "DELETE FROM login_lockout WHERE scope = ? AND subject = ?"
+	connect()
+	result, err := db.ExecContext(ctx, q, scope, subject)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
+// clearMemberLockout clears the username lockout of a household member;
+// anyone else's gets sql.ErrNoRows
+func clearMemberLockout(ctx context.Context, householdID int, username string) error {
+	q := `DELETE FROM login_lockout WHERE scope = ? AND subject = ? AND subject IN
+		(SELECT LOWER(username) FROM user JOIN household_user USING (user_id) WHERE household_id = ?)`
+	connect()
+	result, err := db.ExecContext(ctx, q, lockoutScopeUser, username, householdID)
+	return checkFound(result, err, 0)
+}
+
+func deleteLabel(ctx context.Context, householdID int, labelID int, version int) error {
+	connect()
+
+	// Start transaction for atomic deletion
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Ensure transaction is always closed
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// Its children will move up to its parent
+	var parentID int
+	err = tx.QueryRowContext(ctx, "SELECT parent_id FROM label WHERE household_id = ? AND label_id = ?", householdID, labelID).Scan(&parentID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// First delete the label itself, making sure it belongs to this household
+	q := "DELETE FROM label WHERE household_id = ? AND label_id = ? AND " + versionMatches
+	result, err := tx.ExecContext(ctx, q, householdID, labelID, version, version)
+	if err != nil {
+		return err
+	}
+
+	// Check if label existed
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = sql.ErrNoRows
+		if version != 0 {
+			err = ErrVersionConflict
+		}
+		return err
+	}
+
+	// Then unlink all recipes
+	if err = touchLabeledRecipes(ctx, tx, labelID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM recipe_label WHERE label_id = ?", labelID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE label SET parent_id = ?, version = version + 1 WHERE parent_id = ?", parentID, labelID)
+	if err != nil {
+		return err
+	}
+
+	// Commit transaction
+	err = tx.Commit()
+	return err
+}
+
+// deleteLabelType deletes a label type; its labels are left without one
+func deleteLabelType(ctx context.Context, householdID int, typeID int, version int) (err error) {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	q := "DELETE FROM label_type WHERE household_id = ? AND label_type_id = ? AND " + versionMatches
+	result, err := tx.ExecContext(ctx, q, householdID, typeID, version, version)
+	if err = checkFound(result, err, version); err != nil {
+		return err
+	}
+	if err = touchTypedLabels(ctx, tx, typeID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE label SET type_id = 0 WHERE type_id = ?", typeID); err != nil {
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
+
+// deleteRecipe permanently deletes a recipe with its label links and notes,
+// all or nothing. The foreign keys cascade, but older databases may not have
+// them yet, so the links and notes are deleted explicitly too.
+func deleteRecipe(ctx context.Context, householdID int, recipeID int, version int) error {
+	return deleteRecipeIf(ctx, householdID, recipeID, version, "")
+}
+
+// deleteTrashedRecipe is deleteRecipe for a recipe in the trash; one that
+// isn't is sql.ErrNoRows
+func deleteTrashedRecipe(ctx context.Context, householdID int, recipeID int, version int) error {
+	return deleteRecipeIf(ctx, householdID, recipeID, version, " AND deleted = 1")
+}
+
+func deleteRecipeIf(ctx context.Context, householdID int, recipeID int, version int, condition string) error {
+	connect()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	q := "DELETE FROM recipe WHERE household_id = ? AND recipe_id = ?" + condition + " AND " + versionMatches
+	result, err := tx.ExecContext(ctx, q, householdID, recipeID, version, version)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		err = sql.ErrNoRows
+		if version != 0 {
+			err = ErrVersionConflict
+		}
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM recipe_label WHERE recipe_id = ?", recipeID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, "DELETE FROM note WHERE recipe_id = ?", recipeID); err != nil {
+		return err
+	}
+	err = tx.Commit()
+	return err
+}
+
+// purgeTrash permanently deletes every recipe, in any household, that went
+// in the trash before cutoff, and returns them. Recipes with no deletion
+// time, like deleted sample recipes, are left alone.
+func purgeTrash(ctx context.Context, cutoff int64) (purged []Recipe, err error) {
+	connect()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = tx.SelectContext(ctx, &purged, "SELECT * FROM recipe WHERE deleted = 1 AND deleted_at > 0 AND deleted_at < ? ORDER BY recipe_id", cutoff)
+	if err != nil || len(purged) == 0 {
+		tx.Rollback()
+		return nil, err
+	}
+	ids := make([]int, len(purged))
+	for i, recipe := range purged {
+		ids[i] = recipe.ID
+	}
+	for _, q := range []string{
+		"DELETE FROM recipe_label WHERE recipe_id IN (?)",
+		"DELETE FROM note WHERE recipe_id IN (?)",
+		"DELETE FROM recipe WHERE recipe_id IN (?)",
+	} {
+		var args []interface{}
+		if q, args, err = sqlx.In(q, ids); err != nil {
+			return nil, err
+		}
+		if _, err = tx.ExecContext(ctx, tx.Rebind(q), args...); err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	return purged, err
+}
+
 // MISC //
+func auditJSON(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// connect opens the database without checking that it's reachable, so a
+// database outage makes the server not ready rather than crashing it
 func connect() {
 	if db != nil {
 		return
 	}
-	db = sqlx.MustConnect(conf.DbDialect, conf.DbDSN)
+	dsn := conf.DbDSN
+	if conf.DbDialect == "sqlite3" {
+		dsn = sqliteDSN(dsn)
+	}
+	var err error
+	if db, err = sqlx.Open(conf.DbDialect, dsn); err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
 
 	// For in-memory SQLite, we must use exactly one connection
 	// Otherwise each connection gets its own isolated database
@@ -399,11 +1830,49 @@ func connect() {
 	}
 }
 
+// sqliteDSN turns on foreign key enforcement, which SQLite leaves off
+// unless each connection asks for it
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "_foreign_keys=") || strings.Contains(dsn, "_fk=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=1"
+	}
+	return dsn + "?_foreign_keys=1"
+}
+
 /***********
  * METHODS *
  ***********/
 func (u User) CheckPassword(cleartext string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.HashedPassword), []byte(cleartext))
+	return checkPasswordHash(u.HashedPassword, cleartext)
+}
+
+// MarshalJSON emits Before and After as embedded JSON rather than as strings
+func (a AuditEntry) MarshalJSON() ([]byte, error) {
+	type entry AuditEntry
+	return json.Marshal(struct {
+		entry
+		Before json.RawMessage
+		After  json.RawMessage
+	}{entry(a), rawJSON(a.Before), rawJSON(a.After)})
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
+
+// Expired reports whether the key has passed its expiry time
+func (k APIKey) Expired(now time.Time) bool {
+	return k.Expires != 0 && now.Unix() >= k.Expires
+}
+
+func (l Lockout) Locked(now time.Time) bool {
+	return l.LockedUntil > now.Unix()
 }
 
 func (r Recipe) String() string {
@@ -1,20 +1,65 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 )
 
-func TestUserStructHasAdministratorField(t *testing.T) {
+func TestUserStructHasRoleField(t *testing.T) {
 	user := User{
-		ID:            1,
-		Username:      "testuser",
-		Administrator: true,
+		ID:       1,
+		Username: "testuser",
+		Role:     RoleAdmin,
 	}
 
-	if user.Administrator != true {
-		t.Errorf("Expected Administrator to be true, got %v", user.Administrator)
+	if user.Role != RoleAdmin {
+		t.Errorf("Expected Role to be admin, got %v", user.Role)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	setupIntegrationTest()
+
+	if err := setUserRole(context.Background(), 1, 4, RoleContributor); err != nil {
+		t.Fatalf("setUserRole() returned error: %v", err)
+	}
+	user, _ := householdUser(context.Background(), 1, 4)
+	if user.Role != RoleContributor {
+		t.Errorf("Expected role contributor, got %q", user.Role)
+	}
+
+	if err := setUserRole(context.Background(), 1, 4, Role("overlord")); !errors.Is(err, ErrRoleValidation) {
+		t.Errorf("Expected ErrRoleValidation for unknown role, got %v", err)
+	}
+	if err := setUserRole(context.Background(), 1, 9999, RoleViewer); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for unknown user, got %v", err)
+	}
+
+	// Only members of the household can be changed
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	if err := setUserRole(context.Background(), household.ID, 4, RoleAdmin); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows for a user outside the household, got %v", err)
+	}
+	if users, _ := allUsers(context.Background(), household.ID); len(users) != 1 || users[0].ID != 1 || users[0].Role != RoleAdmin {
+		t.Errorf("Expected only the household's creator as its admin, got %+v", users)
+	}
+
+	// Roles belong to the membership, so changing one leaves the others alone
+	addHouseholdMember(context.Background(), household.ID, 4)
+	if role, _ := householdRole(context.Background(), household.ID, 4); role != RoleViewer {
+		t.Errorf("Expected a new member to join as a viewer, got %q", role)
+	}
+	if err := setUserRole(context.Background(), household.ID, 4, RoleEditor); err != nil {
+		t.Fatalf("setUserRole() returned error: %v", err)
+	}
+	if role, _ := householdRole(context.Background(), 1, 4); role != RoleContributor {
+		t.Errorf("Expected role in household 1 to stay contributor, got %q", role)
 	}
 }
 
@@ -54,7 +99,7 @@ func TestBootstrap(t *testing.T) {
 	bootstrap(false)
 	checkDb(t, 46, 20, 71)
 
-	db.Exec("insert into label values (50, 'florp', '', '')")
+	db.Exec("insert into label (label_id, label) values (50, 'florp')")
 	bootstrap(false)
 	checkDb(t, 47, 20, 71)
 	bootstrap(true)
@@ -77,7 +122,7 @@ func TestSetRecipeNewFlag(t *testing.T) {
 	bootstrap(true)
 
 	// Create a test recipe
-	recipe, err := createRecipe("Test Recipe", "Test body", 10, 20)
+	recipe, err := createRecipe(context.Background(), 1, "Test Recipe", "Test body", 10, 20, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to create test recipe: %v", err)
 	}
@@ -88,13 +133,13 @@ func TestSetRecipeNewFlag(t *testing.T) {
 	}
 
 	// Set to new (true)
-	err = setRecipeNewFlag(recipe.ID, true)
+	err = setRecipeNewFlag(context.Background(), 1, recipe.ID, true, 0)
 	if err != nil {
 		t.Errorf("setRecipeNewFlag(true) returned error: %v", err)
 	}
 
 	// Verify it was set
-	updated, err := recipeByID(recipe.ID, false)
+	updated, err := recipeByID(context.Background(), 1, recipe.ID, false)
 	if err != nil {
 		t.Fatalf("Failed to fetch recipe after update: %v", err)
 	}
@@ -103,13 +148,13 @@ func TestSetRecipeNewFlag(t *testing.T) {
 	}
 
 	// Set to cooked (false)
-	err = setRecipeNewFlag(recipe.ID, false)
+	err = setRecipeNewFlag(context.Background(), 1, recipe.ID, false, 0)
 	if err != nil {
 		t.Errorf("setRecipeNewFlag(false) returned error: %v", err)
 	}
 
 	// Verify it was set
-	updated, err = recipeByID(recipe.ID, false)
+	updated, err = recipeByID(context.Background(), 1, recipe.ID, false)
 	if err != nil {
 		t.Fatalf("Failed to fetch recipe after second update: %v", err)
 	}
@@ -134,19 +179,19 @@ func TestUpdateRecipeWithNewFlag(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe
-	recipe, err := createRecipe("Original Title", "Original Body", 10, 20)
+	recipe, err := createRecipe(context.Background(), 1, "Original Title", "Original Body", 10, 20, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to create recipe: %v", err)
 	}
 
 	// Update with new=true
-	err = updateRecipe(recipe.ID, "Updated Title", "Updated Body", 15, 25, true)
+	err = updateRecipe(context.Background(), 1, recipe.ID, "Updated Title", "Updated Body", 15, 25, true, nil, 0)
 	if err != nil {
 		t.Fatalf("updateRecipe failed: %v", err)
 	}
 
 	// Verify all fields updated including new flag
-	updated, err := recipeByID(recipe.ID, false)
+	updated, err := recipeByID(context.Background(), 1, recipe.ID, false)
 	if err != nil {
 		t.Fatalf("Failed to fetch updated recipe: %v", err)
 	}
@@ -168,13 +213,13 @@ func TestUpdateRecipeWithNewFlag(t *testing.T) {
 	}
 
 	// Update with new=false
-	err = updateRecipe(recipe.ID, "Final Title", "Final Body", 5, 10, false)
+	err = updateRecipe(context.Background(), 1, recipe.ID, "Final Title", "Final Body", 5, 10, false, nil, 0)
 	if err != nil {
 		t.Fatalf("Second updateRecipe failed: %v", err)
 	}
 
 	// Verify new flag set to false
-	updated, err = recipeByID(recipe.ID, false)
+	updated, err = recipeByID(context.Background(), 1, recipe.ID, false)
 	if err != nil {
 		t.Fatalf("Failed to fetch recipe after second update: %v", err)
 	}
@@ -203,12 +248,12 @@ func TestUpdateLabel(t *testing.T) {
 	bootstrap(true)
 
 	// Test 1: Update both name and icon
-	err := updateLabel(1, "newname", "🐄", "")
+	err := updateLabel(context.Background(), 1, 1, "newname", "🐄", "", 0, 0)
 	if err != nil {
 		t.Errorf("updateLabel() error = %v", err)
 	}
 
-	label, _ := labelByID(1)
+	label, _ := labelByID(context.Background(), 1, 1)
 	if label.Label != "newname" {
 		t.Errorf("Expected label name 'newname', got %q", label.Label)
 	}
@@ -217,29 +262,29 @@ func TestUpdateLabel(t *testing.T) {
 	}
 
 	// Test 2: Invalid icon should fail
-	err = updateLabel(1, "another", "🐓🐄", "")
+	err = updateLabel(context.Background(), 1, 1, "another", "🐓🐄", "", 0, 0)
 	if err == nil {
 		t.Error("Expected error for multi-character icon, got nil")
 	}
 
 	// Test 3: Name conflict should fail (beef is label 2)
-	err = updateLabel(1, "beef", "🐓", "")
+	err = updateLabel(context.Background(), 1, 1, "beef", "🐓", "", 0, 0)
 	if err == nil {
 		t.Error("Expected error for duplicate label name, got nil")
 	}
 
 	// Test 4: Empty icon should clear it
-	err = updateLabel(1, "cleared", "", "")
+	err = updateLabel(context.Background(), 1, 1, "cleared", "", "", 0, 0)
 	if err != nil {
 		t.Errorf("updateLabel() with empty icon error = %v", err)
 	}
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Icon != "" {
 		t.Errorf("Expected empty icon, got %q", label.Icon)
 	}
 
 	// Test 5: Nonexistent label should fail
-	err = updateLabel(999, "fake", "", "")
+	err = updateLabel(context.Background(), 1, 999, "fake", "", "", 0, 0)
 	if err == nil {
 		t.Error("Expected error for nonexistent label, got nil")
 	}
@@ -261,40 +306,40 @@ func TestUpdateLabelWithType(t *testing.T) {
 	bootstrap(true)
 
 	// Test 1: Update type only
-	err := updateLabel(1, "chicken", "🐓", "protein")
+	err := updateLabel(context.Background(), 1, 1, "chicken", "🐓", "protein", 0, 0)
 	if err != nil {
 		t.Errorf("updateLabel() error = %v", err)
 	}
 
-	label, _ := labelByID(1)
+	label, _ := labelByID(context.Background(), 1, 1)
 	if label.Type != "protein" {
 		t.Errorf("Expected type 'protein', got %q", label.Type)
 	}
 
 	// Test 2: Type normalization (uppercase -> lowercase)
-	err = updateLabel(1, "chicken", "🐓", "PROTEIN")
+	err = updateLabel(context.Background(), 1, 1, "chicken", "🐓", "PROTEIN", 0, 0)
 	if err != nil {
 		t.Errorf("updateLabel() error = %v", err)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Type != "protein" {
 		t.Errorf("Expected lowercase 'protein', got %q", label.Type)
 	}
 
 	// Test 3: Empty type clears it
-	err = updateLabel(1, "chicken", "🐓", "")
+	err = updateLabel(context.Background(), 1, 1, "chicken", "🐓", "", 0, 0)
 	if err != nil {
 		t.Errorf("updateLabel() with empty type error = %v", err)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Type != "" {
 		t.Errorf("Expected empty type, got %q", label.Type)
 	}
 
 	// Test 4: Type too long should fail
-	err = updateLabel(1, "chicken", "🐓", "123456789012345678901")
+	err = updateLabel(context.Background(), 1, 1, "chicken", "🐓", "123456789012345678901", 0, 0)
 	if err == nil {
 		t.Error("Expected error for type too long, got nil")
 	}
@@ -317,18 +362,18 @@ func TestDeleteLabel(t *testing.T) {
 
 	// Test 1: Delete a label with no recipes linked
 	// Create a new label that won't have any recipes
-	_, err := db.Exec("INSERT INTO label (label_id, label, icon, type) VALUES (999, 'testlabel', '🧪', 'test')")
+	_, err := db.Exec("INSERT INTO label (label_id, label, icon, type_id) VALUES (999, 'testlabel', '🧪', 8)")
 	if err != nil {
 		t.Fatalf("Failed to create test label: %v", err)
 	}
 
-	err = deleteLabel(999)
+	err = deleteLabel(context.Background(), 1, 999, 0)
 	if err != nil {
 		t.Errorf("deleteLabel(999) with no recipes failed: %v", err)
 	}
 
 	// Verify label is gone
-	_, err = labelByID(999)
+	_, err = labelByID(context.Background(), 1, 999)
 	if err == nil {
 		t.Error("Label 999 should not exist after deletion")
 	}
@@ -342,13 +387,13 @@ func TestDeleteLabel(t *testing.T) {
 	}
 
 	initialRecipeLinkCount := recipeLinkCount
-	err = deleteLabel(1)
+	err = deleteLabel(context.Background(), 1, 1, 0)
 	if err != nil {
 		t.Errorf("deleteLabel(1) with recipes failed: %v", err)
 	}
 
 	// Verify label is gone
-	_, err = labelByID(1)
+	_, err = labelByID(context.Background(), 1, 1)
 	if err == nil {
 		t.Error("Label 1 should not exist after deletion")
 	}
@@ -362,7 +407,7 @@ func TestDeleteLabel(t *testing.T) {
 	t.Logf("Successfully deleted label with %d recipe links", initialRecipeLinkCount)
 
 	// Test 3: Delete non-existent label
-	err = deleteLabel(9999)
+	err = deleteLabel(context.Background(), 1, 9999, 0)
 	if err == nil {
 		t.Error("deleteLabel(9999) should return error for non-existent label")
 	}
@@ -377,7 +422,7 @@ func TestDeleteLabel(t *testing.T) {
 	db.QueryRow("SELECT COUNT(*) FROM recipe_label").Scan(&recipeLabelCount)
 
 	// Delete another label
-	err = deleteLabel(2) // beef label
+	err = deleteLabel(context.Background(), 1, 2, 0) // beef label
 	if err != nil {
 		t.Fatalf("Failed to delete label 2: %v", err)
 	}
@@ -397,6 +442,267 @@ func TestDeleteLabel(t *testing.T) {
 	}
 }
 
+func TestMergeLabel(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+	sauce, _ := labelByName(ctx, 1, "sauce")
+	sauces, _ := labelByName(ctx, 1, "sauces")
+	soup, _ := labelByName(ctx, 1, "soup")
+	linked := func(labelID int) []int {
+		var ids []int
+		db.Select(&ids, "SELECT recipe_id FROM recipe_label WHERE label_id = ? ORDER BY recipe_id", labelID)
+		return ids
+	}
+
+	// Recipe 1 has both labels, recipe 2 only the duplicate
+	db.Exec("DELETE FROM recipe_label WHERE label_id IN (?, ?)", sauce.ID, sauces.ID)
+	createRecipeLabel(ctx, 1, sauce.ID)
+	createRecipeLabel(ctx, 1, sauces.ID)
+	createRecipeLabel(ctx, 2, sauces.ID)
+
+	if err := mergeLabel(ctx, 1, sauces.ID, sauce.ID, 99); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if err := mergeLabel(ctx, 1, sauces.ID, 9001, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows merging into a missing label, got %v", err)
+	}
+	if got := linked(sauces.ID); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("Expected failed merges to leave the links alone, got %v", got)
+	}
+
+	if err := mergeLabel(ctx, 1, sauces.ID, sauce.ID, sauces.Version); err != nil {
+		t.Fatalf("mergeLabel() returned error: %v", err)
+	}
+	if got := linked(sauce.ID); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Expected recipes 1 and 2 to be labeled sauce once each, got %v", got)
+	}
+	if _, err := labelByID(ctx, 1, sauces.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected the merged label to be gone, got %v", err)
+	}
+	if label, err := labelByName(ctx, 1, "sauces"); err != nil || label.ID != sauce.ID {
+		t.Errorf("Expected sauces to resolve to sauce, got %+v, %v", label, err)
+	}
+
+	// Aliases resolve when labeling recipes too, without linking twice
+	recipe, err := createRecipe(ctx, 1, "Pesto", "Blend", 10, 10, false, []string{"sauces", "sauce"}, nil)
+	if err != nil || len(recipe.Labels) != 1 || recipe.Labels[0].ID != sauce.ID {
+		t.Errorf("Expected Pesto to be labeled sauce once, got %+v, %v", recipe.Labels, err)
+	}
+
+	// Merging again carries the aliases along
+	if err := mergeLabel(ctx, 1, sauce.ID, soup.ID, 0); err != nil {
+		t.Fatalf("mergeLabel() returned error: %v", err)
+	}
+	if aliases, _ := labelAliases(ctx, 1, soup.ID); !reflect.DeepEqual(aliases, []string{"sauce", "sauces"}) {
+		t.Errorf("Expected soup to have aliases sauce and sauces, got %v", aliases)
+	}
+	if label, _ := labelByName(ctx, 1, "sauces"); label.ID != soup.ID {
+		t.Errorf("Expected sauces to resolve to soup, got %+v", label)
+	}
+
+	// Renaming a label to an alias takes the name back
+	lamp, _ := labelByName(ctx, 1, "lamp")
+	if err := updateLabel(ctx, 1, lamp.ID, "sauces", "", "", 0, 0); err != nil {
+		t.Fatalf("updateLabel() returned error: %v", err)
+	}
+	if label, _ := labelByName(ctx, 1, "sauces"); label.ID != lamp.ID {
+		t.Errorf("Expected sauces to be the renamed label, got %+v", label)
+	}
+	if aliases, _ := labelAliases(ctx, 1, soup.ID); !reflect.DeepEqual(aliases, []string{"sauce"}) {
+		t.Errorf("Expected the renamed label to take the alias, got %v", aliases)
+	}
+}
+
+func TestLabelTypes(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+
+	season, err := createLabelType(ctx, 1, LabelType{Name: "Season", Icon: "🍂", DisplayOrder: 9, MultiSelect: true})
+	if err != nil || season.Name != "season" || season.ID == 0 {
+		t.Fatalf("createLabelType() = %+v, %v", season, err)
+	}
+	if _, err := createLabelType(ctx, 1, LabelType{Name: "PROTEIN"}); !errors.Is(err, ErrLabelTypeConflict) {
+		t.Errorf("Expected ErrLabelTypeConflict for a second protein type, got %v", err)
+	}
+	if _, err := createLabelType(ctx, 1, LabelType{}); !errors.Is(err, ErrTypeValidation) {
+		t.Errorf("Expected ErrTypeValidation for a type without a name, got %v", err)
+	}
+
+	// Labels can only take the household's types
+	if err := updateLabel(ctx, 1, 43, "summer", "", "proteins", 0, 0); !errors.Is(err, ErrTypeValidation) {
+		t.Errorf("Expected ErrTypeValidation for an unknown type, got %v", err)
+	}
+	if err := updateLabel(ctx, 1, 43, "summer", "", "Season", 0, 0); err != nil {
+		t.Fatalf("updateLabel() returned error: %v", err)
+	}
+	summer, _ := labelByID(ctx, 1, 43)
+	if summer.TypeID != season.ID || summer.Type != "season" {
+		t.Errorf("Expected summer to be a season, got %+v", summer)
+	}
+
+	// Renaming a type renames it on its labels
+	season.Name = "seasons"
+	if err := updateLabelType(ctx, 1, season, season.Version); err != nil {
+		t.Fatalf("updateLabelType() returned error: %v", err)
+	}
+	if err := updateLabelType(ctx, 1, season, season.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if label, _ := labelByID(ctx, 1, 43); label.Type != "seasons" || label.Version != summer.Version+1 {
+		t.Errorf("Expected summer to be a seasons with a new version, got %+v", label)
+	}
+
+	// Grouped in display order, with untyped labels last
+	groups, err := labelsByType(ctx, 1)
+	if err != nil {
+		t.Fatalf("labelsByType() returned error: %v", err)
+	}
+	if len(groups) != 10 || groups[0].Type.Name != "course" || groups[8].Type.Name != "seasons" || groups[9].Type != nil {
+		t.Fatalf("Expected 9 types from course to seasons and then the untyped labels, got %+v", groups)
+	}
+	if len(groups[8].Labels) != 1 || groups[8].Labels[0].ID != 43 || len(groups[9].Labels) != 2 {
+		t.Errorf("Expected summer to be the only season and 2 labels without a type, got %+v and %+v", groups[8], groups[9])
+	}
+
+	// Deleting a type leaves its labels without one
+	if err := deleteLabelType(ctx, 1, season.ID, 0); err != nil {
+		t.Fatalf("deleteLabelType() returned error: %v", err)
+	}
+	if label, _ := labelByID(ctx, 1, 43); label.TypeID != 0 || label.Type != "" {
+		t.Errorf("Expected summer to have no type, got %+v", label)
+	}
+	if err := deleteLabelType(ctx, 1, season.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows deleting a deleted type, got %v", err)
+	}
+}
+
+func TestLabelParents(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+	fowl, _ := createLabel(ctx, 1, "fowl")
+	poultry, _ := createLabel(ctx, 1, "poultry")
+	setParent := func(labelID int, parentID int) error {
+		label, _ := labelByID(ctx, 1, labelID)
+		return updateLabel(ctx, 1, labelID, label.Label, label.Icon, label.Type, parentID, 0)
+	}
+	parentOf := func(labelID int) int {
+		label, _ := labelByID(ctx, 1, labelID)
+		return label.ParentID
+	}
+
+	// fowl > poultry > chicken (1), turkey (37)
+	for child, parent := range map[int]int{poultry.ID: fowl.ID, 1: poultry.ID, 37: poultry.ID} {
+		if err := setParent(child, parent); err != nil {
+			t.Fatalf("updateLabel() returned error: %v", err)
+		}
+	}
+	labels, _ := allLabels(ctx, 1)
+	family := labelFamily(labels, fowl.ID)
+	sort.Ints(family)
+	if want := []int{1, 37, fowl.ID, poultry.ID}; !reflect.DeepEqual(family, want) {
+		t.Errorf("Expected fowl's family to be %v, got %v", want, family)
+	}
+	for _, parentID := range []int{fowl.ID, 1, 9999} {
+		if err := setParent(fowl.ID, parentID); !errors.Is(err, ErrParentValidation) {
+			t.Errorf("Expected ErrParentValidation making %d fowl's parent, got %v", parentID, err)
+		}
+	}
+
+	// Merging poultry into chicken puts chicken in poultry's place
+	if err := mergeLabel(ctx, 1, poultry.ID, 1, 0); err != nil {
+		t.Fatalf("mergeLabel() returned error: %v", err)
+	}
+	if parentOf(1) != fowl.ID || parentOf(37) != 1 {
+		t.Errorf("Expected fowl > chicken > turkey, got chicken under %d and turkey under %d", parentOf(1), parentOf(37))
+	}
+
+	// Deleting chicken moves turkey up to fowl
+	if err := deleteLabel(ctx, 1, 1, 0); err != nil {
+		t.Fatalf("deleteLabel() returned error: %v", err)
+	}
+	if parentOf(37) != fowl.ID {
+		t.Errorf("Expected turkey to move up to fowl, got %d", parentOf(37))
+	}
+}
+
+func TestDeleteRecipe(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+	count := func(q string, args ...interface{}) int {
+		var n int
+		db.QueryRow(q, args...).Scan(&n)
+		return n
+	}
+
+	// Recipe 1 has a label and two notes
+	if err := deleteRecipe(ctx, 1, 1, 99); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale version, got %v", err)
+	}
+	if err := deleteRecipe(ctx, 2, 1, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows from another household, got %v", err)
+	}
+	if count("SELECT COUNT(*) FROM recipe_label WHERE recipe_id = 1") == 0 || count("SELECT COUNT(*) FROM note WHERE recipe_id = 1") != 2 {
+		t.Fatalf("Expected failed deletes to leave recipe 1's links and notes alone")
+	}
+	if err := deleteRecipe(ctx, 1, 1, 1); err != nil {
+		t.Fatalf("deleteRecipe() returned error: %v", err)
+	}
+	if n := count("SELECT COUNT(*) FROM recipe_label WHERE recipe_id = 1") + count("SELECT COUNT(*) FROM note WHERE recipe_id = 1"); n != 0 {
+		t.Errorf("Expected recipe 1's links and notes to be deleted, %d remain", n)
+	}
+	if err := deleteRecipe(ctx, 1, 1, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows deleting a deleted recipe, got %v", err)
+	}
+
+	// A failure part way through leaves everything as it was
+	db.Exec("ALTER TABLE note RENAME TO note_elsewhere")
+	if err := deleteRecipe(ctx, 1, 4, 0); err == nil {
+		t.Errorf("Expected deleteRecipe() to fail without a note table")
+	}
+	db.Exec("ALTER TABLE note_elsewhere RENAME TO note")
+	if count("SELECT COUNT(*) FROM recipe WHERE recipe_id = 4") != 1 || count("SELECT COUNT(*) FROM note WHERE recipe_id = 4") != 1 {
+		t.Errorf("Expected the failed delete to be rolled back")
+	}
+
+	// The foreign keys cascade on their own
+	db.Exec("DELETE FROM recipe WHERE recipe_id = 2")
+	if n := count("SELECT COUNT(*) FROM recipe_label WHERE recipe_id = 2"); n != 0 {
+		t.Errorf("Expected deleting recipe 2 to cascade to its links, %d remain", n)
+	}
+}
+
+func TestRecordLoginFailure(t *testing.T) {
+	setupIntegrationTest()
+	conf.LoginMaxFailures = 2
+	now := time.Now()
+
+	lockout, err := recordLoginFailure(context.Background(), lockoutScopeUser, "koko", now)
+	if err != nil {
+		t.Fatalf("recordLoginFailure() returned error: %v", err)
+	}
+	if lockout.Failures != 1 || lockout.Locked(now) {
+		t.Errorf("Expected 1 failure and no lockout, got %+v", lockout)
+	}
+
+	recordLoginFailure(context.Background(), lockoutScopeUser, "koko", now)
+	lockout, _ = recordLoginFailure(context.Background(), lockoutScopeUser, "koko", now)
+	if lockout.Failures != 3 || !lockout.Locked(now) {
+		t.Errorf("Expected 3 failures and a lockout, got %+v", lockout)
+	}
+
+	// Failures long in the past are forgotten
+	later := now.Add(2 * loginLockoutMax())
+	lockout, _ = recordLoginFailure(context.Background(), lockoutScopeUser, "koko", later)
+	if lockout.Failures != 1 {
+		t.Errorf("Expected stale failures to reset, got %d", lockout.Failures)
+	}
+
+	stored, _ := lockoutFor(context.Background(), lockoutScopeUser, "koko")
+	if stored.Failures != 1 {
+		t.Errorf("Expected stored failure count 1, got %d", stored.Failures)
+	}
+}
+
 func checkDb(t *testing.T, expectedLabels int, expectedRecipes int, expectedRecipeLabels int) {
 	var (
 		numLabels       int
@@ -529,3 +835,289 @@ func TestLoadLabel(t *testing.T) {
 	}
 }
 ****/
+
+func TestHouseholdScoping(t *testing.T) {
+	setupIntegrationTest()
+
+	household, err := createHousehold(context.Background(), "Cabin", 2)
+	if err != nil {
+		t.Fatalf("createHousehold() returned error: %v", err)
+	}
+	if household.InviteCode == "" {
+		t.Error("Expected new household to have an invite code")
+	}
+
+	recipe, err := createRecipe(context.Background(), household.ID, "Cabin Chili", "Body", 10, 60, false, nil, nil)
+	if err != nil {
+		t.Fatalf("createRecipe() returned error: %v", err)
+	}
+	if _, err := recipeByID(context.Background(), 1, recipe.ID, false); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected recipe to be invisible to household 1, got %v", err)
+	}
+	if err := softDeleteRecipe(context.Background(), 1, recipe.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected another household's recipe to be not found, got %v", err)
+	}
+	fetched, _ := recipeByID(context.Background(), household.ID, recipe.ID, false)
+	if fetched.Deleted {
+		t.Error("Household 1 should not be able to delete another household's recipe")
+	}
+
+	// Changes without a version still can't reach another household's recipe
+	if err := updateRecipe(context.Background(), household.ID, 1, "Mine", "", 0, 0, false, []string{}, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected updating another household's recipe to return ErrNoRows, got %v", err)
+	}
+	if labels, _ := labelsByRecipeID(context.Background(), 1, 1); len(labels) == 0 {
+		t.Error("Updating another household's recipe removed its labels")
+	}
+	if err := setRecipeNewFlag(context.Background(), household.ID, 1, true, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected flagging another household's recipe to return ErrNoRows, got %v", err)
+	}
+	if err := labelRecipe(context.Background(), household.ID, 1, 1, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected labeling another household's recipe to return ErrNoRows, got %v", err)
+	}
+
+	recipes, _ := activeRecipes(context.Background(), household.ID, false)
+	if len(recipes) != 1 {
+		t.Errorf("Expected 1 recipe in new household, got %d", len(recipes))
+	}
+
+	// Label names only need to be unique within a household
+	if _, err := createLabel(context.Background(), household.ID, "chicken"); err != nil {
+		t.Fatalf("createLabel() returned error: %v", err)
+	}
+	home, _ := labelByName(context.Background(), 1, "chicken")
+	cabin, _ := labelByName(context.Background(), household.ID, "chicken")
+	if home.ID == cabin.ID {
+		t.Error("Expected separate chicken labels per household")
+	}
+	if err := deleteLabel(context.Background(), household.ID, home.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected deleting another household's label to return ErrNoRows, got %v", err)
+	}
+
+	member, _ := isHouseholdMember(context.Background(), household.ID, 2)
+	if !member {
+		t.Error("Expected creator to be a member of the new household")
+	}
+	households, _ := householdsForUser(context.Background(), 2)
+	if len(households) != 2 {
+		t.Errorf("Expected user 2 to belong to 2 households, got %d", len(households))
+	}
+}
+
+func TestCopyRecipe(t *testing.T) {
+	setupIntegrationTest()
+
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	createLabel(context.Background(), household.ID, "chicken")
+
+	source, _ := recipeByID(context.Background(), 1, 1, true)
+	copied, err := copyRecipe(context.Background(), 1, 1, household.ID)
+	if err != nil {
+		t.Fatalf("copyRecipe() returned error: %v", err)
+	}
+	if copied.ID == source.ID || copied.HouseholdID != household.ID {
+		t.Errorf("Expected a new recipe in household %d, got %+v", household.ID, copied)
+	}
+	if copied.Title != source.Title || copied.Body != source.Body {
+		t.Error("Copied recipe does not match source")
+	}
+	if len(copied.Labels) != len(source.Labels) {
+		t.Errorf("Expected %d labels on copy, got %d", len(source.Labels), len(copied.Labels))
+	}
+	for _, label := range copied.Labels {
+		if label.HouseholdID != household.ID {
+			t.Errorf("Copied label %q belongs to household %d", label.Label, label.HouseholdID)
+		}
+	}
+
+	// Existing labels are reused rather than duplicated
+	labels, _ := allLabels(context.Background(), household.ID)
+	if len(labels) != len(source.Labels) {
+		t.Errorf("Expected %d labels in target household, got %d", len(source.Labels), len(labels))
+	}
+
+	notes, _ := notesByRecipeID(context.Background(), household.ID, copied.ID)
+	if len(notes) != 0 {
+		t.Errorf("Expected notes not to be copied, got %d", len(notes))
+	}
+
+	if _, err := copyRecipe(context.Background(), household.ID, 1, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected copying another household's recipe to return ErrNoRows, got %v", err)
+	}
+}
+
+func TestVersionConflicts(t *testing.T) {
+	conf = configuration{
+		Debug:     false,
+		DbDialect: "sqlite3",
+		DbDSN:     ":memory:",
+		JwtSecret: "secret",
+	}
+
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+	connect()
+	bootstrap(true)
+
+	recipe, err := createRecipe(context.Background(), 1, "Chili", "Simmer", 20, 90, false, []string{"chili"}, []string{"spicy"})
+	if err != nil {
+		t.Fatalf("Failed to create test recipe: %v", err)
+	}
+	if recipe.Version != 1 {
+		t.Errorf("Expected a new recipe to be version 1, got %d", recipe.Version)
+	}
+
+	// Each update moves the version on, so the old one no longer matches
+	if err := updateRecipe(context.Background(), 1, recipe.ID, "Chili", "Simmer longer", 20, 120, false, nil, recipe.Version); err != nil {
+		t.Fatalf("updateRecipe() at the current version returned error: %v", err)
+	}
+	err = updateRecipe(context.Background(), 1, recipe.ID, "Chili", "Simmer less", 20, 60, false, nil, recipe.Version)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale update, got %v", err)
+	}
+	if err := setRecipeNewFlag(context.Background(), 1, recipe.ID, true, recipe.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict for a stale flag change, got %v", err)
+	}
+	got, _ := recipeByID(context.Background(), 1, recipe.ID, false)
+	if got.Version != 2 || got.Body != "Simmer longer" {
+		t.Errorf("Expected version 2 with the first update's body, got version %d body %q", got.Version, got.Body)
+	}
+
+	// Renaming a label changes every recipe that embeds it
+	label, _ := labelByName(context.Background(), 1, "chili")
+	if err := updateLabel(context.Background(), 1, label.ID, "chilli", "", "", 0, label.Version); err != nil {
+		t.Fatalf("updateLabel() returned error: %v", err)
+	}
+	if after, _ := recipeByID(context.Background(), 1, recipe.ID, false); after.Version != 3 {
+		t.Errorf("Expected relabeled recipe at version 3, got %d", after.Version)
+	}
+	if err := deleteLabel(context.Background(), 1, label.ID, label.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict deleting a stale label, got %v", err)
+	}
+
+	notes, _ := notesByRecipeID(context.Background(), 1, recipe.ID)
+	note := notes[0]
+	if err := setNoteText(context.Background(), 1, note.ID, "very spicy", note.Version); err != nil {
+		t.Fatalf("setNoteText() returned error: %v", err)
+	}
+	if err := deleteNote(context.Background(), 1, note.ID, note.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected ErrVersionConflict deleting a stale note, got %v", err)
+	}
+	if err := deleteNote(context.Background(), 1, note.ID, 0); err != nil {
+		t.Errorf("deleteNote() without a version returned error: %v", err)
+	}
+	// Without a version, a note that's gone is not found rather than a no-op
+	if err := deleteNote(context.Background(), 1, note.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows deleting a missing note, got %v", err)
+	}
+	if err := setNoteFlag(context.Background(), 1, note.ID, true, 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows flagging a missing note, got %v", err)
+	}
+	if err := setNoteText(context.Background(), 1, note.ID, "gone", 0); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows editing a missing note, got %v", err)
+	}
+}
+
+func TestRecipeListLoadsLabelsAndNotes(t *testing.T) {
+	conf = configuration{
+		Debug:     false,
+		DbDialect: "sqlite3",
+		DbDSN:     ":memory:",
+		JwtSecret: "secret",
+	}
+
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+	connect()
+	bootstrap(true)
+	createRecipe(context.Background(), 1, "Noted", "", 1, 1, false, []string{"chicken", "quick"}, []string{"first", "second"})
+
+	// Every recipe at once, and one page, must match loading each recipe alone
+	for _, opts := range []RecipeListOptions{
+		{WantLabels: true, WantNotes: true},
+		{WantLabels: true, WantNotes: true, SortKey: "title", Limit: 5},
+	} {
+		recipes, _, err := recipeList(context.Background(), 1, opts)
+		if err != nil {
+			t.Fatalf("recipeList(%+v) returned error: %v", opts, err)
+		}
+		for _, recipe := range recipes {
+			labels, _ := labelsByRecipeID(context.Background(), 1, recipe.ID)
+			if len(recipe.Labels) != len(labels) {
+				t.Errorf("Recipe %d: expected %d labels, got %d", recipe.ID, len(labels), len(recipe.Labels))
+			}
+			notes, _ := notesByRecipeID(context.Background(), 1, recipe.ID)
+			if !reflect.DeepEqual(recipe.Notes, notes) {
+				t.Errorf("Recipe %d: expected notes %v, got %v", recipe.ID, notes, recipe.Notes)
+			}
+		}
+	}
+
+	// Another household's labels and notes never leak in
+	other, _ := createHousehold(context.Background(), "Other", 1)
+	createRecipe(context.Background(), other.ID, "Theirs", "", 1, 1, false, []string{"secret"}, []string{"private"})
+	recipes, _, _ := recipeList(context.Background(), 1, RecipeListOptions{WantLabels: true, WantNotes: true})
+	for _, recipe := range recipes {
+		for _, label := range recipe.Labels {
+			if label.HouseholdID != 1 {
+				t.Errorf("Recipe %d has another household's label %+v", recipe.ID, label)
+			}
+		}
+		for _, note := range recipe.Notes {
+			if note.HouseholdID != 1 {
+				t.Errorf("Recipe %d has another household's note %+v", recipe.ID, note)
+			}
+		}
+	}
+}
+
+// BenchmarkActiveRecipes lists every recipe in households of growing size.
+// Labels are loaded in one query however many recipes there are, so
+// ns/recipe should stay about the same from one size to the next.
+func BenchmarkActiveRecipes(b *testing.B) {
+	conf = configuration{
+		Debug:     false,
+		DbDialect: "sqlite3",
+		DbDSN:     ":memory:",
+		JwtSecret: "secret",
+	}
+
+	for _, size := range []int{10, 100, 1000, 5000} {
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+		connect()
+		bootstrap(true)
+		household, _ := createHousehold(context.Background(), "Benchmark", 1)
+		tx := db.MustBegin()
+		for i := 0; i < size; i++ {
+			result := tx.MustExec("INSERT INTO recipe (household_id, title, recipe_body, active_time, total_time) VALUES (?, ?, ?, ?, ?)", household.ID, fmt.Sprintf("Recipe %d", i), "body", 10, 20)
+			recipeID, _ := result.LastInsertId()
+			for _, name := range []string{"one", "two", "three"} {
+				labelID, err := findOrCreateLabel(context.Background(), tx.Tx, household.ID, Label{Label: name})
+				if err != nil {
+					b.Fatal(err)
+				}
+				tx.MustExec("INSERT INTO recipe_label (recipe_id, label_id) VALUES (?, ?)", recipeID, labelID)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("recipes=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				recipes, err := activeRecipes(context.Background(), household.ID, true)
+				if err != nil || len(recipes) != size {
+					b.Fatalf("activeRecipes() returned %d recipes, error %v", len(recipes), err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/recipe")
+		})
+	}
+}
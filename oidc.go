@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OpenID Connect authorization-code login. The flow is:
+//
+//  1. GET /login/oidc/ redirects the browser to the identity provider with a
+//     random state and nonce, which are also stored in a short-lived signed
+//     cookie.
+//  2. The provider redirects back to GET /login/oidc/callback with a code.
+//     We check the state against the cookie, exchange the code for an ID
+//     token, verify the token's signature against the provider's JWKS and
+//     check its issuer, audience, expiry and nonce.
+//  3. The (issuer, subject) pair is mapped to a local user through the
+//     user_identity table, provisioning a user on first login if the
+//     configuration allows, and the same JWT /login/ returns is issued.
+//
+// An identity is only ever linked to an existing local user by that user:
+// POST /priv/me/oidc/link starts the same flow with the caller's ID in the
+// state cookie, and the callback links whichever identity comes back.
+
+const (
+	oidcCookieName    = "gorecipes_oidc"
+	oidcCookieTTL     = 10 * time.Minute
+	oidcStateAudience = "gorecipes-oidc-state"
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProvider - the parts of the provider's discovery document we use
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcStateClaims - contents of the cookie that ties a callback to the
+// browser that started the login
+type oidcStateClaims struct {
+	State      string `json:"state"`
+	Nonce      string `json:"nonce"`
+	LinkUserID int    `json:"link_user_id,omitempty"` // set when a logged-in user is linking an identity
+	jwt.RegisteredClaims
+}
+
+// oidcIDClaims - the ID token claims we care about
+type oidcIDClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+var oidcCache struct {
+	sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+}
+
+func oidcEnabled() bool {
+	return conf.OIDCIssuer != "" && conf.OIDCClientID != ""
+}
+
+// resetOIDCCache forgets the discovery document and signing keys, e.g.
+// after the issuer changes
+func resetOIDCCache() {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	oidcCache.provider = nil
+	oidcCache.keys = nil
+}
+
+/* HANDLERS */
+func oidcLogin(w http.ResponseWriter, r *http.Request) *appError {
+	location, appErr := oidcStart(w, 0)
+	if appErr != nil {
+		return appErr
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+	return nil
+}
+
+// linkOIDCIdentity starts a login at the identity provider for the caller,
+// whose local account the identity is linked to when it comes back. Since
+// it's called with a token rather than navigated to, it answers with the
+// provider's URL instead of redirecting there.
+func linkOIDCIdentity(w http.ResponseWriter, r *http.Request) *appError {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+	if claims.APIKeyID != 0 {
+		return &appError{http.StatusForbidden, "API keys cannot link identities; log in instead", nil, "api_key_not_allowed"}
+	}
+	location, appErr := oidcStart(w, claims.UserID)
+	if appErr != nil {
+		return appErr
+	}
+	json.NewEncoder(w).Encode(map[string]string{"url": location})
+	return nil
+}
+
+// oidcStart sets the state cookie for a new login and returns the provider
+// URL to send the browser to. linkUserID is the local user to link the
+// identity to, or 0 for an ordinary login.
+func oidcStart(w http.ResponseWriter, linkUserID int) (string, *appError) {
+	if !oidcEnabled() {
+		return "", &appError{http.StatusNotFound, "OIDC login is not configured", nil, "oidc_disabled"}
+	}
+	provider, err := oidcDiscover()
+	if err != nil {
+		return "", &appError{http.StatusBadGateway, "could not reach identity provider", err, "identity_provider_error"}
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", &appError{http.StatusInternalServerError, "problem starting login", err, "internal_error"}
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", &appError{http.StatusInternalServerError, "problem starting login", err, "internal_error"}
+	}
+
+	cookie := &oidcStateClaims{
+		State:      state,
+		Nonce:      nonce,
+		LinkUserID: linkUserID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{oidcStateAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oidcCookieTTL)),
+		},
+	}
+	cookieValue, err := jwt.NewWithClaims(jwt.SigningMethodHS256, cookie).SignedString(oidcStateKey())
+	if err != nil {
+		return "", &appError{http.StatusInternalServerError, "problem starting login", err, "internal_error"}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    cookieValue,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(conf.OIDCRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", conf.OIDCClientID)
+	params.Set("redirect_uri", conf.OIDCRedirectURL)
+	params.Set("scope", "openid profile email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return provider.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request) *appError {
+	if !oidcEnabled() {
+		return &appError{http.StatusNotFound, "OIDC login is not configured", nil, "oidc_disabled"}
+	}
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		msg := fmt.Sprintf("identity provider refused login: %s", providerErr)
+		countLogin("oidc", "failure")
+		return &appError{http.StatusForbidden, msg, nil, "identity_provider_refused"}
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		countLogin("oidc", "failure")
+		return &appError{http.StatusBadRequest, "missing or expired login state; start again", err, "invalid_login_state"}
+	}
+	// The state cookie is single-use
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/login/oidc", MaxAge: -1})
+
+	stateClaims := &oidcStateClaims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, stateClaims, func(token *jwt.Token) (interface{}, error) {
+		return oidcStateKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(oidcStateAudience))
+	if err != nil {
+		countLogin("oidc", "failure")
+		return &appError{http.StatusBadRequest, "missing or expired login state; start again", err, "invalid_login_state"}
+	}
+	if r.FormValue("state") == "" || r.FormValue("state") != stateClaims.State {
+		countLogin("oidc", "failure")
+		return &appError{http.StatusBadRequest, "login state mismatch", nil, "invalid_login_state"}
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		countLogin("oidc", "failure")
+		return &appError{http.StatusBadRequest, "missing authorization code", nil, "invalid_login_state"}
+	}
+
+	// An unreachable or misbehaving provider is a server error rather than
+	// a failed login, so it isn't counted
+	rawIDToken, err := oidcExchangeCode(code)
+	if err != nil {
+		return &appError{http.StatusBadGateway, "could not exchange authorization code", err, "identity_provider_error"}
+	}
+	idClaims, err := oidcVerifyIDToken(rawIDToken, stateClaims.Nonce)
+	if err != nil {
+		countLogin("oidc", "failure")
+		return &appError{http.StatusForbidden, "invalid ID token", err, "invalid_id_token"}
+	}
+
+	user, appErr := oidcLocalUser(r.Context(), idClaims, stateClaims.LinkUserID)
+	if appErr != nil {
+		if appErr.Code == http.StatusForbidden || appErr.Code == http.StatusConflict {
+			countLogin("oidc", "failure")
+		}
+		return appErr
+	}
+	householdID, role, appErr := loginHousehold(r.Context(), user, nil)
+	if appErr != nil {
+		return appErr
+	}
+
+	tokenStr, err := jwtGenerate(user.ID, role, householdID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "could not sign token", err, "internal_error"}
+	}
+	countLogin("oidc", "success")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokenStr})
+	return nil
+}
+
+// oidcLocalUser finds the local user an identity maps to. When a logged-in
+// user started the login (linkUserID), an unknown identity is linked to them;
+// otherwise a new user is created for it (OIDCAutoProvision). Identities are
+// never matched to existing users by name or email, which the provider's
+// users may be able to choose.
+func oidcLocalUser(ctx context.Context, claims *oidcIDClaims, linkUserID int) (User, *appError) {
+	issuer := claims.Issuer
+	subject := claims.Subject
+	user, err := userByIdentity(ctx, issuer, subject)
+	if err == nil {
+		if linkUserID != 0 && user.ID != linkUserID {
+			return User{}, &appError{http.StatusConflict, "this identity is already linked to another user", nil, "identity_taken"}
+		}
+		return user, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+
+	if linkUserID != 0 {
+		if err := linkIdentity(ctx, issuer, subject, linkUserID); err != nil {
+			return User{}, &appError{http.StatusInternalServerError, "problem linking identity", err, "internal_error"}
+		}
+		user, err := userByID(ctx, linkUserID)
+		if err != nil {
+			return User{}, &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+		}
+		return user, nil
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+	if username == "" {
+		username = subject
+	}
+
+	if _, err := userByName(ctx, username); err == nil {
+		return User{}, &appError{http.StatusConflict, "a local user with that username already exists; log in as them and link this identity", nil, "username_taken"}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+
+	if !conf.OIDCAutoProvision {
+		return User{}, &appError{http.StatusForbidden, "no local account for this identity", nil, "unknown_identity"}
+	}
+	user, err = createIdentityUser(ctx, issuer, subject, username, oidcDefaultRole(), defaultHouseholdID)
+	if err != nil {
+		return User{}, &appError{http.StatusInternalServerError, "problem creating user", err, "internal_error"}
+	}
+	return user, nil
+}
+
+// oidcStateKey signs the state cookie. It's derived from the JWT secret so
+// there's nothing else to configure, but differs from it so the cookie can't
+// be replayed as a session token.
+func oidcStateKey() []byte {
+	mac := hmac.New(sha256.New, []byte(conf.JwtSecret))
+	mac.Write([]byte(oidcStateAudience))
+	return mac.Sum(nil)
+}
+
+func oidcDefaultRole() Role {
+	if conf.OIDCDefaultRole == "" {
+		return RoleViewer
+	}
+	return Role(strings.ToLower(conf.OIDCDefaultRole))
+}
+
+/* PROVIDER */
+
+// oidcDiscover fetches (and caches) the issuer's discovery document
+func oidcDiscover() (*oidcProvider, error) {
+	oidcCache.Lock()
+	defer oidcCache.Unlock()
+	if oidcCache.provider != nil {
+		return oidcCache.provider, nil
+	}
+
+	wellKnown := strings.TrimSuffix(conf.OIDCIssuer, "/") + "/.well-known/openid-configuration"
+	provider := &oidcProvider{}
+	if err := oidcGetJSON(wellKnown, provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != conf.OIDCIssuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match configured issuer %q", provider.Issuer, conf.OIDCIssuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+	oidcCache.provider = provider
+	return provider, nil
+}
+
+// oidcExchangeCode trades an authorization code for the raw ID token
+func oidcExchangeCode(code string) (string, error) {
+	provider, err := oidcDiscover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", conf.OIDCRedirectURL)
+	form.Set("client_id", conf.OIDCClientID)
+	form.Set("client_secret", conf.OIDCClientSecret)
+	resp, err := oidcHTTPClient.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response did not include an id_token")
+	}
+	return body.IDToken, nil
+}
+
+// oidcVerifyIDToken checks an ID token's signature, issuer, audience,
+// expiry and nonce
+func oidcVerifyIDToken(rawIDToken string, nonce string) (*oidcIDClaims, error) {
+	claims := &oidcIDClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, oidcSigningKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(conf.OIDCIssuer),
+		jwt.WithAudience(conf.OIDCClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcSigningKey returns the provider key a token was signed with, refetching
+// the JWKS once if the key ID is unknown (the provider may have rotated keys)
+func oidcSigningKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	oidcCache.Lock()
+	key, ok := oidcCache.keys[kid]
+	oidcCache.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	provider, err := oidcDiscover()
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(provider.JwksURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus for key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("bad exponent for key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	oidcCache.Lock()
+	oidcCache.keys = keys
+	oidcCache.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key with id %q", kid)
+}
+
+func oidcGetJSON(url string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, JWKS and a token
+// endpoint that hands back an ID token built from its fields
+type mockIssuer struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	kid      string
+	subject  string
+	username string
+	nonce    string
+	audience string
+	signWith *rsa.PrivateKey // sign with a different key than published
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	m := &mockIssuer{key: key, kid: "test-key", subject: "sub-123", username: "newcook", audience: "gorecipes"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": m.kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("client_secret") != "shh" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		claims := &oidcIDClaims{
+			Nonce:             m.nonce,
+			PreferredUsername: m.username,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    m.server.URL,
+				Subject:   m.subject,
+				Audience:  jwt.ClaimStrings{m.audience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = m.kid
+		signer := m.key
+		if m.signWith != nil {
+			signer = m.signWith
+		}
+		idToken, _ := token.SignedString(signer)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "id_token": idToken})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func setupOIDCTest(t *testing.T) *mockIssuer {
+	setupIntegrationTest()
+	m := newMockIssuer(t)
+	conf.OIDCIssuer = m.server.URL
+	conf.OIDCClientID = "gorecipes"
+	conf.OIDCClientSecret = "shh"
+	conf.OIDCRedirectURL = "http://localhost:8080/login/oidc/callback"
+	resetOIDCCache()
+	t.Cleanup(resetOIDCCache)
+	return m
+}
+
+// startOIDCLogin runs the first leg of the flow and returns the state cookie
+// and the parameters sent to the provider
+func startOIDCLogin(t *testing.T) (*http.Cookie, url.Values) {
+	rr := httptest.NewRecorder()
+	if appErr := oidcLogin(rr, httptest.NewRequest("GET", "/login/oidc/", nil)); appErr != nil {
+		t.Fatalf("oidcLogin() returned appError: %v", appErr)
+	}
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Expected redirect, got %d", rr.Code)
+	}
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("bad redirect location: %v", err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName {
+		t.Fatalf("Expected state cookie, got %v", cookies)
+	}
+	return cookies[0], location.Query()
+}
+
+func finishOIDCLogin(cookie *http.Cookie, state string, code string) (*httptest.ResponseRecorder, *appError) {
+	req := httptest.NewRequest("GET", "/login/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	return rr, oidcCallback(rr, req)
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	m := setupOIDCTest(t)
+	conf.OIDCAutoProvision = true
+
+	cookie, params := startOIDCLogin(t)
+	if params.Get("client_id") != "gorecipes" || params.Get("redirect_uri") != conf.OIDCRedirectURL {
+		t.Errorf("Unexpected authorization parameters: %v", params)
+	}
+	m.nonce = params.Get("nonce")
+
+	rr, appErr := finishOIDCLogin(cookie, params.Get("state"), "good-code")
+	if appErr != nil {
+		t.Fatalf("oidcCallback() returned appError: %v", appErr)
+	}
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	claims, err := jwtExtractClaims(body["token"])
+	if err != nil {
+		t.Fatalf("oidcCallback() returned invalid token: %v", err)
+	}
+	if claims.Role != RoleViewer || claims.HouseholdID != 1 {
+		t.Errorf("Expected viewer in household 1, got %+v", claims)
+	}
+	user, _ := userByID(context.Background(), claims.UserID)
+	if user.Username != "newcook" {
+		t.Errorf("Expected provisioned user newcook, got %q", user.Username)
+	}
+
+	// Logging in again maps to the same user
+	cookie, params = startOIDCLogin(t)
+	m.nonce = params.Get("nonce")
+	rr, appErr = finishOIDCLogin(cookie, params.Get("state"), "good-code")
+	if appErr != nil {
+		t.Fatalf("second oidcCallback() returned appError: %v", appErr)
+	}
+	json.NewDecoder(rr.Body).Decode(&body)
+	again, _ := jwtExtractClaims(body["token"])
+	if again.UserID != claims.UserID {
+		t.Errorf("Expected same user on second login, got %d and %d", claims.UserID, again.UserID)
+	}
+
+	// The provisioned user has no local password
+	if _, appErr := attemptLogin("newcook", "", "192.0.2.1:1234"); appErr == nil {
+		t.Error("Expected password login to fail for an OIDC-only user")
+	}
+}
+
+func TestOIDCLoginUnknownIdentity(t *testing.T) {
+	m := setupOIDCTest(t)
+
+	cookie, params := startOIDCLogin(t)
+	m.nonce = params.Get("nonce")
+	_, appErr := finishOIDCLogin(cookie, params.Get("state"), "good-code")
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without auto-provisioning, got %v", appErr)
+	}
+
+	// An existing username is never linked automatically, even with
+	// auto-provisioning on
+	conf.OIDCAutoProvision = true
+	m.username = "koko"
+	cookie, params = startOIDCLogin(t)
+	m.nonce = params.Get("nonce")
+	_, appErr = finishOIDCLogin(cookie, params.Get("state"), "good-code")
+	if appErr == nil || appErr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for unlinked existing username, got %v", appErr)
+	}
+	if _, err := userByIdentity(context.Background(), m.server.URL, m.subject); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected the identity to stay unlinked, got %v", err)
+	}
+}
+
+// startOIDCLink runs the first leg of the flow as a logged-in user linking
+// an identity, returning the state cookie and the parameters for the provider
+func startOIDCLink(t *testing.T, claims *CustomClaims) (*http.Cookie, url.Values) {
+	rr := httptest.NewRecorder()
+	if appErr := linkOIDCIdentity(rr, withClaims(httptest.NewRequest("POST", "/priv/me/oidc/link", nil), claims)); appErr != nil {
+		t.Fatalf("linkOIDCIdentity() returned appError: %v", appErr)
+	}
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	location, err := url.Parse(body["url"])
+	if err != nil || location.Host == "" {
+		t.Fatalf("bad provider URL %q: %v", body["url"], err)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcCookieName {
+		t.Fatalf("Expected state cookie, got %v", cookies)
+	}
+	return cookies[0], location.Query()
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	m := setupOIDCTest(t)
+	m.username = "koko"
+
+	cookie, params := startOIDCLink(t, &CustomClaims{UserID: 2, Role: RoleContributor, HouseholdID: 1})
+	m.nonce = params.Get("nonce")
+	rr, appErr := finishOIDCLogin(cookie, params.Get("state"), "good-code")
+	if appErr != nil {
+		t.Fatalf("oidcCallback() returned appError: %v", appErr)
+	}
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	claims, _ := jwtExtractClaims(body["token"])
+	if claims == nil || claims.UserID != 2 || claims.Role != RoleContributor {
+		t.Errorf("Expected to log in as koko, got %+v", claims)
+	}
+	if user, err := userByIdentity(context.Background(), m.server.URL, m.subject); err != nil || user.ID != 2 {
+		t.Errorf("Expected identity to be linked to user 2, got %v, %v", user.ID, err)
+	}
+
+	// Later logins find the linked user without linking again
+	cookie, params = startOIDCLogin(t)
+	m.nonce = params.Get("nonce")
+	if _, appErr := finishOIDCLogin(cookie, params.Get("state"), "good-code"); appErr != nil {
+		t.Errorf("Expected the linked identity to log in, got %v", appErr)
+	}
+
+	// Nobody else can claim it
+	cookie, params = startOIDCLink(t, &CustomClaims{UserID: 3, Role: RoleViewer, HouseholdID: 1})
+	m.nonce = params.Get("nonce")
+	if _, appErr := finishOIDCLogin(cookie, params.Get("state"), "good-code"); appErr == nil || appErr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 linking an identity linked to someone else, got %v", appErr)
+	}
+
+	req := withClaims(httptest.NewRequest("POST", "/priv/me/oidc/link", nil), &CustomClaims{UserID: 2, APIKeyID: 1})
+	if appErr := linkOIDCIdentity(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("Expected API keys to be refused, got %v", appErr)
+	}
+}
+
+func TestOIDCStateCookieIsNotASessionToken(t *testing.T) {
+	setupOIDCTest(t)
+
+	cookie, _ := startOIDCLogin(t)
+	if claims, err := jwtExtractClaims(cookie.Value); err == nil {
+		t.Errorf("Expected the state cookie to be rejected as a session token, got %+v", claims)
+	}
+}
+
+func TestOIDCCallbackRejectsBadResponses(t *testing.T) {
+	m := setupOIDCTest(t)
+	conf.OIDCAutoProvision = true
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name     string
+		setup    func(params url.Values) (cookie bool, state string, code string)
+		wantCode int
+		counted  bool // as a failed login in /metrics
+	}{
+		{"missing cookie", func(p url.Values) (bool, string, string) {
+			return false, p.Get("state"), "good-code"
+		}, http.StatusBadRequest, true},
+		{"state mismatch", func(p url.Values) (bool, string, string) {
+			return true, "forged", "good-code"
+		}, http.StatusBadRequest, true},
+		{"missing code", func(p url.Values) (bool, string, string) {
+			return true, p.Get("state"), ""
+		}, http.StatusBadRequest, true},
+		{"bad code", func(p url.Values) (bool, string, string) {
+			return true, p.Get("state"), "bad-code"
+		}, http.StatusBadGateway, false},
+		{"nonce mismatch", func(p url.Values) (bool, string, string) {
+			m.nonce = "replayed"
+			return true, p.Get("state"), "good-code"
+		}, http.StatusForbidden, true},
+		{"wrong audience", func(p url.Values) (bool, string, string) {
+			m.audience = "someone-else"
+			return true, p.Get("state"), "good-code"
+		}, http.StatusForbidden, true},
+		{"bad signature", func(p url.Values) (bool, string, string) {
+			m.signWith = otherKey
+			return true, p.Get("state"), "good-code"
+		}, http.StatusForbidden, true},
+	}
+	failures := func() uint64 {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.logins[metricLabels("method", "oidc", "result", "failure")]
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookie, params := startOIDCLogin(t)
+			m.nonce, m.audience, m.signWith = params.Get("nonce"), "gorecipes", nil
+			sendCookie, state, code := tt.setup(params)
+			if !sendCookie {
+				cookie = nil
+			}
+			before := failures()
+			_, appErr := finishOIDCLogin(cookie, state, code)
+			if appErr == nil || appErr.Code != tt.wantCode {
+				t.Errorf("Expected %d, got %v", tt.wantCode, appErr)
+			}
+			if counted := failures() > before; counted != tt.counted {
+				t.Errorf("Expected failed login to be counted: %v, was: %v", tt.counted, counted)
+			}
+		})
+	}
+}
+
+func TestOIDCNotConfigured(t *testing.T) {
+	setupIntegrationTest()
+	appErr := oidcLogin(httptest.NewRecorder(), httptest.NewRequest("GET", "/login/oidc/", nil))
+	if appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when OIDC is not configured, got %v", appErr)
+	}
+}
@@ -1,91 +1,180 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 )
 
+type contextKey int
+
+const (
+	claimsContextKey contextKey = iota
+	requestInfoContextKey
+)
+
+// claimsFromContext returns the token claims stored by authRequired, or nil
+// if the request did not pass through it
+func claimsFromContext(ctx context.Context) *CustomClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*CustomClaims)
+	return claims
+}
+
+// sessionClaims returns the caller's claims, refusing requests authenticated
+// with an API key. Keys can't mint or revoke other keys, change their
+// owner's account or households, or be exchanged for a login token, so a
+// leaked read-only key can't escalate itself.
+func sessionClaims(r *http.Request) (*CustomClaims, *appError) {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return nil, &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+	if claims.APIKeyID != 0 {
+		return nil, &appError{http.StatusForbidden, "API keys cannot change accounts, keys or households; log in instead", nil, "api_key_not_allowed"}
+	}
+	return claims, nil
+}
+
+// householdFor returns the household a request is scoped to: the one in the
+// caller's token, or the default household for anonymous (public) requests
+func householdFor(r *http.Request) int {
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		return claims.EffectiveHouseholdID()
+	}
+	return defaultHouseholdID
+}
+
+// audit records a change made through an /admin route. Failures are logged
+// rather than returned since the change itself has already been made, and
+// the client hanging up doesn't stop the record being written.
+func audit(r *http.Request, action string, entityType string, entityID int, before interface{}, after interface{}) {
+	actorID := 0
+	if claims := claimsFromContext(r.Context()); claims != nil {
+		actorID = claims.UserID
+	}
+	if err := recordAudit(context.WithoutCancel(r.Context()), householdFor(r), actorID, action, entityType, entityID, before, after); err != nil {
+		requestLog(r).Error("could not record change in audit log", "action", action, "error", err)
+	}
+}
+
+// authenticate validates the request's auth token and returns its claims.
+// The token normally comes from the x-access-token header, but scripts can
+// also send "Authorization: Bearer <token>", where the token is either a
+// JWT or an API key.
+func authenticate(r *http.Request) (*CustomClaims, *appError) {
+	var header = r.Header.Get("x-access-token")
+	tokenString := strings.TrimSpace(header)
+	if tokenString == "" {
+		auth := r.Header.Get("Authorization")
+		if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			tokenString = strings.TrimSpace(auth[len("Bearer "):])
+		}
+	}
+	if tokenString == "" {
+		return nil, &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return authenticateAPIKey(r.Context(), tokenString)
+	}
+
+	claims, err := jwtExtractClaims(tokenString)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, &appError{http.StatusUnauthorized, "auth token expired; please log in again", err, "token_expired"}
+		}
+		return nil, &appError{http.StatusBadRequest, "invalid auth token", err, "invalid_token"}
+	}
+	return claims, nil
+}
+
+// authenticateAPIKey looks up an API key and builds claims for its owner. A
+// read-scoped key only ever acts as a viewer; an admin-scoped key carries
+// the owner's current role in the key's household. Keys stop working once
+// their owner leaves that household.
+func authenticateAPIKey(ctx context.Context, key string) (*CustomClaims, *appError) {
+	apiKey, err := apiKeyByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &appError{http.StatusUnauthorized, "invalid API key", err, "invalid_api_key"}
+		}
+		return nil, &appError{http.StatusInternalServerError, "problem checking API key", err, "internal_error"}
+	}
+
+	now := time.Now()
+	if apiKey.Expired(now) {
+		return nil, &appError{http.StatusUnauthorized, "API key expired", nil, "api_key_expired"}
+	}
+
+	user, err := householdUser(ctx, apiKey.HouseholdID, apiKey.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &appError{http.StatusUnauthorized, "invalid API key", err, "invalid_api_key"}
+		}
+		return nil, &appError{http.StatusInternalServerError, "problem checking API key", err, "internal_error"}
+	}
+
+	role := RoleViewer
+	if apiKey.Scope == apiKeyScopeAdmin {
+		role = user.Role
+	}
+	if err := touchAPIKey(ctx, apiKey.ID, now); err != nil {
+		slog.Warn("could not record use of API key", "key_id", apiKey.ID, "error", err)
+	}
+
+	return &CustomClaims{UserID: user.ID, Role: role, HouseholdID: apiKey.HouseholdID, APIKeyID: apiKey.ID}, nil
+}
+
+// Permission Middleware. Authenticates the request (unless an outer
+// middleware already has) and rejects it unless the caller's role grants
+// the given permission.
+func requirePermission(perm Permission) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFromContext(r.Context())
+			if claims == nil {
+				var authErr *appError
+				claims, authErr = authenticate(r)
+				if authErr != nil {
+					writeError(w, r, authErr)
+					logAppError(r, authErr)
+					return
+				}
+				r = r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+				noteCaller(r, claims)
+			}
+
+			if !claims.EffectiveRole().Can(perm) {
+				msg := fmt.Sprintf("%s access required", perm.minimumRole())
+				appErr := &appError{http.StatusForbidden, msg, nil, "insufficient_role"}
+				writeError(w, r, appErr)
+				logAppError(r, appErr)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Authentication Middleware. Paths under this router require valid
 // authentication to access
 func authRequired(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var header = r.Header.Get("x-access-token")
-		tokenString := strings.TrimSpace(header)
-		if tokenString == "" {
-			msg := "missing auth token"
-			code := http.StatusUnauthorized
-			http.Error(w, msg, code)
-			fmt.Printf("%d: %v\n", code, msg)
-			return
-		}
-
-		_, err := jwtExtractClaims(tokenString)
-		if err != nil {
-			var msg string
-			var code int
-			if errors.Is(err, jwt.ErrTokenExpired) {
-				msg = "auth token expired; please log in again"
-				code = http.StatusUnauthorized
-			} else {
-				msg = "invalid auth token"
-				code = http.StatusBadRequest
-			}
-			http.Error(w, msg, code)
-			fmt.Printf("%d: %v\n", code, msg)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+	return requirePermission(PermRead)(next)
 }
 
 // Admin Middleware. Paths under this router require valid authentication
 // AND admin privileges to access
 func adminRequired(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var header = r.Header.Get("x-access-token")
-		tokenString := strings.TrimSpace(header)
-		if tokenString == "" {
-			msg := "missing auth token"
-			code := http.StatusUnauthorized
-			http.Error(w, msg, code)
-			fmt.Printf("%d: %v\n", code, msg)
-			return
-		}
-
-		claims, err := jwtExtractClaims(tokenString)
-		if err != nil {
-			var msg string
-			var code int
-			if errors.Is(err, jwt.ErrTokenExpired) {
-				msg = "auth token expired; please log in again"
-				code = http.StatusUnauthorized
-			} else {
-				msg = "invalid auth token"
-				code = http.StatusBadRequest
-			}
-			http.Error(w, msg, code)
-			fmt.Printf("%d: %v\n", code, msg)
-			return
-		}
-
-		if !claims.IsAdmin {
-			msg := "admin access required"
-			code := http.StatusForbidden
-			http.Error(w, msg, code)
-			fmt.Printf("%d: %v\n", code, msg)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
+	return requirePermission(PermAdmin)(next)
 }
 
 //TODO: How can I do something like python decorators to wrap certain methods
@@ -93,88 +182,515 @@ func adminRequired(next http.Handler) http.Handler {
 
 /* GET */
 func getAllRecipes(w http.ResponseWriter, r *http.Request) *appError {
-	recipes, err := activeRecipes(true)
+	listing, appErr := parseRecipeListing(r, true)
+	if appErr != nil {
+		return appErr
+	}
+	recipes, more, err := recipeList(r.Context(), householdFor(r), listing.opts)
 
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "Problem loading recipes", err}
+		return &appError{http.StatusInternalServerError, "Problem loading recipes", err, "internal_error"}
 	}
-	json.NewEncoder(w).Encode(recipes)
+	writeRecipeListing(w, r, listing, recipes, more)
 	return nil
 }
 
 func getRecipeByID(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 
-	if recipe, err := recipeByID(recipeID, true); err != nil {
+	if recipe, err := recipeByID(r.Context(), householdFor(r), recipeID, true); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "No recipe with id=%v exists", recipeID)
-			return nil
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
 		} else {
-			return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+			return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 		}
 	} else {
-		json.NewEncoder(w).Encode(recipe)
+		writeJSONWithETag(w, r, versionETag(recipe.Version), recipe)
 	}
 	return nil
 }
 
+// TrashedRecipe is a recipe in the trash and when it will be purged (0 if
+// it was deleted before deletions were dated, so never)
+type TrashedRecipe struct {
+	Recipe
+	PurgeAt int64
+}
+
+// getTrash lists the household's deleted recipes, most recently deleted first
+func getTrash(w http.ResponseWriter, r *http.Request) *appError {
+	recipes, err := trashedRecipes(r.Context(), householdFor(r))
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "Problem loading trash", err, "internal_error"}
+	}
+	trash := make([]TrashedRecipe, len(recipes))
+	for i, recipe := range recipes {
+		trash[i] = TrashedRecipe{recipe, purgeAt(recipe.DeletedAt)}
+	}
+	writeJSONWithETag(w, r, "", trash)
+	return nil
+}
+
 func getNotesForRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
-	if notes, err := notesByRecipeID(recipeID); err != nil {
+	if notes, err := notesByRecipeID(r.Context(), householdFor(r), recipeID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "No notes for recipe with id=%v exists", recipeID)
-			return nil
+			msg := fmt.Sprintf("No notes for recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
 		} else {
-			return &appError{http.StatusInternalServerError, "Problem loading notes", err}
+			return &appError{http.StatusInternalServerError, "Problem loading notes", err, "internal_error"}
 		}
 	} else {
-		json.NewEncoder(w).Encode(notes)
+		writeJSONWithETag(w, r, "", notes)
 		return nil
 	}
 }
 
+func getCurrentUser(w http.ResponseWriter, r *http.Request) *appError {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+
+	user, err := householdUser(r.Context(), householdFor(r), claims.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "user does not exist", err, "user_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(user)
+	return nil
+}
+
+func getUsers(w http.ResponseWriter, r *http.Request) *appError {
+	users, err := allUsers(r.Context(), householdFor(r))
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading users", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(users)
+	return nil
+}
+
+// isOperator reports whether the caller is one of the deployment's
+// Operators, who look after things that belong to no household
+func isOperator(r *http.Request) (bool, *appError) {
+	claims := claimsFromContext(r.Context())
+	if claims == nil || len(conf.Operators) == 0 {
+		return false, nil
+	}
+	user, err := userByID(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+	for _, username := range conf.Operators {
+		if strings.EqualFold(username, user.Username) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getLockouts lists the username lockouts of the household's members, or
+// every lockout, IPs included, for operators
+func getLockouts(w http.ResponseWriter, r *http.Request) *appError {
+	operator, appErr := isOperator(r)
+	if appErr != nil {
+		return appErr
+	}
+	var lockouts []Lockout
+	var err error
+	if operator {
+		lockouts, err = allLockouts(r.Context())
+	} else {
+		lockouts, err = memberLockouts(r.Context(), householdFor(r))
+	}
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading lockouts", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(lockouts)
+	return nil
+}
+
+// getAuditLog returns a page of the caller's household's audit log, newest
+// first. Filters: user (actor ID), entity (type), entity_id, action, since
+// and until (dates); paging: page (from 1) and per_page.
+func getAuditLog(w http.ResponseWriter, r *http.Request) *appError {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		HouseholdID: householdFor(r),
+		EntityType:  query.Get("entity"),
+		Action:      query.Get("action"),
+		Limit:       defaultAuditPageSize,
+	}
+
+	if v := query.Get("user"); v != "" {
+		actorID, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidField("user", "user must be an integer")
+		}
+		filter.ActorID = &actorID
+	}
+	if v := query.Get("entity_id"); v != "" {
+		entityID, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidField("entity_id", "entity_id must be an integer")
+		}
+		filter.EntityID = entityID
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := parseDateParam(v, false)
+		if err != nil {
+			return invalidField("since", "since: "+err.Error())
+		}
+		filter.Since = since
+	}
+	if v := query.Get("until"); v != "" {
+		until, err := parseDateParam(v, true)
+		if err != nil {
+			return invalidField("until", "until: "+err.Error())
+		}
+		filter.Until = until
+	}
+	if v := query.Get("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxAuditPageSize {
+			msg := fmt.Sprintf("per_page must be an integer between 1 and %d", maxAuditPageSize)
+			return invalidField("per_page", msg)
+		}
+		filter.Limit = perPage
+	}
+	page := 1
+	if v := query.Get("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return invalidField("page", "page must be a positive integer")
+		}
+	}
+	filter.Offset = (page - 1) * filter.Limit
+
+	entries, total, err := auditEntries(r.Context(), filter)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading audit log", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Entries": entries,
+		"Total":   total,
+		"Page":    page,
+		"PerPage": filter.Limit,
+	})
+	return nil
+}
+
+func getHouseholds(w http.ResponseWriter, r *http.Request) *appError {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+
+	households, err := householdsForUser(r.Context(), claims.UserID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading households", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(households)
+	return nil
+}
+
+func getAPIKeys(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	keys, err := apiKeysForUser(r.Context(), claims.UserID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading API keys", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(keys)
+	return nil
+}
+
+func getHouseholdInvite(w http.ResponseWriter, r *http.Request) *appError {
+	household, err := householdByID(r.Context(), householdFor(r))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "household does not exist", err, "household_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading household", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(household)
+	return nil
+}
+
 /* UPDATE */
+func changePassword(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	user, err := userByID(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "user does not exist", err, "user_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+
+	var req passwordRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	newPassword := stringValue(req.NewPassword)
+	if err := user.CheckPassword(stringValue(req.CurrentPassword)); err != nil {
+		return &appError{http.StatusForbidden, "current password is incorrect", err, "incorrect_password"}
+	}
+	if err := validatePassword(newPassword); err != nil {
+		return invalidField("newPassword", err.Error())
+	}
+
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem hashing password", err, "internal_error"}
+	}
+	if err := setUserPassword(r.Context(), user.ID, hash); err != nil {
+		return &appError{http.StatusInternalServerError, "problem updating password", err, "internal_error"}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func editUserRole(w http.ResponseWriter, r *http.Request) *appError {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "user ID must be an integer", err, "invalid_id"}
+	}
+	var req roleRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	role := Role(strings.ToLower(stringValue(req.Role)))
+
+	before, _ := householdUser(r.Context(), householdFor(r), userID)
+	if err := setUserRole(r.Context(), householdFor(r), userID, role); err != nil {
+		if errors.Is(err, ErrRoleValidation) {
+			return invalidField("role", err.Error())
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "user does not exist", err, "user_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem updating role", err, "internal_error"}
+	}
+	after, _ := householdUser(r.Context(), householdFor(r), userID)
+	audit(r, "user_role_changed", "user", userID, before, after)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func updateCurrentUserSettings(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	var req settingsRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+
+	user, err := userByID(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "user does not exist", err, "user_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading user", err, "internal_error"}
+	}
+
+	// Only touch the settings that were provided
+	unitSystem := user.UnitSystem
+	if req.UnitSystem != nil {
+		unitSystem = *req.UnitSystem
+	}
+	defaultServings := user.DefaultServings
+	if req.DefaultServings != nil {
+		defaultServings = *req.DefaultServings
+	}
+
+	if err := updateUserPreferences(r.Context(), user.ID, unitSystem, defaultServings); err != nil {
+		if errors.Is(err, ErrPreferenceValidation) {
+			return &appError{http.StatusBadRequest, err.Error(), err, "validation_failed"}
+		}
+		return &appError{http.StatusInternalServerError, "problem updating settings", err, "internal_error"}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func regenerateHouseholdInvite(w http.ResponseWriter, r *http.Request) *appError {
+	householdID := householdFor(r)
+	before, _ := householdByID(r.Context(), householdID)
+	code, err := newInviteCode()
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem generating invite code", err, "internal_error"}
+	}
+	if err := setHouseholdInviteCode(r.Context(), householdID, code); err != nil {
+		return &appError{http.StatusInternalServerError, "problem updating invite code", err, "internal_error"}
+	}
+
+	household, err := householdByID(r.Context(), householdID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading household", err, "internal_error"}
+	}
+	audit(r, "household_invite_regenerated", "household", householdID, before, household)
+	json.NewEncoder(w).Encode(household)
+	return nil
+}
+
+// switchHousehold issues a new token scoped to another household the caller
+// belongs to
+func switchHousehold(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+	householdID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "household ID must be an integer", err, "invalid_id"}
+	}
+
+	role, appErr := membershipRole(r.Context(), householdID, claims.UserID)
+	if appErr != nil {
+		return appErr
+	}
+	tokenStr, err := jwtGenerate(claims.UserID, role, householdID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "could not sign token", err, "internal_error"}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokenStr})
+	return nil
+}
+
 func updateExistingRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeId, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 
 	// Validate recipe exists before attempting update
-	if _, err := recipeByID(recipeId, false); err != nil {
+	before, err := recipeByID(r.Context(), householdFor(r), recipeId, false)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "recipe does not exist", err}
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
 		}
-		return &appError{http.StatusInternalServerError, "problem loading recipe", err}
+		return &appError{http.StatusInternalServerError, "problem loading recipe", err, "internal_error"}
 	}
 
-	title := r.FormValue("title")
-	if title == "" {
-		return &appError{http.StatusBadRequest, "title is required", nil}
+	var req recipeRequest
+	if appErr := req.validate(bindRequest(w, r, &req)); appErr != nil {
+		return appErr
+	}
+	if req.Notes != nil {
+		return invalidField("notes", "notes can only be sent when creating a recipe")
+	}
+	var labels []string
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+	isNew := req.New != nil && *req.New
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
-	activeTime, err := strconv.Atoi(r.FormValue("activeTime"))
+
+	err = updateRecipe(r.Context(), householdFor(r), recipeId, *req.Title, stringValue(req.Body), *req.ActiveTime, *req.TotalTime, isNew, labels, version)
 	if err != nil {
-		return &appError{http.StatusBadRequest, "activeTime must be an integer", err}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "could not update recipe", err, "internal_error"}
 	}
-	totalTime, err := strconv.Atoi(r.FormValue("totalTime"))
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeId, false)
+	audit(r, "recipe_updated", "recipe", recipeId, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// patchRecipe updates only the fields the client sends, as a JSON Merge
+// Patch (RFC 7396) or a form. Unlike PUT, leaving out "new" keeps the flag.
+func patchRecipe(w http.ResponseWriter, r *http.Request) *appError {
+	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "totalTime must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
-	body := r.FormValue("body")
-	isNew := r.FormValue("new") != ""
 
-	err = updateRecipe(recipeId, title, body, activeTime, totalTime, isNew)
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, true)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not update recipe", err}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading recipe", err, "internal_error"}
 	}
+
+	var req recipeRequest
+	if appErr := req.validatePatch(bindRequest(w, r, &req)); appErr != nil {
+		return appErr
+	}
+
+	title, body, activeTime, totalTime, isNew := before.Title, before.Body, before.ActiveTime, before.Time, before.New
+	if req.Title != nil {
+		title = *req.Title
+	}
+	if req.Body != nil || req.null["body"] {
+		body = stringValue(req.Body)
+	}
+	if req.ActiveTime != nil {
+		activeTime = *req.ActiveTime
+	}
+	if req.TotalTime != nil {
+		totalTime = *req.TotalTime
+	}
+	if req.New != nil || req.null["new"] {
+		isNew = req.New != nil && *req.New
+	}
+	var labels []string // nil leaves the labels alone
+	if req.Labels != nil {
+		labels = *req.Labels
+	} else if req.null["labels"] {
+		labels = []string{}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	err = updateRecipe(r.Context(), householdFor(r), recipeID, title, body, activeTime, totalTime, isNew, labels, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "could not update recipe", err, "internal_error"}
+	}
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeID, true)
+	audit(r, "recipe_updated", "recipe", recipeID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -182,15 +698,29 @@ func updateExistingRecipe(w http.ResponseWriter, r *http.Request) *appError {
 func flagNote(w http.ResponseWriter, r *http.Request) *appError {
 	noteID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "note ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "note ID must be an integer", err, "invalid_id"}
 	}
 
-	if _, err := getNoteByID(noteID); err != nil {
-		return &appError{http.StatusNotFound, "note does not exist", err}
+	before, err := getNoteByID(r.Context(), householdFor(r), noteID)
+	if err != nil {
+		return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
-	if err := setNoteFlag(noteID, true); err != nil {
-		return &appError{http.StatusInternalServerError, "problem flagging note", err}
+	if err := setNoteFlag(r.Context(), householdFor(r), noteID, true, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem flagging note", err, "internal_error"}
 	}
+	after, _ := getNoteByID(r.Context(), householdFor(r), noteID)
+	audit(r, "note_flagged", "note", noteID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -198,15 +728,29 @@ func flagNote(w http.ResponseWriter, r *http.Request) *appError {
 func unFlagNote(w http.ResponseWriter, r *http.Request) *appError {
 	noteID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "note ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "note ID must be an integer", err, "invalid_id"}
 	}
 
-	if _, err := getNoteByID(noteID); err != nil {
-		return &appError{http.StatusNotFound, "note does not exist", err}
+	before, err := getNoteByID(r.Context(), householdFor(r), noteID)
+	if err != nil {
+		return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
 	}
-	if err := setNoteFlag(noteID, false); err != nil {
-		return &appError{http.StatusInternalServerError, "problem flagging note", err}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
+	if err := setNoteFlag(r.Context(), householdFor(r), noteID, false, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem flagging note", err, "internal_error"}
+	}
+	after, _ := getNoteByID(r.Context(), householdFor(r), noteID)
+	audit(r, "note_unflagged", "note", noteID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -214,16 +758,34 @@ func unFlagNote(w http.ResponseWriter, r *http.Request) *appError {
 func editNote(w http.ResponseWriter, r *http.Request) *appError {
 	noteID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "note ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "note ID must be an integer", err, "invalid_id"}
 	}
-	noteText := r.FormValue("text")
+	var req noteRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	noteText := stringValue(req.Text)
 
-	if _, err := getNoteByID(noteID); err != nil {
-		return &appError{http.StatusNotFound, "note does not exist", err}
+	before, err := getNoteByID(r.Context(), householdFor(r), noteID)
+	if err != nil {
+		return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
-	if err := setNoteText(noteID, noteText); err != nil {
-		return &appError{http.StatusInternalServerError, "problem updating note", err}
+	if err := setNoteText(r.Context(), householdFor(r), noteID, noteText, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem updating note", err, "internal_error"}
 	}
+	after, _ := getNoteByID(r.Context(), householdFor(r), noteID)
+	audit(r, "note_updated", "note", noteID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -231,81 +793,341 @@ func editNote(w http.ResponseWriter, r *http.Request) *appError {
 func editLabel(w http.ResponseWriter, r *http.Request) *appError {
 	labelID, err := strconv.Atoi(mux.Vars(r)["label_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "label ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "label ID must be an integer", err, "invalid_id"}
 	}
 
-	// Parse form data
-	if err := r.ParseForm(); err != nil {
-		return &appError{http.StatusBadRequest, "invalid form data", err}
+	var req labelRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
 	}
 
-	// Get optional form parameters
-	newName := r.FormValue("label")
-	icon := r.FormValue("icon")
-	labelType := r.FormValue("type")
-
 	// Fetch existing label to get current values
-	existing, err := labelByID(labelID)
+	existing, err := labelByID(r.Context(), householdFor(r), labelID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "label does not exist", err}
+			return &appError{http.StatusNotFound, "label does not exist", err, "label_not_found"}
 		}
-		return &appError{http.StatusInternalServerError, "problem loading label", err}
+		return &appError{http.StatusInternalServerError, "problem loading label", err, "internal_error"}
 	}
 
-	// Use existing values if parameters not provided
-	if !r.Form.Has("label") {
-		newName = existing.Label
+	// Use existing values if parameters not provided. Note: icon can be
+	// explicitly set to empty string to clear it, which is why the request
+	// fields are pointers: nil is "not provided", "" is "empty string"
+	newName, icon, labelType, parentID := existing.Label, existing.Icon, existing.Type, existing.ParentID
+	if req.Label != nil {
+		newName = *req.Label
 	}
-	// Note: icon can be explicitly set to empty string to clear it
-	// So we use r.Form.Has to distinguish "not provided" from "empty string"
-	if !r.Form.Has("icon") {
-		icon = existing.Icon
+	if req.Icon != nil {
+		icon = *req.Icon
 	}
-	if !r.Form.Has("type") {
-		labelType = existing.Type
+	if req.Type != nil {
+		labelType = *req.Type
+	}
+	if req.ParentID != nil {
+		parentID = *req.ParentID
 	}
 
 	// Update the label
-	err = updateLabel(labelID, newName, icon, labelType)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = updateLabel(r.Context(), householdFor(r), labelID, newName, icon, labelType, parentID, version)
 	if err != nil {
 		// Check if it's a validation error
 		if errors.Is(err, ErrIconValidation) {
-			return &appError{http.StatusBadRequest, err.Error(), err}
+			return invalidField("icon", err.Error())
 		}
 		if errors.Is(err, ErrTypeValidation) {
-			return &appError{http.StatusBadRequest, err.Error(), err}
+			return invalidField("type", err.Error())
+		}
+		if errors.Is(err, ErrParentValidation) {
+			return invalidField("parentId", err.Error())
 		}
 		if errors.Is(err, ErrLabelConflict) {
-			return &appError{http.StatusConflict, err.Error(), err}
+			return &appError{http.StatusConflict, err.Error(), err, "label_conflict"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
 		}
-		return &appError{http.StatusInternalServerError, "problem updating label", err}
+		return &appError{http.StatusInternalServerError, "problem updating label", err, "internal_error"}
 	}
+	after, _ := labelByID(r.Context(), householdFor(r), labelID)
+	audit(r, "label_updated", "label", labelID, existing, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+func editLabelType(w http.ResponseWriter, r *http.Request) *appError {
+	typeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "label type ID must be an integer", err, "invalid_id"}
+	}
+	var req labelTypeRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+
+	existing, err := labelTypeByID(r.Context(), householdFor(r), typeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "label type does not exist", err, "label_type_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading label type", err, "internal_error"}
+	}
+	labelType := req.apply(existing)
+
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = updateLabelType(r.Context(), householdFor(r), labelType, version)
+	if err != nil {
+		if appErr := labelTypeError(err); appErr != nil {
+			return appErr
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem updating label type", err, "internal_error"}
+	}
+	after, _ := labelTypeByID(r.Context(), householdFor(r), typeID)
+	audit(r, "label_type_updated", "label_type", typeID, existing, after)
+	w.Header().Set("ETag", versionETag(after.Version))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// labelTypeError maps the validation errors of a label type's fields to
+// responses, or returns nil for any other error
+func labelTypeError(err error) *appError {
+	switch {
+	case errors.Is(err, ErrTypeValidation):
+		return invalidField("name", err.Error())
+	case errors.Is(err, ErrIconValidation):
+		return invalidField("icon", err.Error())
+	case errors.Is(err, ErrLabelTypeConflict):
+		return &appError{http.StatusConflict, err.Error(), err, "label_type_conflict"}
+	}
+	return nil
+}
+
+// mergeLabels merges one label into another: its recipes get the target
+// label instead, and its name becomes an alias for the target
+func mergeLabels(w http.ResponseWriter, r *http.Request) *appError {
+	labelID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "label ID must be an integer", err, "invalid_id"}
+	}
+	targetID, err := strconv.Atoi(mux.Vars(r)["target_id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "target label ID must be an integer", err, "invalid_id"}
+	}
+	if labelID == targetID {
+		return &appError{http.StatusBadRequest, "a label can't be merged into itself", nil, "invalid_id"}
+	}
+
+	before, err := labelByID(r.Context(), householdFor(r), labelID)
+	if err == nil {
+		_, err = labelByID(r.Context(), householdFor(r), targetID)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return &appError{http.StatusNotFound, "label does not exist", err, "label_not_found"}
+	} else if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading label", err, "internal_error"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	err = mergeLabel(r.Context(), householdFor(r), labelID, targetID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "label does not exist", err, "label_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem merging labels", err, "internal_error"}
+	}
+	target, err := labelByID(r.Context(), householdFor(r), targetID)
+	if err == nil {
+		target.Aliases, err = labelAliases(r.Context(), householdFor(r), targetID)
+	}
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem loading label", err, "internal_error"}
+	}
+	audit(r, "label_merged", "label", labelID, before, target)
+	w.Header().Set("ETag", versionETag(target.Version))
+	json.NewEncoder(w).Encode(target)
+	return nil
+}
+
 /* CREATE */
 func createNewRecipe(w http.ResponseWriter, r *http.Request) *appError {
-	title := r.FormValue("title")
-	if title == "" {
-		return &appError{http.StatusBadRequest, "title is required", nil}
+	var req recipeRequest
+	if appErr := req.validate(bindRequest(w, r, &req)); appErr != nil {
+		return appErr
+	}
+	var labels, notes []string
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+	if req.Notes != nil {
+		notes = *req.Notes
+	}
+	isNew := req.New != nil && *req.New
+
+	recipe, err := createRecipe(r.Context(), householdFor(r), *req.Title, stringValue(req.Body), *req.ActiveTime, *req.TotalTime, isNew, labels, notes)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "could not create recipe", err, "internal_error"}
+	}
+	audit(r, "recipe_created", "recipe", recipe.ID, nil, recipe)
+	w.Header().Set("ETag", versionETag(recipe.Version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(recipe)
+	return nil
+}
+
+// createNewAPIKey issues a key for the logged-in user, scoped to their
+// current household. The key itself is only ever returned here.
+func createNewAPIKey(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	var req apiKeyRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	name := strings.TrimSpace(stringValue(req.Name))
+	scope := strings.ToLower(stringValue(req.Scope))
+	if scope == "" {
+		scope = apiKeyScopeRead
+	}
+	var expires int64
+	if req.ExpiresInDays != nil {
+		n := *req.ExpiresInDays
+		if n < 0 {
+			return invalidField("expiresInDays", "expiresInDays must be a non-negative integer")
+		}
+		if n > 0 {
+			expires = time.Now().Add(time.Duration(n) * 24 * time.Hour).Unix()
+		}
+	}
+
+	key, hash, err := newAPIKey()
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "problem generating API key", err, "internal_error"}
+	}
+	apiKey, err := createAPIKey(r.Context(), claims.UserID, claims.EffectiveHouseholdID(), name, scope, hash, key[:apiKeyDisplayLength], expires)
+	if err != nil {
+		if errors.Is(err, ErrAPIKeyValidation) {
+			return &appError{http.StatusBadRequest, err.Error(), err, "validation_failed"}
+		}
+		return &appError{http.StatusInternalServerError, "could not create API key", err, "internal_error"}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Key string
+	}{apiKey, key})
+	return nil
+}
+
+func createNewHousehold(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+	var req householdRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	name := strings.TrimSpace(stringValue(req.Name))
+	if err := validateHouseholdName(name); err != nil {
+		return invalidField("name", err.Error())
+	}
+
+	household, err := createHousehold(r.Context(), name, claims.UserID)
+	if err != nil {
+		return &appError{http.StatusInternalServerError, "could not create household", err, "internal_error"}
+	}
+	audit(r, "household_created", "household", household.ID, nil, household)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(household)
+	return nil
+}
+
+func joinHousehold(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+	var req joinRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	code := strings.TrimSpace(stringValue(req.Code))
+	if code == "" {
+		return invalidField("code", "invite code is required")
+	}
+
+	household, err := householdByInviteCode(r.Context(), code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "invite code not recognized", err, "invite_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem loading household", err, "internal_error"}
+	}
+	if err := addHouseholdMember(r.Context(), household.ID, claims.UserID); err != nil {
+		return &appError{http.StatusInternalServerError, "could not join household", err, "internal_error"}
+	}
+
+	household.InviteCode = ""
+	json.NewEncoder(w).Encode(household)
+	return nil
+}
+
+// copyRecipeToHousehold copies a recipe from the caller's current household
+// into another household they belong to
+func copyRecipeToHousehold(w http.ResponseWriter, r *http.Request) *appError {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return &appError{http.StatusUnauthorized, "missing auth token", nil, "auth_required"}
+	}
+	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
-	activeTime, err := strconv.Atoi(r.FormValue("activeTime"))
+	targetID, err := strconv.Atoi(mux.Vars(r)["household_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "activeTime must be an integer", err}
+		return &appError{http.StatusBadRequest, "household ID must be an integer", err, "invalid_id"}
 	}
-	totalTime, err := strconv.Atoi(r.FormValue("totalTime"))
+
+	member, err := isHouseholdMember(r.Context(), targetID, claims.UserID)
 	if err != nil {
-		return &appError{http.StatusBadRequest, "totalTime must be an integer", err}
+		return &appError{http.StatusInternalServerError, "problem checking household membership", err, "internal_error"}
+	}
+	if !member {
+		return &appError{http.StatusForbidden, "not a member of that household", nil, "not_household_member"}
 	}
-	body := r.FormValue("body")
 
-	recipe, err := createRecipe(title, body, activeTime, totalTime)
+	recipe, err := copyRecipe(r.Context(), householdFor(r), recipeID, targetID)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not create recipe", err}
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "could not copy recipe", err, "internal_error"}
 	}
+	source := map[string]int{"recipe_id": recipeID, "household_id": householdFor(r)}
+	audit(r, "recipe_copied", "recipe", recipe.ID, source, recipe)
+	w.Header().Set("ETag", versionETag(recipe.Version))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(recipe)
 	return nil
@@ -314,23 +1136,29 @@ func createNewRecipe(w http.ResponseWriter, r *http.Request) *appError {
 func createNoteOnRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
+	}
+	var req noteRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
 	}
-	noteText := r.FormValue("text")
+	noteText := stringValue(req.Text)
 
 	// Validate that the recipe exists
-	if _, err := recipeByID(recipeID, false); err != nil {
+	if _, err := recipeByID(r.Context(), householdFor(r), recipeID, false); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "recipe does not exist", err}
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
 		} else {
-			return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+			return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 		}
 	}
 
-	note, err := createNote(recipeID, noteText)
+	note, err := createNote(r.Context(), householdFor(r), recipeID, noteText)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "problem creating note", err}
+		return &appError{http.StatusInternalServerError, "problem creating note", err, "internal_error"}
 	}
+	audit(r, "note_created", "note", note.ID, nil, note)
+	w.Header().Set("ETag", versionETag(note.Version))
 	json.NewEncoder(w).Encode(note)
 	return nil
 }
@@ -338,92 +1166,133 @@ func createNoteOnRecipe(w http.ResponseWriter, r *http.Request) *appError {
 func tagRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["recipe_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 	labelID, err := strconv.Atoi(mux.Vars(r)["label_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "label ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "label ID must be an integer", err, "invalid_id"}
 	}
 
 	// Make sure we have both recipe and label
-	if _, err := recipeByID(recipeID, false); err != nil {
+	if _, err := recipeByID(r.Context(), householdFor(r), recipeID, false); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
-			return &appError{http.StatusNotFound, msg, err}
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
 		} else {
-			return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+			return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 		}
 	}
-	if _, err := labelByID(labelID); err != nil {
+	if _, err := labelByID(r.Context(), householdFor(r), labelID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			msg := fmt.Sprintf("No label with id=%v exists", labelID)
-			return &appError{http.StatusNotFound, msg, err}
+			return &appError{http.StatusNotFound, msg, err, "label_not_found"}
 		} else {
-			return &appError{http.StatusInternalServerError, "Problem loading label", err}
+			return &appError{http.StatusInternalServerError, "Problem loading label", err, "internal_error"}
 		}
 	}
-	linked, err := recipeLabelExists(recipeID, labelID)
+	linked, err := recipeLabelExists(r.Context(), recipeID, labelID)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "problem checking recipe-label link", err}
+		return &appError{http.StatusInternalServerError, "problem checking recipe-label link", err, "internal_error"}
 	}
 
 	if linked {
 		w.WriteHeader(http.StatusNoContent)
 		return nil
 	} else {
-		if err := createRecipeLabel(recipeID, labelID); err != nil {
-			return &appError{http.StatusInternalServerError, "problem linking recipe to label", err}
+		version, appErr := ifMatchVersion(r)
+		if appErr != nil {
+			return appErr
+		}
+		if err := labelRecipe(r.Context(), householdFor(r), recipeID, labelID, version); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+				return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+			}
+			if errors.Is(err, ErrVersionConflict) {
+				return preconditionFailed(err)
+			}
+			return &appError{http.StatusInternalServerError, "problem linking recipe to label", err, "internal_error"}
 		}
 	}
+	audit(r, "recipe_labeled", "recipe", recipeID, nil, map[string]int{"label_id": labelID})
 	w.WriteHeader(http.StatusCreated)
 	return nil
 }
 
 func addLabel(w http.ResponseWriter, r *http.Request) *appError {
 	labelName := strings.ToLower(mux.Vars(r)["label_name"])
-	label, err := labelByName(labelName)
+	label, err := labelByName(r.Context(), householdFor(r), labelName)
 	if err == nil { // No error means the label alredy exists
+		w.Header().Set("ETag", versionETag(label.Version))
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(label)
 		return nil
 	} else if !errors.Is(err, sql.ErrNoRows) {
 		// ErrNoRows means the label doesn't yet exist; anything else is actually an error
-		return &appError{http.StatusInternalServerError, "problem checking label", err}
+		return &appError{http.StatusInternalServerError, "problem checking label", err, "internal_error"}
 	}
-	label, err = createLabel(labelName)
+	label, err = createLabel(r.Context(), householdFor(r), labelName)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "problem creating label", err}
+		return &appError{http.StatusInternalServerError, "problem creating label", err, "internal_error"}
 	}
+	audit(r, "label_created", "label", label.ID, nil, label)
+	w.Header().Set("ETag", versionETag(label.Version))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(label)
 	return nil
 }
 
+func createNewLabelType(w http.ResponseWriter, r *http.Request) *appError {
+	var req labelTypeRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	labelType, err := createLabelType(r.Context(), householdFor(r), req.apply(LabelType{MultiSelect: true}))
+	if err != nil {
+		if appErr := labelTypeError(err); appErr != nil {
+			return appErr
+		}
+		return &appError{http.StatusInternalServerError, "problem creating label type", err, "internal_error"}
+	}
+	audit(r, "label_type_created", "label_type", labelType.ID, nil, labelType)
+	w.Header().Set("ETag", versionETag(labelType.Version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(labelType)
+	return nil
+}
+
 /* DELETE */
 func deleteRecipeHard(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 
-	_, err = recipeByID(recipeID, false)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+		return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+	} else if err != nil {
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
+	}
+	before.Notes, _ = notesByRecipeID(r.Context(), householdFor(r), recipeID)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
 
-	connect()
-	qr := "DELETE FROM recipe WHERE recipe_id = ?"
-	ql := "DELETE FROM recipe_label WHERE recipe_id = ?"
-	qn := "DELETE FROM note WHERE recipe_id = ?"
-	if _, err := db.Exec(qr, recipeID); err != nil {
-		return &appError{http.StatusInternalServerError, "Problem deleting recipe", err}
-	}
-	if _, err := db.Exec(ql, recipeID); err != nil {
-		return &appError{http.StatusInternalServerError, "Problem deleting recipe-label links", err}
-	}
-	if _, err := db.Exec(qn, recipeID); err != nil {
-		return &appError{http.StatusInternalServerError, "Problem deleting notes", err}
+	err = deleteRecipe(r.Context(), householdFor(r), recipeID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "Problem deleting recipe", err, "internal_error"}
 	}
+	audit(r, "recipe_hard_deleted", "recipe", recipeID, before, nil)
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -431,12 +1300,32 @@ func deleteRecipeHard(w http.ResponseWriter, r *http.Request) *appError {
 func deleteRecipeSoft(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
+	}
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+		return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+	} else if err != nil {
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 	}
-	err = softDeleteRecipe(recipeID)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = softDeleteRecipe(r.Context(), householdFor(r), recipeID, version)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not soft-delete recipe", err}
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "could not soft-delete recipe", err, "internal_error"}
 	}
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	audit(r, "recipe_deleted", "recipe", recipeID, before, after)
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -444,12 +1333,69 @@ func deleteRecipeSoft(w http.ResponseWriter, r *http.Request) *appError {
 func recipeRestore(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
-	err = unDeleteRecipe(recipeID)
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+		return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+	} else if err != nil {
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = unDeleteRecipe(r.Context(), householdFor(r), recipeID, version)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not un-delete recipe", err}
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "could not un-delete recipe", err, "internal_error"}
 	}
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	audit(r, "recipe_restored", "recipe", recipeID, before, after)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// deleteFromTrash permanently deletes a recipe, but only one that's
+// already in the trash
+func deleteFromTrash(w http.ResponseWriter, r *http.Request) *appError {
+	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
+	}
+
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, true)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !before.Deleted) {
+		msg := fmt.Sprintf("No recipe with id=%v is in the trash", recipeID)
+		return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+	} else if err != nil {
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
+	}
+	before.Notes, _ = notesByRecipeID(r.Context(), householdFor(r), recipeID)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	err = deleteTrashedRecipe(r.Context(), householdFor(r), recipeID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v is in the trash", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "Problem deleting recipe", err, "internal_error"}
+	}
+	audit(r, "recipe_hard_deleted", "recipe", recipeID, before, nil)
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -457,19 +1403,33 @@ func recipeRestore(w http.ResponseWriter, r *http.Request) *appError {
 func flagRecipeCooked(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 
-	if _, err := recipeByID(recipeID, false); err != nil {
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "recipe does not exist", err}
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
 		}
-		return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 	}
 
-	if err := setRecipeNewFlag(recipeID, false); err != nil {
-		return &appError{http.StatusInternalServerError, "problem setting recipe new flag", err}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
+	if err := setRecipeNewFlag(r.Context(), householdFor(r), recipeID, false, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem setting recipe new flag", err, "internal_error"}
+	}
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	audit(r, "recipe_marked_cooked", "recipe", recipeID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -478,19 +1438,33 @@ func flagRecipeCooked(w http.ResponseWriter, r *http.Request) *appError {
 func unFlagRecipeCooked(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 
-	if _, err := recipeByID(recipeID, false); err != nil {
+	before, err := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "recipe does not exist", err}
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
 		}
-		return &appError{http.StatusInternalServerError, "Problem loading recipe", err}
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
 	}
 
-	if err := setRecipeNewFlag(recipeID, true); err != nil {
-		return &appError{http.StatusInternalServerError, "problem setting recipe new flag", err}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	if err := setRecipeNewFlag(r.Context(), householdFor(r), recipeID, true, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "recipe does not exist", err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem setting recipe new flag", err, "internal_error"}
 	}
+	after, _ := recipeByID(r.Context(), householdFor(r), recipeID, false)
+	audit(r, "recipe_marked_new", "recipe", recipeID, before, after)
+	w.Header().Set("ETag", versionETag(after.Version))
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -499,16 +1473,35 @@ func unFlagRecipeCooked(w http.ResponseWriter, r *http.Request) *appError {
 func untagRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, err := strconv.Atoi(mux.Vars(r)["recipe_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "recipe ID must be an integer", err, "invalid_id"}
 	}
 	labelID, err := strconv.Atoi(mux.Vars(r)["label_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "label ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "label ID must be an integer", err, "invalid_id"}
 	}
 
-	if err := deleteRecipeLabel(recipeID, labelID); err != nil {
-		return &appError{http.StatusInternalServerError, "problem deleting recipe-label link", err}
+	if _, err := recipeByID(r.Context(), householdFor(r), recipeID, false); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "Problem loading recipe", err, "internal_error"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
 	}
+	if err := unlabelRecipe(r.Context(), householdFor(r), recipeID, labelID, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			msg := fmt.Sprintf("No recipe with id=%v exists", recipeID)
+			return &appError{http.StatusNotFound, msg, err, "recipe_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem deleting recipe-label link", err, "internal_error"}
+	}
+	audit(r, "recipe_unlabeled", "recipe", recipeID, map[string]int{"label_id": labelID}, nil)
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
@@ -516,29 +1509,138 @@ func untagRecipe(w http.ResponseWriter, r *http.Request) *appError {
 func removeNote(w http.ResponseWriter, r *http.Request) *appError {
 	noteID, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "note ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "note ID must be an integer", err, "invalid_id"}
+	}
+
+	before, err := getNoteByID(r.Context(), householdFor(r), noteID)
+	if err != nil {
+		return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+	}
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	if err := deleteNote(r.Context(), householdFor(r), noteID, version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "note does not exist", err, "note_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem deleting note", err, "internal_error"}
+	}
+	audit(r, "note_deleted", "note", noteID, before, nil)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) *appError {
+	claims, appErr := sessionClaims(r)
+	if appErr != nil {
+		return appErr
+	}
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "API key ID must be an integer", err, "invalid_id"}
 	}
 
-	if err := deleteNote(noteID); err != nil {
-		return &appError{http.StatusInternalServerError, "problem deleting note", err}
+	if err := deleteAPIKey(r.Context(), claims.UserID, keyID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "API key does not exist", err, "api_key_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem revoking API key", err, "internal_error"}
 	}
 	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+func removeLockout(w http.ResponseWriter, r *http.Request) *appError {
+	scope := mux.Vars(r)["scope"]
+	subject := mux.Vars(r)["subject"]
+	if scope != lockoutScopeUser && scope != lockoutScopeIP {
+		msg := fmt.Sprintf("lockout scope must be %q or %q", lockoutScopeUser, lockoutScopeIP)
+		return &appError{http.StatusBadRequest, msg, nil, "invalid_id"}
+	}
+	if scope == lockoutScopeUser {
+		subject = strings.ToLower(subject)
+	}
+	operator, appErr := isOperator(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	// Household admins can only clear their own members' lockouts
+	var err error
+	switch {
+	case operator:
+		err = clearLockout(r.Context(), scope, subject)
+	case scope == lockoutScopeUser:
+		err = clearMemberLockout(r.Context(), householdFor(r), subject)
+	default:
+		return &appError{http.StatusForbidden, "only operators can clear IP lockouts", nil, "operator_required"}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "lockout does not exist", err, "lockout_not_found"}
+		}
+		return &appError{http.StatusInternalServerError, "problem clearing lockout", err, "internal_error"}
+	}
+
+	audit(r, "lockout_cleared", "lockout", 0, map[string]string{"scope": scope, "subject": subject}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 func removeLabel(w http.ResponseWriter, r *http.Request) *appError {
 	labelID, err := strconv.Atoi(mux.Vars(r)["label_id"])
 	if err != nil {
-		return &appError{http.StatusBadRequest, "label ID must be an integer", err}
+		return &appError{http.StatusBadRequest, "label ID must be an integer", err, "invalid_id"}
 	}
 
-	err = deleteLabel(labelID)
+	before, _ := labelByID(r.Context(), householdFor(r), labelID)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = deleteLabel(r.Context(), householdFor(r), labelID, version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return &appError{http.StatusNotFound, "label does not exist", err}
+			return &appError{http.StatusNotFound, "label does not exist", err, "label_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
+		}
+		return &appError{http.StatusInternalServerError, "problem deleting label", err, "internal_error"}
+	}
+	audit(r, "label_deleted", "label", labelID, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func removeLabelType(w http.ResponseWriter, r *http.Request) *appError {
+	typeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return &appError{http.StatusBadRequest, "label type ID must be an integer", err, "invalid_id"}
+	}
+
+	before, _ := labelTypeByID(r.Context(), householdFor(r), typeID)
+	version, appErr := ifMatchVersion(r)
+	if appErr != nil {
+		return appErr
+	}
+	err = deleteLabelType(r.Context(), householdFor(r), typeID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &appError{http.StatusNotFound, "label type does not exist", err, "label_type_not_found"}
+		}
+		if errors.Is(err, ErrVersionConflict) {
+			return preconditionFailed(err)
 		}
-		return &appError{http.StatusInternalServerError, "problem deleting label", err}
+		return &appError{http.StatusInternalServerError, "problem deleting label type", err, "internal_error"}
 	}
+	audit(r, "label_type_deleted", "label_type", typeID, before, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,7 +36,7 @@ func TestAuthRequiredWithValidToken(t *testing.T) {
 	setupAuthConfig()
 
 	// Generate a valid token
-	tokenString, err := jwtGenerate(1, true)
+	tokenString, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -185,7 +191,7 @@ func TestAuthRequiredWithWrongSecret(t *testing.T) {
 	setupAuthConfig()
 
 	// Generate token with current secret
-	tokenString, err := jwtGenerate(1, true)
+	tokenString, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -222,7 +228,7 @@ func TestAuthRequiredWithTokenInWhitespace(t *testing.T) {
 	setupAuthConfig()
 
 	// Generate a valid token
-	tokenString, err := jwtGenerate(1, true)
+	tokenString, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -268,8 +274,8 @@ func TestFlagRecipeCookedSuccess(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe and set it to new
-	recipe, _ := createRecipe("Test Recipe", "Body", 10, 20)
-	setRecipeNewFlag(recipe.ID, true)
+	recipe, _ := createRecipe(context.Background(), 1, "Test Recipe", "Body", 10, 20, false, nil, nil)
+	setRecipeNewFlag(context.Background(), 1, recipe.ID, true, 0)
 
 	// Create request to mark it cooked
 	req := httptest.NewRequest("PUT", fmt.Sprintf("/recipe/%d/mark_cooked", recipe.ID), nil)
@@ -290,7 +296,7 @@ func TestFlagRecipeCookedSuccess(t *testing.T) {
 	}
 
 	// Verify database was updated
-	updated, _ := recipeByID(recipe.ID, false)
+	updated, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if updated.New {
 		t.Errorf("After flagRecipeCooked(), expected New=false, got New=true")
 	}
@@ -378,7 +384,7 @@ func TestUnFlagRecipeCookedSuccess(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe (defaults to new=false)
-	recipe, _ := createRecipe("Test Recipe", "Body", 10, 20)
+	recipe, _ := createRecipe(context.Background(), 1, "Test Recipe", "Body", 10, 20, false, nil, nil)
 
 	// Create request to mark it new
 	req := httptest.NewRequest("PUT", fmt.Sprintf("/recipe/%d/mark_new", recipe.ID), nil)
@@ -399,7 +405,7 @@ func TestUnFlagRecipeCookedSuccess(t *testing.T) {
 	}
 
 	// Verify database was updated
-	updated, _ := recipeByID(recipe.ID, false)
+	updated, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if !updated.New {
 		t.Errorf("After unFlagRecipeCooked(), expected New=true, got New=false")
 	}
@@ -487,13 +493,13 @@ func TestRecipeNewFlagIntegration(t *testing.T) {
 	bootstrap(true)
 
 	// Create a new recipe
-	recipe, err := createRecipe("Integration Test Recipe", "Test body", 15, 25)
+	recipe, err := createRecipe(context.Background(), 1, "Integration Test Recipe", "Test body", 15, 25, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to create recipe: %v", err)
 	}
 
 	// Initial state should be new=false
-	fetched, _ := recipeByID(recipe.ID, false)
+	fetched, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if fetched.New {
 		t.Errorf("Newly created recipe should have New=false, got New=true")
 	}
@@ -507,7 +513,7 @@ func TestRecipeNewFlagIntegration(t *testing.T) {
 	}
 
 	// Verify it's new
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("After marking new, expected New=true, got New=false")
 	}
@@ -521,7 +527,7 @@ func TestRecipeNewFlagIntegration(t *testing.T) {
 	}
 
 	// Verify it's not new
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if fetched.New {
 		t.Errorf("After marking cooked, expected New=false, got New=true")
 	}
@@ -535,7 +541,7 @@ func TestRecipeNewFlagIntegration(t *testing.T) {
 	}
 
 	// Verify it's new again
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("After second marking new, expected New=true, got New=false")
 	}
@@ -557,10 +563,10 @@ func TestUpdateExistingRecipeWithNewFlagTrue(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe (defaults to new=false)
-	recipe, _ := createRecipe("Test Recipe", "Original Body", 10, 20)
+	recipe, _ := createRecipe(context.Background(), 1, "Test Recipe", "Original Body", 10, 20, false, nil, nil)
 
 	// Verify initial state
-	fetched, _ := recipeByID(recipe.ID, false)
+	fetched, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if fetched.New {
 		t.Errorf("Initial recipe should have New=false, got New=true")
 	}
@@ -591,7 +597,7 @@ func TestUpdateExistingRecipeWithNewFlagTrue(t *testing.T) {
 	}
 
 	// Verify database was updated with new=true
-	updated, _ := recipeByID(recipe.ID, false)
+	updated, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if !updated.New {
 		t.Errorf("After update with new=on, expected New=true, got New=false")
 	}
@@ -625,11 +631,11 @@ func TestUpdateExistingRecipeWithNewFlagFalse(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe and set it to new
-	recipe, _ := createRecipe("Test Recipe", "Original Body", 10, 20)
-	setRecipeNewFlag(recipe.ID, true)
+	recipe, _ := createRecipe(context.Background(), 1, "Test Recipe", "Original Body", 10, 20, false, nil, nil)
+	setRecipeNewFlag(context.Background(), 1, recipe.ID, true, 0)
 
 	// Verify initial state
-	fetched, _ := recipeByID(recipe.ID, false)
+	fetched, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("Recipe should have New=true after setRecipeNewFlag, got New=false")
 	}
@@ -660,7 +666,7 @@ func TestUpdateExistingRecipeWithNewFlagFalse(t *testing.T) {
 	}
 
 	// Verify database was updated with new=false
-	updated, _ := recipeByID(recipe.ID, false)
+	updated, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if updated.New {
 		t.Errorf("After update without new field, expected New=false, got New=true")
 	}
@@ -725,13 +731,13 @@ func TestUpdateRecipeNewFlagIntegration(t *testing.T) {
 	bootstrap(true)
 
 	// Create a recipe
-	recipe, err := createRecipe("Integration Test Recipe", "Original Body", 10, 20)
+	recipe, err := createRecipe(context.Background(), 1, "Integration Test Recipe", "Original Body", 10, 20, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to create recipe: %v", err)
 	}
 
 	// Initial state: new=false
-	fetched, _ := recipeByID(recipe.ID, false)
+	fetched, _ := recipeByID(context.Background(), 1, recipe.ID, false)
 	if fetched.New {
 		t.Errorf("Newly created recipe should have New=false, got New=true")
 	}
@@ -751,7 +757,7 @@ func TestUpdateRecipeNewFlagIntegration(t *testing.T) {
 		t.Fatalf("First update failed: %v", err)
 	}
 
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("After first update with new=on, expected New=true, got New=false")
 	}
@@ -771,7 +777,7 @@ func TestUpdateRecipeNewFlagIntegration(t *testing.T) {
 		t.Fatalf("Second update failed: %v", err)
 	}
 
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("After second update with new=on, expected New=true, got New=false")
 	}
@@ -794,7 +800,7 @@ func TestUpdateRecipeNewFlagIntegration(t *testing.T) {
 		t.Fatalf("Third update failed: %v", err)
 	}
 
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if fetched.New {
 		t.Errorf("After third update without new field, expected New=false, got New=true")
 	}
@@ -817,7 +823,7 @@ func TestUpdateRecipeNewFlagIntegration(t *testing.T) {
 		t.Fatalf("Fourth update failed: %v", err)
 	}
 
-	fetched, _ = recipeByID(recipe.ID, false)
+	fetched, _ = recipeByID(context.Background(), 1, recipe.ID, false)
 	if !fetched.New {
 		t.Errorf("After fourth update with new=1, expected New=true, got New=false")
 	}
@@ -843,7 +849,7 @@ func TestEditLabel(t *testing.T) {
 
 	// Test 1: Update icon only
 	// First get the original label name
-	originalLabel, _ := labelByID(1)
+	originalLabel, _ := labelByID(context.Background(), 1, 1)
 	originalName := originalLabel.Label
 
 	req := httptest.NewRequest("PUT", "/priv/label/id/1", nil)
@@ -860,7 +866,7 @@ func TestEditLabel(t *testing.T) {
 		t.Errorf("Test 1: Expected 204, got %d: %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ := labelByID(1)
+	label, _ := labelByID(context.Background(), 1, 1)
 	if label.Icon != "🐄" {
 		t.Errorf("Test 1: Expected icon '🐄', got %q", label.Icon)
 	}
@@ -886,7 +892,7 @@ func TestEditLabel(t *testing.T) {
 		t.Errorf("Test 2: Expected 204, got %d", rr.Code)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Label != "newname" {
 		t.Errorf("Test 2: Expected label 'newname', got %q", label.Label)
 	}
@@ -952,7 +958,7 @@ func TestEditLabel(t *testing.T) {
 		t.Errorf("Test 6: Expected 204, got %d", rr.Code)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Icon != "" {
 		t.Errorf("Test 6: Expected empty icon, got %q", label.Icon)
 	}
@@ -975,7 +981,7 @@ func TestEditLabelIntegration(t *testing.T) {
 	bootstrap(true)
 
 	// Verify initial state from bootstrap
-	label, _ := labelByID(1)
+	label, _ := labelByID(context.Background(), 1, 1)
 	if label.Label != "chicken" {
 		t.Errorf("Expected initial label 'chicken', got %q", label.Label)
 	}
@@ -998,7 +1004,7 @@ func TestEditLabelIntegration(t *testing.T) {
 		t.Fatalf("Test 1: Expected 204, got %d - %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Label != "chicken" {
 		t.Errorf("Test 1: Label name should not change, got %q", label.Label)
 	}
@@ -1021,7 +1027,7 @@ func TestEditLabelIntegration(t *testing.T) {
 		t.Fatalf("Test 2: Expected 204, got %d - %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Label != "steak" {
 		t.Errorf("Test 2: Expected lowercase 'steak', got %q", label.Label)
 	}
@@ -1045,7 +1051,7 @@ func TestEditLabelIntegration(t *testing.T) {
 		t.Fatalf("Test 3: Expected 204, got %d - %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ = labelByID(2)
+	label, _ = labelByID(context.Background(), 1, 2)
 	if label.Label != "poultry" || label.Icon != "🐔" {
 		t.Errorf("Test 3: Expected 'poultry'/'🐔', got %q/%q", label.Label, label.Icon)
 	}
@@ -1065,7 +1071,7 @@ func TestEditLabelIntegration(t *testing.T) {
 		t.Fatalf("Test 4: Expected 204, got %d - %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ = labelByID(2)
+	label, _ = labelByID(context.Background(), 1, 2)
 	if label.Icon != "" {
 		t.Errorf("Test 4: Expected empty icon, got %q", label.Icon)
 	}
@@ -1100,7 +1106,7 @@ func TestEditLabelIntegration(t *testing.T) {
 		t.Fatalf("Test 6: Expected 204, got %d - %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ = labelByID(14)
+	label, _ = labelByID(context.Background(), 1, 14)
 	if label.Icon != "🇲🇽" {
 		t.Errorf("Test 6: Expected flag '🇲🇽', got %q", label.Icon)
 	}
@@ -1136,7 +1142,7 @@ func TestEditLabelWithType(t *testing.T) {
 		t.Errorf("Test 1: Expected 204, got %d: %s", rr.Code, rr.Body.String())
 	}
 
-	label, _ := labelByID(1)
+	label, _ := labelByID(context.Background(), 1, 1)
 	if label.Type != "protein" {
 		t.Errorf("Test 1: Expected type 'protein', got %q", label.Type)
 	}
@@ -1158,7 +1164,7 @@ func TestEditLabelWithType(t *testing.T) {
 		t.Errorf("Test 2: Expected 204, got %d", rr.Code)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Label != "poultry" || label.Icon != "🐔" || label.Type != "protein" {
 		t.Errorf("Test 2: Expected poultry/🐔/protein, got %q/%q/%q", label.Label, label.Icon, label.Type)
 	}
@@ -1193,14 +1199,14 @@ func TestEditLabelWithType(t *testing.T) {
 		t.Errorf("Test 4: Expected 204, got %d", rr.Code)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Type != "" {
 		t.Errorf("Test 4: Expected empty type, got %q", label.Type)
 	}
 
 	// Test 5: Missing type parameter preserves existing value
 	// First set a type
-	updateLabel(1, "poultry", "🐔", "protein")
+	updateLabel(context.Background(), 1, 1, "poultry", "🐔", "protein", 0, 0)
 
 	// Then update only icon (no type parameter)
 	req = httptest.NewRequest("PUT", "/priv/label/id/1", nil)
@@ -1217,7 +1223,7 @@ func TestEditLabelWithType(t *testing.T) {
 		t.Errorf("Test 5: Expected 204, got %d", rr.Code)
 	}
 
-	label, _ = labelByID(1)
+	label, _ = labelByID(context.Background(), 1, 1)
 	if label.Type != "protein" {
 		t.Errorf("Test 5: Type should be preserved, got %q", label.Type)
 	}
@@ -1226,7 +1232,7 @@ func TestEditLabelWithType(t *testing.T) {
 func TestAdminRequiredWithAdminToken(t *testing.T) {
 	setupAuthConfig()
 
-	tokenStr, err := jwtGenerate(1, true)
+	tokenStr, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -1256,7 +1262,7 @@ func TestAdminRequiredWithAdminToken(t *testing.T) {
 func TestAdminRequiredWithNonAdminToken(t *testing.T) {
 	setupAuthConfig()
 
-	tokenStr, err := jwtGenerate(2, false)
+	tokenStr, err := jwtGenerate(2, RoleViewer, 1)
 	if err != nil {
 		t.Fatalf("Failed to generate token: %v", err)
 	}
@@ -1353,13 +1359,13 @@ func TestRemoveLabelSuccess(t *testing.T) {
 	bootstrap(true)
 
 	// Create a label to delete
-	_, err := db.Exec("INSERT INTO label (label_id, label, icon, type) VALUES (999, 'testlabel', '🧪', 'test')")
+	_, err := db.Exec("INSERT INTO label (label_id, label, icon, type_id) VALUES (999, 'testlabel', '🧪', 8)")
 	if err != nil {
 		t.Fatalf("Failed to create test label: %v", err)
 	}
 
 	// Verify label exists
-	_, err = labelByID(999)
+	_, err = labelByID(context.Background(), 1, 999)
 	if err != nil {
 		t.Fatalf("Test label should exist before deletion: %v", err)
 	}
@@ -1383,7 +1389,7 @@ func TestRemoveLabelSuccess(t *testing.T) {
 	}
 
 	// Verify label is deleted
-	_, err = labelByID(999)
+	_, err = labelByID(context.Background(), 1, 999)
 	if err == nil {
 		t.Error("Label should not exist after deletion")
 	}
@@ -1430,7 +1436,7 @@ func TestRemoveLabelWithRecipes(t *testing.T) {
 	}
 
 	// Verify label is deleted
-	_, err := labelByID(1)
+	_, err := labelByID(context.Background(), 1, 1)
 	if err == nil {
 		t.Error("Label should not exist after deletion")
 	}
@@ -1507,3 +1513,1198 @@ func TestRemoveLabelInvalidID(t *testing.T) {
 		t.Errorf("removeLabel() with invalid ID returned wrong code: got %v want %v", appErr.Code, http.StatusBadRequest)
 	}
 }
+
+func TestMergeLabels(t *testing.T) {
+	setupIntegrationTest()
+	sauce, _ := labelByName(context.Background(), 1, "sauce")
+	sauces, _ := labelByName(context.Background(), 1, "sauces")
+	merge := func(id string, targetID string) (*httptest.ResponseRecorder, *appError) {
+		req := jsonRequest("POST", "/admin/label/"+id+"/merge-into/"+targetID, "")
+		req = mux.SetURLVars(req, map[string]string{"id": id, "target_id": targetID})
+		rr := httptest.NewRecorder()
+		return rr, mergeLabels(rr, req)
+	}
+
+	for _, tc := range []struct {
+		id, targetID string
+		want         int
+	}{
+		{"abc", "32", http.StatusBadRequest},
+		{"44", "abc", http.StatusBadRequest},
+		{"44", "44", http.StatusBadRequest},
+		{"9999", "32", http.StatusNotFound},
+		{"44", "9999", http.StatusNotFound},
+	} {
+		if _, appErr := merge(tc.id, tc.targetID); appErr == nil || appErr.Code != tc.want {
+			t.Errorf("mergeLabels(%s, %s) = %v, want %d", tc.id, tc.targetID, appErr, tc.want)
+		}
+	}
+
+	rr, appErr := merge(strconv.Itoa(sauces.ID), strconv.Itoa(sauce.ID))
+	if appErr != nil {
+		t.Fatalf("mergeLabels() returned appError: %v", appErr)
+	}
+	var target Label
+	json.Unmarshal(rr.Body.Bytes(), &target)
+	if rr.Code != http.StatusOK || target.ID != sauce.ID || !reflect.DeepEqual(target.Aliases, []string{"sauces"}) {
+		t.Errorf("Expected sauce with alias sauces, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Adding the old name finds the label it was merged into
+	rr = httptest.NewRecorder()
+	req := mux.SetURLVars(jsonRequest("PUT", "/admin/label/sauces", ""), map[string]string{"label_name": "sauces"})
+	if appErr := addLabel(rr, req); appErr != nil {
+		t.Fatalf("addLabel() returned appError: %v", appErr)
+	}
+	var added Label
+	json.Unmarshal(rr.Body.Bytes(), &added)
+	if rr.Code != http.StatusOK || added.ID != sauce.ID {
+		t.Errorf("Expected addLabel(sauces) to return sauce with 200, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	entries, _, _ := auditEntries(context.Background(), AuditFilter{Action: "label_merged", Limit: 10})
+	if len(entries) != 1 || entries[0].EntityID != sauces.ID {
+		t.Errorf("Expected one audit entry for merging sauces, got %+v", entries)
+	}
+}
+
+func TestLabelTypeHandlers(t *testing.T) {
+	setupIntegrationTest()
+	call := func(handler func(http.ResponseWriter, *http.Request) *appError, method, id, body string) (*httptest.ResponseRecorder, *appError) {
+		req := mux.SetURLVars(jsonRequest(method, "/admin/label-type/"+id, body), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		return rr, handler(rr, req)
+	}
+
+	rr, appErr := call(createNewLabelType, "POST", "", `{"name": "Season", "displayOrder": 9}`)
+	if appErr != nil {
+		t.Fatalf("createNewLabelType() returned appError: %v", appErr)
+	}
+	var created LabelType
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusCreated || created.Name != "season" || !created.MultiSelect || created.DisplayOrder != 9 {
+		t.Errorf("Expected a multi-select season type with 201, got %d %s", rr.Code, rr.Body.String())
+	}
+	if _, appErr := call(createNewLabelType, "POST", "", `{"name": "season"}`); appErr == nil || appErr.Code != http.StatusConflict {
+		t.Errorf("Expected a duplicate type name to conflict, got %v", appErr)
+	}
+	if _, appErr := call(createNewLabelType, "POST", "", `{"name": ""}`); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty type name to be rejected, got %v", appErr)
+	}
+
+	id := strconv.Itoa(created.ID)
+	if _, appErr := call(editLabelType, "PUT", id, `{"multiSelect": false}`); appErr != nil {
+		t.Fatalf("editLabelType() returned appError: %v", appErr)
+	}
+	if edited, _ := labelTypeByID(context.Background(), 1, created.ID); edited.MultiSelect || edited.Name != "season" {
+		t.Errorf("Expected season to become single-select, got %+v", edited)
+	}
+	if _, appErr := call(editLabelType, "PUT", "9999", `{"name": "other"}`); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected editing a missing type to 404, got %v", appErr)
+	}
+
+	// Grouped labels list the types in display order
+	req := httptest.NewRequest("GET", "/labels/?group=type", nil)
+	rr = httptest.NewRecorder()
+	if appErr := getAllLabels(rr, req); appErr != nil {
+		t.Fatalf("getAllLabels() returned appError: %v", appErr)
+	}
+	var groups []LabelGroup
+	json.Unmarshal(rr.Body.Bytes(), &groups)
+	if len(groups) == 0 || groups[0].Type == nil || groups[0].Type.Name != "course" {
+		t.Errorf("Expected the course group first, got %s", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	if appErr := getAllLabels(rr, httptest.NewRequest("GET", "/labels/?group=icon", nil)); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown grouping to be rejected, got %v", appErr)
+	}
+
+	if _, appErr := call(removeLabelType, "DELETE", id, ""); appErr != nil {
+		t.Fatalf("removeLabelType() returned appError: %v", appErr)
+	}
+	if _, appErr := call(removeLabelType, "DELETE", id, ""); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected deleting a deleted type to 404, got %v", appErr)
+	}
+	entries, _, _ := auditEntries(context.Background(), AuditFilter{EntityType: "label_type", Limit: 10})
+	if len(entries) != 3 {
+		t.Errorf("Expected the create, update and delete to be audited, got %+v", entries)
+	}
+}
+
+// withClaims attaches token claims to a request the way authRequired does
+func withClaims(req *http.Request, claims *CustomClaims) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), claimsContextKey, claims))
+}
+
+func TestAuthRequiredStoresClaims(t *testing.T) {
+	setupAuthConfig()
+
+	tokenString, err := jwtGenerate(2, RoleViewer, 1)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/protected", nil)
+	req.Header.Set("x-access-token", tokenString)
+	rr := httptest.NewRecorder()
+
+	var seen *CustomClaims
+	handler := authRequired(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = claimsFromContext(r.Context())
+	}))
+	handler.ServeHTTP(rr, req)
+
+	if seen == nil {
+		t.Fatal("authRequired() did not store claims in the request context")
+	}
+	if seen.UserID != 2 {
+		t.Errorf("Expected UserID 2 in context claims, got %d", seen.UserID)
+	}
+}
+
+func TestGetCurrentUser(t *testing.T) {
+	setupIntegrationTest()
+
+	req := httptest.NewRequest("GET", "/priv/me/", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	rr := httptest.NewRecorder()
+
+	if appErr := getCurrentUser(rr, req); appErr != nil {
+		t.Fatalf("getCurrentUser() returned appError: %v", appErr)
+	}
+
+	var response map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if response["Username"] != "koko" {
+		t.Errorf("Expected Username 'koko', got %v", response["Username"])
+	}
+	if _, ok := response["HashedPassword"]; ok {
+		t.Error("Profile response must not include the password hash")
+	}
+	if _, ok := response["PlaintextPassword"]; ok {
+		t.Error("Profile response must not include the bootstrapping password")
+	}
+
+	// Token for a user that no longer exists
+	req = httptest.NewRequest("GET", "/priv/me/", nil)
+	req = withClaims(req, &CustomClaims{UserID: 9999})
+	rr = httptest.NewRecorder()
+	appErr := getCurrentUser(rr, req)
+	if appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("getCurrentUser() for unknown user should return 404, got %v", appErr)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	setupIntegrationTest()
+
+	// Wrong current password
+	req := httptest.NewRequest("PUT", "/priv/me/password", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	req.Form = map[string][]string{
+		"currentPassword": {"not my password"},
+		"newPassword":     {"a much better password"},
+	}
+	rr := httptest.NewRecorder()
+	appErr := changePassword(rr, req)
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("changePassword() with wrong current password should return 403, got %v", appErr)
+	}
+
+	// New password too short
+	req = httptest.NewRequest("PUT", "/priv/me/password", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	req.Form = map[string][]string{
+		"currentPassword": {"cooking for mama"},
+		"newPassword":     {"short"},
+	}
+	rr = httptest.NewRecorder()
+	appErr = changePassword(rr, req)
+	if appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("changePassword() with short new password should return 400, got %v", appErr)
+	}
+
+	// Successful change
+	req = httptest.NewRequest("PUT", "/priv/me/password", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	req.Form = map[string][]string{
+		"currentPassword": {"cooking for mama"},
+		"newPassword":     {"a much better password"},
+	}
+	rr = httptest.NewRecorder()
+	if appErr := changePassword(rr, req); appErr != nil {
+		t.Fatalf("changePassword() returned appError: %v", appErr)
+	}
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("changePassword() returned wrong status: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	user, _ := userByID(context.Background(), 2)
+	if err := user.CheckPassword("a much better password"); err != nil {
+		t.Errorf("New password was not stored: %v", err)
+	}
+	if err := user.CheckPassword("cooking for mama"); err == nil {
+		t.Error("Old password should no longer be valid")
+	}
+}
+
+func TestUpdateCurrentUserSettings(t *testing.T) {
+	setupIntegrationTest()
+
+	// Set both preferences
+	req := httptest.NewRequest("PUT", "/priv/me", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	req.Form = map[string][]string{
+		"unitSystem":      {"Metric"},
+		"defaultServings": {"4"},
+	}
+	rr := httptest.NewRecorder()
+	if appErr := updateCurrentUserSettings(rr, req); appErr != nil {
+		t.Fatalf("updateCurrentUserSettings() returned appError: %v", appErr)
+	}
+
+	user, _ := userByID(context.Background(), 2)
+	if user.UnitSystem != "metric" {
+		t.Errorf("Expected unit system 'metric', got %q", user.UnitSystem)
+	}
+	if user.DefaultServings != 4 {
+		t.Errorf("Expected default servings 4, got %d", user.DefaultServings)
+	}
+
+	// Omitted settings are left alone
+	req = httptest.NewRequest("PUT", "/priv/me", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2})
+	req.Form = map[string][]string{
+		"defaultServings": {"6"},
+	}
+	rr = httptest.NewRecorder()
+	if appErr := updateCurrentUserSettings(rr, req); appErr != nil {
+		t.Fatalf("updateCurrentUserSettings() returned appError: %v", appErr)
+	}
+
+	user, _ = userByID(context.Background(), 2)
+	if user.UnitSystem != "metric" {
+		t.Errorf("Unit system should not change, got %q", user.UnitSystem)
+	}
+	if user.DefaultServings != 6 {
+		t.Errorf("Expected default servings 6, got %d", user.DefaultServings)
+	}
+
+	// Invalid values are rejected
+	for _, form := range []map[string][]string{
+		{"unitSystem": {"cubits"}},
+		{"defaultServings": {"lots"}},
+		{"defaultServings": {"-1"}},
+	} {
+		req = httptest.NewRequest("PUT", "/priv/me", nil)
+		req = withClaims(req, &CustomClaims{UserID: 2})
+		req.Form = form
+		rr = httptest.NewRecorder()
+		appErr := updateCurrentUserSettings(rr, req)
+		if appErr == nil || appErr.Code != http.StatusBadRequest {
+			t.Errorf("updateCurrentUserSettings(%v) should return 400, got %v", form, appErr)
+		}
+	}
+}
+
+func TestGetAndRemoveLockouts(t *testing.T) {
+	setupIntegrationTest()
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	createIdentityUser(context.Background(), "https://idp.example", "sub", "outsider", RoleViewer, household.ID)
+
+	recordLoginFailure(context.Background(), lockoutScopeUser, "koko", time.Now())
+	recordLoginFailure(context.Background(), lockoutScopeUser, "outsider", time.Now())
+	recordLoginFailure(context.Background(), lockoutScopeIP, "192.0.2.1", time.Now())
+
+	admin := &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1}
+	list := func() []Lockout {
+		req := withClaims(httptest.NewRequest("GET", "/admin/lockouts/", nil), admin)
+		rr := httptest.NewRecorder()
+		if appErr := getLockouts(rr, req); appErr != nil {
+			t.Fatalf("getLockouts() returned appError: %v", appErr)
+		}
+		var lockouts []Lockout
+		json.NewDecoder(rr.Body).Decode(&lockouts)
+		return lockouts
+	}
+	remove := func(scope string, subject string) (*httptest.ResponseRecorder, *appError) {
+		req := httptest.NewRequest("DELETE", "/admin/lockout/"+scope+"/"+subject, nil)
+		req = mux.SetURLVars(withClaims(req, admin), map[string]string{"scope": scope, "subject": subject})
+		rr := httptest.NewRecorder()
+		return rr, removeLockout(rr, req)
+	}
+
+	// Household admins only see and clear their own members' lockouts
+	if lockouts := list(); len(lockouts) != 1 || lockouts[0].Subject != "koko" {
+		t.Fatalf("Expected only koko's lockout, got %+v", lockouts)
+	}
+	if _, appErr := remove("username", "outsider"); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("removeLockout() for another household's user should return 404, got %v", appErr)
+	}
+	if _, appErr := remove("ip", "192.0.2.1"); appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("removeLockout() for an IP should return 403 to household admins, got %v", appErr)
+	}
+
+	// Usernames are matched case-insensitively
+	rr, appErr := remove("username", "KOKO")
+	if appErr != nil {
+		t.Fatalf("removeLockout() returned appError: %v", appErr)
+	}
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("removeLockout() returned wrong status: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if lockout, _ := lockoutFor(context.Background(), lockoutScopeUser, "koko"); lockout.Failures != 0 {
+		t.Errorf("Expected koko lockout to be cleared, still has %d failures", lockout.Failures)
+	}
+
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM audit_log WHERE action = 'lockout_cleared' AND actor_id = 1")
+	if count != 1 {
+		t.Errorf("Expected lockout clearing to be audited, got %d entries", count)
+	}
+
+	// Clearing again is a 404
+	if _, appErr := remove("username", "koko"); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("removeLockout() for missing lockout should return 404, got %v", appErr)
+	}
+
+	// Unknown scope is a 400
+	if _, appErr := remove("planet", "earth"); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("removeLockout() with bad scope should return 400, got %v", appErr)
+	}
+
+	// Operators see and clear every lockout
+	conf.Operators = []string{"Foo"}
+	if lockouts := list(); len(lockouts) != 2 {
+		t.Errorf("Expected operators to see 2 lockouts, got %+v", lockouts)
+	}
+	if _, appErr := remove("ip", "192.0.2.1"); appErr != nil {
+		t.Errorf("removeLockout() for an IP returned appError to an operator: %v", appErr)
+	}
+	if _, appErr := remove("username", "outsider"); appErr != nil {
+		t.Errorf("removeLockout() for another household's user returned appError to an operator: %v", appErr)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	setupAuthConfig()
+
+	tests := []struct {
+		role     Role
+		perm     Permission
+		wantCode int
+		wantBody string
+	}{
+		{RoleViewer, PermRead, http.StatusOK, "protected resource"},
+		{RoleViewer, PermContribute, http.StatusForbidden, "contributor access required\n"},
+		{RoleContributor, PermContribute, http.StatusOK, "protected resource"},
+		{RoleContributor, PermEdit, http.StatusForbidden, "editor access required\n"},
+		{RoleEditor, PermEdit, http.StatusOK, "protected resource"},
+		{RoleEditor, PermAdmin, http.StatusForbidden, "admin access required\n"},
+		{RoleAdmin, PermAdmin, http.StatusOK, "protected resource"},
+	}
+
+	for _, tt := range tests {
+		tokenString, _ := jwtGenerate(1, tt.role, 1)
+		req := httptest.NewRequest("GET", "/protected", nil)
+		req.Header.Set("x-access-token", tokenString)
+		rr := httptest.NewRecorder()
+
+		handler := requirePermission(tt.perm)(http.HandlerFunc(mockProtectedHandler))
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.wantCode || rr.Body.String() != tt.wantBody {
+			t.Errorf("role %q perm %d: got %d %q, want %d %q",
+				tt.role, tt.perm, rr.Code, rr.Body.String(), tt.wantCode, tt.wantBody)
+		}
+	}
+}
+
+func TestRequirePermissionReusesClaims(t *testing.T) {
+	setupAuthConfig()
+
+	// Claims already placed by an outer middleware are used without a token
+	req := httptest.NewRequest("GET", "/protected", nil)
+	req = withClaims(req, &CustomClaims{UserID: 3, Role: RoleEditor})
+	rr := httptest.NewRecorder()
+
+	handler := requirePermission(PermEdit)(http.HandlerFunc(mockProtectedHandler))
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 using claims from context, got %d", rr.Code)
+	}
+}
+
+func TestEditUserRole(t *testing.T) {
+	setupIntegrationTest()
+
+	req := httptest.NewRequest("PUT", "/admin/user/4/role", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "4"})
+	req.Form = map[string][]string{"role": {"Editor"}}
+	rr := httptest.NewRecorder()
+	if appErr := editUserRole(rr, req); appErr != nil {
+		t.Fatalf("editUserRole() returned appError: %v", appErr)
+	}
+	user, _ := householdUser(context.Background(), 1, 4)
+	if user.Role != RoleEditor {
+		t.Errorf("Expected role editor, got %q", user.Role)
+	}
+
+	req.Form = map[string][]string{"role": {"overlord"}}
+	rr = httptest.NewRecorder()
+	appErr := editUserRole(rr, req)
+	if appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("editUserRole() with unknown role should return 400, got %v", appErr)
+	}
+
+	req = mux.SetURLVars(req, map[string]string{"id": "9999"})
+	req.Form = map[string][]string{"role": {"viewer"}}
+	rr = httptest.NewRecorder()
+	appErr = editUserRole(rr, req)
+	if appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("editUserRole() for unknown user should return 404, got %v", appErr)
+	}
+}
+
+func TestJoinAndSwitchHousehold(t *testing.T) {
+	setupIntegrationTest()
+
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	koko := &CustomClaims{UserID: 2, Role: RoleContributor, HouseholdID: 1}
+
+	// Not a member yet
+	req := httptest.NewRequest("POST", "/priv/household/2/switch", nil)
+	req = mux.SetURLVars(withClaims(req, koko), map[string]string{"id": strconv.Itoa(household.ID)})
+	appErr := switchHousehold(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Fatalf("switchHousehold() for non-member should return 403, got %v", appErr)
+	}
+
+	req = httptest.NewRequest("POST", "/priv/households/join", nil)
+	req = withClaims(req, koko)
+	req.Form = map[string][]string{"code": {"not-a-code"}}
+	appErr = joinHousehold(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("joinHousehold() with bad code should return 404, got %v", appErr)
+	}
+
+	req.Form = map[string][]string{"code": {household.InviteCode}}
+	rr := httptest.NewRecorder()
+	if appErr := joinHousehold(rr, req); appErr != nil {
+		t.Fatalf("joinHousehold() returned appError: %v", appErr)
+	}
+	var joined Household
+	json.NewDecoder(rr.Body).Decode(&joined)
+	if joined.ID != household.ID || joined.InviteCode != "" {
+		t.Errorf("Expected household %d without invite code, got %+v", household.ID, joined)
+	}
+
+	req = httptest.NewRequest("POST", "/priv/household/2/switch", nil)
+	req = mux.SetURLVars(withClaims(req, koko), map[string]string{"id": strconv.Itoa(household.ID)})
+	rr = httptest.NewRecorder()
+	if appErr := switchHousehold(rr, req); appErr != nil {
+		t.Fatalf("switchHousehold() returned appError: %v", appErr)
+	}
+	var body map[string]string
+	json.NewDecoder(rr.Body).Decode(&body)
+	claims, err := jwtExtractClaims(body["token"])
+	if err != nil {
+		t.Fatalf("switchHousehold() returned invalid token: %v", err)
+	}
+	// Joining grants the viewer role there, whatever koko is at home
+	if claims.HouseholdID != household.ID || claims.Role != RoleViewer {
+		t.Errorf("Expected viewer token for household %d, got %+v", household.ID, claims)
+	}
+}
+
+func TestHouseholdScopedHandlers(t *testing.T) {
+	setupIntegrationTest()
+
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	cabin := &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: household.ID}
+
+	// Recipe 1 belongs to the default household
+	req := httptest.NewRequest("GET", "/priv/recipe/1/", nil)
+	req = mux.SetURLVars(withClaims(req, cabin), map[string]string{"id": "1"})
+	if appErr := getRecipeByID(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another household's recipe, got %v", appErr)
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/recipe/1/hard", nil)
+	req = mux.SetURLVars(withClaims(req, cabin), map[string]string{"id": "1"})
+	if appErr := deleteRecipeHard(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 hard-deleting another household's recipe, got %v", appErr)
+	}
+	if labels, _ := labelsByRecipeID(context.Background(), 1, 1); len(labels) == 0 {
+		t.Error("Hard delete from another household removed recipe-label links")
+	}
+
+	req = httptest.NewRequest("DELETE", "/admin/recipe/1/label/1", nil)
+	req = mux.SetURLVars(withClaims(req, cabin), map[string]string{"recipe_id": "1", "label_id": "1"})
+	if appErr := untagRecipe(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 unlabeling another household's recipe, got %v", appErr)
+	}
+	if entries, _, _ := auditEntries(context.Background(), AuditFilter{Action: "recipe_unlabeled", Limit: 10}); len(entries) != 0 {
+		t.Errorf("Expected a refused unlabeling not to be audited, got %+v", entries)
+	}
+
+	req = httptest.NewRequest("PUT", "/admin/user/4/role", nil)
+	req = mux.SetURLVars(withClaims(req, cabin), map[string]string{"id": "4"})
+	req.Form = map[string][]string{"role": {"admin"}}
+	if appErr := editUserRole(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 changing the role of another household's user, got %v", appErr)
+	}
+
+	req = httptest.NewRequest("POST", "/admin/recipe/1/copy/2", nil)
+	req = withClaims(req, &CustomClaims{UserID: 2, Role: RoleEditor, HouseholdID: 1})
+	req = mux.SetURLVars(req, map[string]string{"id": "1", "household_id": strconv.Itoa(household.ID)})
+	appErr := copyRecipeToHousehold(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("copyRecipeToHousehold() into a foreign household should return 403, got %v", appErr)
+	}
+
+	req = httptest.NewRequest("POST", "/admin/recipe/1/copy/2", nil)
+	req = withClaims(req, &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+	req = mux.SetURLVars(req, map[string]string{"id": "1", "household_id": strconv.Itoa(household.ID)})
+	rr := httptest.NewRecorder()
+	if appErr := copyRecipeToHousehold(rr, req); appErr != nil {
+		t.Fatalf("copyRecipeToHousehold() returned appError: %v", appErr)
+	}
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", rr.Code)
+	}
+	recipes, _ := activeRecipes(context.Background(), household.ID, false)
+	if len(recipes) != 1 {
+		t.Errorf("Expected copied recipe in household %d, got %d recipes", household.ID, len(recipes))
+	}
+}
+
+func createTestAPIKey(t *testing.T, claims *CustomClaims, form map[string][]string) string {
+	req := httptest.NewRequest("POST", "/priv/me/api-keys/", nil)
+	req = withClaims(req, claims)
+	req.Form = form
+	rr := httptest.NewRecorder()
+	if appErr := createNewAPIKey(rr, req); appErr != nil {
+		t.Fatalf("createNewAPIKey() returned appError: %v", appErr)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&body)
+	key, _ := body["Key"].(string)
+	if key == "" {
+		t.Fatal("Expected key in response")
+	}
+	if _, ok := body["KeyHash"]; ok {
+		t.Error("Key hash should not be returned")
+	}
+	return key
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	setupIntegrationTest()
+
+	editor := &CustomClaims{UserID: 3, Role: RoleEditor, HouseholdID: 1}
+	readKey := createTestAPIKey(t, editor, map[string][]string{"name": {"thermostat"}})
+	adminKey := createTestAPIKey(t, editor, map[string][]string{"name": {"importer"}, "scope": {"admin"}})
+
+	handler := requirePermission(PermEdit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r.Context())
+		fmt.Fprintf(w, "%d %s", claims.UserID, claims.Role)
+	}))
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{"read key cannot edit", "Bearer " + readKey, http.StatusForbidden},
+		{"admin key has owner's role", "Bearer " + adminKey, http.StatusOK},
+		{"lowercase bearer", "bearer " + adminKey, http.StatusOK},
+		{"unknown key", "Bearer gr_nope", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/admin/recipe/1", nil)
+			req.Header.Set("Authorization", tt.header)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.wantStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+
+	// JWTs are accepted as bearer tokens too
+	tokenStr, _ := jwtGenerate(3, RoleEditor, 1)
+	req := httptest.NewRequest("PUT", "/admin/recipe/1", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected JWT bearer token to be accepted, got %d", rr.Code)
+	}
+
+	keys, _ := apiKeysForUser(context.Background(), 3)
+	if len(keys) != 2 || keys[1].LastUsed == 0 {
+		t.Errorf("Expected admin key's last use to be recorded, got %+v", keys)
+	}
+
+	// Admin keys follow the owner's current role in the key's household
+	setUserRole(context.Background(), 1, 3, RoleViewer)
+	req = httptest.NewRequest("PUT", "/admin/recipe/1", nil)
+	req.Header.Set("Authorization", "Bearer "+adminKey)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected admin key to lose edit access with its owner, got %d", rr.Code)
+	}
+
+	// and stop working once the owner leaves it
+	db.Exec("DELETE FROM household_user WHERE household_id = 1 AND user_id = 3")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected key of a former member to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestAPIKeysCannotChangeAccounts(t *testing.T) {
+	setupIntegrationTest()
+	household, _ := createHousehold(context.Background(), "Cabin", 1)
+	addHouseholdMember(context.Background(), household.ID, 2)
+
+	owner := &CustomClaims{UserID: 2, Role: RoleContributor, HouseholdID: 1}
+	key := createTestAPIKey(t, owner, map[string][]string{"name": {"script"}})
+	claims, appErr := authenticate(bearerRequest(key))
+	if appErr != nil {
+		t.Fatalf("authenticate() returned appError: %v", appErr)
+	}
+
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request) *appError
+		vars    map[string]string
+		form    map[string][]string
+	}{
+		{"switch household", switchHousehold, map[string]string{"id": strconv.Itoa(household.ID)}, nil},
+		{"create household", createNewHousehold, nil, map[string][]string{"name": {"Hideout"}}},
+		{"join household", joinHousehold, nil, map[string][]string{"code": {household.InviteCode}}},
+		{"change password", changePassword, nil, map[string][]string{"currentPassword": {"cooking for mama"}, "newPassword": {"something much longer"}}},
+		{"change settings", updateCurrentUserSettings, nil, map[string][]string{"unitSystem": {"metric"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := withClaims(httptest.NewRequest("POST", "/priv/", nil), claims)
+			req = mux.SetURLVars(req, tt.vars)
+			req.Form = tt.form
+			rr := httptest.NewRecorder()
+			appErr := tt.handler(rr, req)
+			if appErr == nil || appErr.Code != http.StatusForbidden || appErr.ErrCode != "api_key_not_allowed" {
+				t.Errorf("Expected 403 api_key_not_allowed, got %v (%s)", appErr, rr.Body.String())
+			}
+		})
+	}
+
+	user, _ := userByID(context.Background(), 2)
+	if user.UnitSystem != "" {
+		t.Errorf("Expected settings to be unchanged, got %q", user.UnitSystem)
+	}
+	if households, _ := householdsForUser(context.Background(), 2); len(households) != 2 {
+		t.Errorf("Expected memberships to be unchanged, got %+v", households)
+	}
+}
+
+func TestAPIKeyExpiryAndRevocation(t *testing.T) {
+	setupIntegrationTest()
+
+	owner := &CustomClaims{UserID: 2, Role: RoleContributor, HouseholdID: 1}
+	key := createTestAPIKey(t, owner, map[string][]string{"name": {"script"}, "expiresInDays": {"1"}})
+
+	claims, appErr := authenticate(bearerRequest(key))
+	if appErr != nil {
+		t.Fatalf("authenticate() returned appError: %v", appErr)
+	}
+	if claims.UserID != 2 || claims.Role != RoleViewer || claims.APIKeyID == 0 {
+		t.Errorf("Expected read-only claims for user 2, got %+v", claims)
+	}
+
+	// API keys can't be used to manage API keys
+	req := withClaims(httptest.NewRequest("POST", "/priv/me/api-keys/", nil), claims)
+	req.Form = map[string][]string{"name": {"escalate"}, "scope": {"admin"}}
+	appErr = createNewAPIKey(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 creating a key with a key, got %v", appErr)
+	}
+
+	db.Exec("UPDATE api_key SET expires = ? WHERE key_id = ?", time.Now().Add(-time.Minute).Unix(), claims.APIKeyID)
+	_, appErr = authenticate(bearerRequest(key))
+	if appErr == nil || appErr.Message != "API key expired" {
+		t.Errorf("Expected expired key to be rejected, got %v", appErr)
+	}
+
+	// Other users can't revoke someone else's key
+	req = withClaims(httptest.NewRequest("DELETE", "/priv/me/api-keys/1", nil), &CustomClaims{UserID: 1, Role: RoleAdmin})
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(claims.APIKeyID)})
+	appErr = revokeAPIKey(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking another user's key, got %v", appErr)
+	}
+
+	req = withClaims(httptest.NewRequest("DELETE", "/priv/me/api-keys/1", nil), owner)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(claims.APIKeyID)})
+	if appErr := revokeAPIKey(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("revokeAPIKey() returned appError: %v", appErr)
+	}
+	_, appErr = authenticate(bearerRequest(key))
+	if appErr == nil || appErr.Message != "invalid API key" {
+		t.Errorf("Expected revoked key to be rejected, got %v", appErr)
+	}
+
+	req = withClaims(httptest.NewRequest("POST", "/priv/me/api-keys/", nil), owner)
+	req.Form = map[string][]string{"name": {"bad"}, "scope": {"write"}}
+	appErr = createNewAPIKey(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown scope, got %v", appErr)
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/priv/recipes/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestAdminMutationsAreAudited(t *testing.T) {
+	setupIntegrationTest()
+	editor := &CustomClaims{UserID: 3, Role: RoleEditor, HouseholdID: 1}
+
+	req := withClaims(httptest.NewRequest("PUT", "/admin/recipe/1", nil), editor)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req.Form = map[string][]string{"title": {"Audited Chicken"}, "activeTime": {"5"}, "totalTime": {"10"}}
+	if appErr := updateExistingRecipe(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("updateExistingRecipe() returned appError: %v", appErr)
+	}
+
+	req = withClaims(httptest.NewRequest("DELETE", "/admin/recipe/2/hard", nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+	req = mux.SetURLVars(req, map[string]string{"id": "2"})
+	if appErr := deleteRecipeHard(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("deleteRecipeHard() returned appError: %v", appErr)
+	}
+
+	actor := 3
+	entries, _, _ := auditEntries(context.Background(), AuditFilter{ActorID: &actor, EntityType: "recipe", Limit: 10})
+	if len(entries) != 1 || entries[0].Action != "recipe_updated" || entries[0].EntityID != 1 {
+		t.Fatalf("Expected one recipe_updated entry by user 3, got %+v", entries)
+	}
+	var before, after Recipe
+	json.Unmarshal([]byte(entries[0].Before), &before)
+	json.Unmarshal([]byte(entries[0].After), &after)
+	if before.Title != "Grilled Chicken" || after.Title != "Audited Chicken" {
+		t.Errorf("Expected before/after titles, got %q and %q", before.Title, after.Title)
+	}
+
+	entries, _, _ = auditEntries(context.Background(), AuditFilter{Action: "recipe_hard_deleted", Limit: 10})
+	if len(entries) != 1 || entries[0].ActorID != 1 || entries[0].EntityID != 2 || entries[0].After != "" {
+		t.Fatalf("Expected hard delete by user 1 to be audited, got %+v", entries)
+	}
+	json.Unmarshal([]byte(entries[0].Before), &before)
+	if before.Title == "" || len(before.Labels) == 0 {
+		t.Errorf("Expected deleted recipe and its labels in audit entry, got %+v", before)
+	}
+}
+
+func TestGetAuditLog(t *testing.T) {
+	setupIntegrationTest()
+	for i := 0; i < 5; i++ {
+		recordAudit(context.Background(), 1, 1, "recipe_updated", "recipe", i+1, nil, nil)
+	}
+	recordAudit(context.Background(), 1, 2, "note_created", "note", 7, nil, map[string]string{"Note": "hi"})
+	// Another household's entries are never shown
+	recordAudit(context.Background(), 2, 2, "recipe_updated", "recipe", 99, map[string]string{"Body": "secret"}, nil)
+	db.Exec("UPDATE audit_log SET created = ? WHERE action = 'note_created'", time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC).Unix())
+
+	type auditPage struct {
+		Entries []map[string]interface{}
+		Total   int
+		Page    int
+		PerPage int
+	}
+	get := func(query string) (auditPage, *appError) {
+		rr := httptest.NewRecorder()
+		appErr := getAuditLog(rr, httptest.NewRequest("GET", "/admin/audit/?"+query, nil))
+		var page auditPage
+		json.NewDecoder(rr.Body).Decode(&page)
+		return page, appErr
+	}
+
+	page, appErr := get("entity=recipe&per_page=2&page=2")
+	if appErr != nil {
+		t.Fatalf("getAuditLog() returned appError: %v", appErr)
+	}
+	if page.Total != 5 || len(page.Entries) != 2 || page.Page != 2 {
+		t.Errorf("Expected page 2 of 5 recipe entries, got %+v", page)
+	}
+	// Newest first: page 2 holds entities 3 and 2
+	if len(page.Entries) == 2 && page.Entries[0]["EntityID"] != float64(3) {
+		t.Errorf("Expected entity 3 first on page 2, got %v", page.Entries[0]["EntityID"])
+	}
+
+	page, _ = get("user=2")
+	if page.Total != 1 {
+		t.Fatalf("Expected 1 entry for user 2, got %d", page.Total)
+	}
+	after, ok := page.Entries[0]["After"].(map[string]interface{})
+	if !ok || after["Note"] != "hi" {
+		t.Errorf("Expected After to be embedded JSON, got %v", page.Entries[0]["After"])
+	}
+
+	page, _ = get("since=2026-01-15&until=2026-01-15")
+	if page.Total != 1 {
+		t.Errorf("Expected 1 entry on 2026-01-15, got %d", page.Total)
+	}
+
+	for _, query := range []string{"user=me", "since=yesterday", "per_page=0", "page=0"} {
+		if _, appErr := get(query); appErr == nil || appErr.Code != http.StatusBadRequest {
+			t.Errorf("getAuditLog(%s) should return 400, got %v", query, appErr)
+		}
+	}
+}
+
+func jsonRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return withClaims(req, &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+}
+
+func TestCreateRecipeFromJSON(t *testing.T) {
+	setupIntegrationTest()
+
+	body := `{"title": "Shakshuka", "body": "Eggs in sauce", "activeTime": 15, "totalTime": 40,
+		"labels": ["Breakfast", "breakfast", "brand new label"], "notes": ["use feta"]}`
+	rr := httptest.NewRecorder()
+	if appErr := createNewRecipe(rr, jsonRequest("POST", "/admin/recipe/", body)); appErr != nil {
+		t.Fatalf("createNewRecipe() returned appError: %v", appErr)
+	}
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", rr.Code)
+	}
+	var recipe Recipe
+	json.NewDecoder(rr.Body).Decode(&recipe)
+	if recipe.Title != "Shakshuka" || recipe.ActiveTime != 15 || recipe.Time != 40 {
+		t.Errorf("Unexpected recipe: %+v", recipe)
+	}
+
+	labels, _ := labelsByRecipeID(context.Background(), 1, recipe.ID)
+	if len(labels) != 2 {
+		t.Errorf("Expected 2 labels (duplicates merged), got %v", labels)
+	}
+	if _, err := labelByName(context.Background(), 1, "brand new label"); err != nil {
+		t.Errorf("Expected missing label to be created: %v", err)
+	}
+	notes, _ := notesByRecipeID(context.Background(), 1, recipe.ID)
+	if len(notes) != 1 || notes[0].Note != "use feta" {
+		t.Errorf("Expected one note, got %v", notes)
+	}
+}
+
+func TestCreateRecipeFromJSONRejectsBadBodies(t *testing.T) {
+	setupIntegrationTest()
+	existing, _ := activeRecipes(context.Background(), 1, false)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantErr  string
+		fields   []string
+	}{
+		{"unknown field", `{"title": "x", "activeTime": 1, "totalTime": 2, "total_time": 2}`, http.StatusBadRequest, "unknown_field", []string{"total_time"}},
+		{"wrong types", `{"title": "", "activeTime": "soon", "totalTime": 2}`, http.StatusBadRequest, "validation_failed", []string{"title", "activeTime"}},
+		{"missing fields", `{}`, http.StatusBadRequest, "validation_failed", []string{"title", "activeTime", "totalTime"}},
+		{"empty label", `{"title": "x", "activeTime": 1, "totalTime": 2, "labels": [" "]}`, http.StatusBadRequest, "validation_failed", []string{"labels"}},
+		{"trailing data", `{"title": "x", "activeTime": 1, "totalTime": 2} {}`, http.StatusBadRequest, "invalid_request", nil},
+		{"malformed", `{"title": `, http.StatusBadRequest, "invalid_request", nil},
+		{"too large", `{"title": "` + strings.Repeat("x", maxRequestBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appErr := createNewRecipe(httptest.NewRecorder(), jsonRequest("POST", "/admin/recipe/", tt.body))
+			if appErr == nil || appErr.Code != tt.wantCode || appErr.ErrCode != tt.wantErr {
+				t.Fatalf("Expected %d %s, got %+v", tt.wantCode, tt.wantErr, appErr)
+			}
+			var fields validationErrors
+			errors.As(appErr.Error, &fields)
+			var got []string
+			for _, f := range fields {
+				got = append(got, f.Field)
+			}
+			if !reflect.DeepEqual(got, tt.fields) {
+				t.Errorf("Expected invalid fields %v, got %v", tt.fields, got)
+			}
+		})
+	}
+
+	if recipes, _ := activeRecipes(context.Background(), 1, false); len(recipes) != len(existing) {
+		t.Errorf("No recipe should have been created, have %d", len(recipes))
+	}
+}
+
+func TestUpdateRecipeFromJSON(t *testing.T) {
+	setupIntegrationTest()
+
+	recipe, _ := createRecipe(context.Background(), 1, "Soup", "Body", 10, 20, false, []string{"soup", "dinner"}, nil)
+
+	body := `{"title": "Better Soup", "activeTime": 10, "totalTime": 30, "new": true, "labels": ["lunch"]}`
+	req := mux.SetURLVars(jsonRequest("PUT", "/admin/recipe/x", body), map[string]string{"id": strconv.Itoa(recipe.ID)})
+	if appErr := updateExistingRecipe(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("updateExistingRecipe() returned appError: %v", appErr)
+	}
+	updated, _ := recipeByID(context.Background(), 1, recipe.ID, true)
+	if updated.Title != "Better Soup" || !updated.New || updated.Body != "" {
+		t.Errorf("Unexpected recipe after update: %+v", updated)
+	}
+	if len(updated.Labels) != 1 || updated.Labels[0].Label != "lunch" {
+		t.Errorf("Expected labels to be replaced with [lunch], got %v", updated.Labels)
+	}
+
+	// Leaving labels out leaves them alone
+	body = `{"title": "Better Soup", "activeTime": 10, "totalTime": 30}`
+	req = mux.SetURLVars(jsonRequest("PUT", "/admin/recipe/x", body), map[string]string{"id": strconv.Itoa(recipe.ID)})
+	if appErr := updateExistingRecipe(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("updateExistingRecipe() returned appError: %v", appErr)
+	}
+	if labels, _ := labelsByRecipeID(context.Background(), 1, recipe.ID); len(labels) != 1 {
+		t.Errorf("Expected labels to be untouched, got %v", labels)
+	}
+
+	// Notes are only accepted on create
+	body = `{"title": "Better Soup", "activeTime": 10, "totalTime": 30, "notes": ["hi"]}`
+	req = mux.SetURLVars(jsonRequest("PUT", "/admin/recipe/x", body), map[string]string{"id": strconv.Itoa(recipe.ID)})
+	if appErr := updateExistingRecipe(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for notes on update, got %v", appErr)
+	}
+}
+
+func TestJSONBodiesOnOtherEndpoints(t *testing.T) {
+	setupIntegrationTest()
+
+	// An empty icon clears it, a missing field is left alone
+	before, _ := labelByID(context.Background(), 1, 1)
+	req := mux.SetURLVars(jsonRequest("PUT", "/admin/label/id/1", `{"icon": ""}`), map[string]string{"label_id": "1"})
+	if appErr := editLabel(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("editLabel() returned appError: %v", appErr)
+	}
+	after, _ := labelByID(context.Background(), 1, 1)
+	if after.Icon != "" || after.Label != before.Label {
+		t.Errorf("Expected only the icon to be cleared, got %+v", after)
+	}
+
+	req = mux.SetURLVars(jsonRequest("POST", "/admin/recipe/1/note/", `{"text": "from the app"}`), map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	if appErr := createNoteOnRecipe(rr, req); appErr != nil {
+		t.Fatalf("createNoteOnRecipe() returned appError: %v", appErr)
+	}
+	var note Note
+	json.NewDecoder(rr.Body).Decode(&note)
+	if note.Note != "from the app" {
+		t.Errorf("Expected note text from JSON, got %q", note.Note)
+	}
+
+	req = jsonRequest("PUT", "/priv/me", `{"defaultServings": "four"}`)
+	appErr := updateCurrentUserSettings(httptest.NewRecorder(), req)
+	if appErr == nil || appErr.Message != "defaultServings must be an integer" {
+		t.Errorf("Expected the same error as the form path, got %v", appErr)
+	}
+}
+
+func TestPatchRecipe(t *testing.T) {
+	setupIntegrationTest()
+
+	recipe, _ := createRecipe(context.Background(), 1, "Soup", "Simmer", 10, 20, true, []string{"soup"}, nil)
+	patch := func(contentType string, body string) *appError {
+		req := httptest.NewRequest("PATCH", "/admin/recipe/x", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req = withClaims(req, &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(recipe.ID)})
+		return patchRecipe(httptest.NewRecorder(), req)
+	}
+
+	// Editing the title keeps everything else, including the new flag
+	if appErr := patch("application/merge-patch+json", `{"title": "Better Soup"}`); appErr != nil {
+		t.Fatalf("patchRecipe() returned appError: %v", appErr)
+	}
+	got, _ := recipeByID(context.Background(), 1, recipe.ID, true)
+	if got.Title != "Better Soup" || got.Body != "Simmer" || got.ActiveTime != 10 || got.Time != 20 || !got.New || len(got.Labels) != 1 {
+		t.Errorf("Expected only the title to change, got %+v", got)
+	}
+
+	// null removes optional fields
+	if appErr := patch("application/merge-patch+json", `{"body": null, "labels": null, "totalTime": 25}`); appErr != nil {
+		t.Fatalf("patchRecipe() returned appError: %v", appErr)
+	}
+	got, _ = recipeByID(context.Background(), 1, recipe.ID, true)
+	if got.Body != "" || len(got.Labels) != 0 || got.Time != 25 || got.Title != "Better Soup" || !got.New {
+		t.Errorf("Expected body and labels removed, got %+v", got)
+	}
+
+	// Forms work the same way: only the fields sent are touched
+	if appErr := patch("application/x-www-form-urlencoded", "new=&labels=dinner"); appErr != nil {
+		t.Fatalf("patchRecipe() with form returned appError: %v", appErr)
+	}
+	got, _ = recipeByID(context.Background(), 1, recipe.ID, true)
+	if got.New || got.Title != "Better Soup" || len(got.Labels) != 1 || got.Labels[0].Label != "dinner" {
+		t.Errorf("Expected new cleared and labels set, got %+v", got)
+	}
+
+	for _, body := range []string{`{"title": null}`, `{"title": ""}`, `{"activeTime": null}`, `{"activeTime": "x"}`, `{"notes": ["hi"]}`, `{"rating": 5}`} {
+		if appErr := patch("application/merge-patch+json", body); appErr == nil || appErr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %v", body, appErr)
+		}
+	}
+	if after, _ := recipeByID(context.Background(), 1, recipe.ID, true); after.Title != "Better Soup" || after.ActiveTime != 10 {
+		t.Errorf("Rejected patches should not change the recipe, got %+v", after)
+	}
+
+	recipe.ID = 9999
+	if appErr := patch("application/merge-patch+json", `{"title": "x"}`); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing recipe, got %v", appErr)
+	}
+}
+
+func TestIfMatchPreconditions(t *testing.T) {
+	setupIntegrationTest()
+	defer func() { conf.RequireIfMatch = false }()
+
+	recipe, _ := createRecipe(context.Background(), 1, "Stew", "Braise", 20, 120, false, []string{"stew"}, nil)
+	patch := func(ifMatch string, body string) (*httptest.ResponseRecorder, *appError) {
+		req := jsonRequest("PATCH", "/admin/recipe/x", body)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(recipe.ID)})
+		rr := httptest.NewRecorder()
+		return rr, patchRecipe(rr, req)
+	}
+
+	// The ETag from a GET lets exactly one editor through
+	rr := httptest.NewRecorder()
+	req := mux.SetURLVars(jsonRequest("GET", "/admin/recipe/x", ""), map[string]string{"id": strconv.Itoa(recipe.ID)})
+	if appErr := getRecipeByID(rr, req); appErr != nil {
+		t.Fatalf("getRecipeByID() returned appError: %v", appErr)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag != versionETag(recipe.Version) {
+		t.Fatalf("Expected ETag %s, got %q", versionETag(recipe.Version), etag)
+	}
+
+	rr, appErr := patch(etag, `{"title": "Beef Stew"}`)
+	if appErr != nil {
+		t.Fatalf("patchRecipe() with current ETag returned appError: %v", appErr)
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag after the update, still got %s", etag)
+	}
+	if _, appErr := patch(etag, `{"title": "Lamb Stew"}`); appErr == nil || appErr.Code != http.StatusPreconditionFailed || appErr.ErrCode != "version_mismatch" {
+		t.Errorf("Expected 412 version_mismatch for a stale ETag, got %v", appErr)
+	}
+	if got, _ := recipeByID(context.Background(), 1, recipe.ID, false); got.Title != "Beef Stew" {
+		t.Errorf("A stale update should not change the recipe, got title %q", got.Title)
+	}
+
+	for _, ifMatch := range []string{`W/"2"`, "2", `"two"`} {
+		if _, appErr := patch(ifMatch, `{"title": "x"}`); appErr == nil || appErr.Code != http.StatusPreconditionFailed {
+			t.Errorf("Expected 412 for If-Match %s, got %v", ifMatch, appErr)
+		}
+	}
+	if _, appErr := patch("*", `{"title": "Any Stew"}`); appErr != nil {
+		t.Errorf("Expected If-Match * to match any version, got %v", appErr)
+	}
+
+	// Relabeling a recipe changes its version too
+	before, _ := recipeByID(context.Background(), 1, recipe.ID, false)
+	label, _ := createLabel(context.Background(), 1, "winter")
+	req = mux.SetURLVars(jsonRequest("PUT", "/admin/recipe/x/label/y", ""), map[string]string{"recipe_id": strconv.Itoa(recipe.ID), "label_id": strconv.Itoa(label.ID)})
+	req.Header.Set("If-Match", versionETag(before.Version))
+	if appErr := tagRecipe(httptest.NewRecorder(), req); appErr != nil {
+		t.Fatalf("tagRecipe() returned appError: %v", appErr)
+	}
+	if after, _ := recipeByID(context.Background(), 1, recipe.ID, false); after.Version <= before.Version {
+		t.Errorf("Expected tagging to bump the version past %d, got %d", before.Version, after.Version)
+	}
+
+	// Stale deletes are refused as well
+	req = mux.SetURLVars(jsonRequest("DELETE", "/admin/recipe/x", ""), map[string]string{"id": strconv.Itoa(recipe.ID)})
+	req.Header.Set("If-Match", versionETag(before.Version))
+	if appErr := deleteRecipeSoft(httptest.NewRecorder(), req); appErr == nil || appErr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale soft delete, got %v", appErr)
+	}
+
+	conf.RequireIfMatch = true
+	if _, appErr := patch("", `{"title": "x"}`); appErr == nil || appErr.Code != http.StatusPreconditionRequired || appErr.ErrCode != "precondition_required" {
+		t.Errorf("Expected 428 without If-Match when it is required, got %v", appErr)
+	}
+}
+
+func TestUnknownNoteIsNotFound(t *testing.T) {
+	setupIntegrationTest()
+
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request) *appError
+		method  string
+		body    string
+	}{
+		{"edit", editNote, "PUT", `{"text": "gone"}`},
+		{"flag", flagNote, "PUT", ""},
+		{"unflag", unFlagNote, "PUT", ""},
+		{"delete", removeNote, "DELETE", ""},
+	}
+	for _, tt := range tests {
+		for _, ifMatch := range []string{"", versionETag(1)} {
+			t.Run(tt.name+" "+ifMatch, func(t *testing.T) {
+				req := jsonRequest(tt.method, "/admin/note/9999", tt.body)
+				if ifMatch != "" {
+					req.Header.Set("If-Match", ifMatch)
+				}
+				req = mux.SetURLVars(req, map[string]string{"id": "9999"})
+				appErr := tt.handler(httptest.NewRecorder(), req)
+				if appErr == nil || appErr.Code != http.StatusNotFound || appErr.ErrCode != "note_not_found" {
+					t.Errorf("Expected 404 note_not_found, got %v", appErr)
+				}
+			})
+		}
+	}
+
+	var count int
+	db.Get(&count, "SELECT COUNT(*) FROM audit_log")
+	if count != 0 {
+		t.Errorf("Expected nothing to be audited, got %d entries", count)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	setupIntegrationTest()
+
+	rr := httptest.NewRecorder()
+	if appErr := getRecipeList(rr, httptest.NewRequest("GET", "/recipes", nil)); appErr != nil {
+		t.Fatalf("getRecipeList() returned appError: %v", appErr)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" || rr.Body.Len() == 0 {
+		t.Fatalf("Expected an ETag and a body, got ETag %q and %d bytes", etag, rr.Body.Len())
+	}
+
+	req := httptest.NewRequest("GET", "/recipes", nil)
+	req.Header.Set("If-None-Match", `"stale", W/`+etag)
+	rr = httptest.NewRecorder()
+	getRecipeList(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("Expected an empty 304 for a matching ETag, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+
+	createRecipe(context.Background(), defaultHouseholdID, "Toast", "Toast it", 1, 3, false, nil, nil)
+	rr = httptest.NewRecorder()
+	getRecipeList(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("Expected a fresh 200 after the list changed, got %d with ETag %s", rr.Code, rr.Header().Get("ETag"))
+	}
+}
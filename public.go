@@ -1,67 +1,221 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func getRecipeList(w http.ResponseWriter, r *http.Request) *appError {
-	recipes, err := activeRecipes(false)
+	listing, appErr := parseRecipeListing(r, false)
+	if appErr != nil {
+		return appErr
+	}
+	recipes, more, err := recipeList(r.Context(), householdFor(r), listing.opts)
 
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "Problem loading recipes", err}
+		return &appError{http.StatusInternalServerError, "Problem loading recipes", err, "internal_error"}
 	}
-	json.NewEncoder(w).Encode(recipes)
+	writeRecipeListing(w, r, listing, recipes, more)
 	return nil
 }
 
+// getAllLabels lists the household's labels, or with ?group=type, their
+// label types in display order, each with its labels
 func getAllLabels(w http.ResponseWriter, r *http.Request) *appError {
-	var labels []Label
-	q := "SELECT * FROM label"
-	connect()
-	err := db.Select(&labels, q)
+	switch r.URL.Query().Get("group") {
+	case "":
+		labels, err := allLabels(r.Context(), householdFor(r))
+		if err != nil {
+			return &appError{http.StatusInternalServerError, "Problem loading labels", err, "internal_error"}
+		}
+		writeJSONWithETag(w, r, "", labels)
+	case "type":
+		groups, err := labelsByType(r.Context(), householdFor(r))
+		if err != nil {
+			return &appError{http.StatusInternalServerError, "Problem loading labels", err, "internal_error"}
+		}
+		writeJSONWithETag(w, r, "", groups)
+	default:
+		return invalidField("group", `group must be "type"`)
+	}
+	return nil
+}
+
+func getLabelTypes(w http.ResponseWriter, r *http.Request) *appError {
+	types, err := labelTypes(r.Context(), householdFor(r))
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "Problem loading labels", err}
+		return &appError{http.StatusInternalServerError, "Problem loading label types", err, "internal_error"}
 	}
-	json.NewEncoder(w).Encode(labels)
+	writeJSONWithETag(w, r, "", types)
 	return nil
 }
 
 func getLabelsForRecipe(w http.ResponseWriter, r *http.Request) *appError {
 	recipeID, _ := strconv.Atoi(mux.Vars(r)["id"])
-	labels, err := labelsByRecipeID(recipeID)
+	labels, err := labelsByRecipeID(r.Context(), householdFor(r), recipeID)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "Problem retrieving labels for recipe", err}
+		return &appError{http.StatusInternalServerError, "Problem retrieving labels for recipe", err, "internal_error"}
 	}
-	json.NewEncoder(w).Encode(labels)
+	writeJSONWithETag(w, r, "", labels)
 	return nil
 }
 
 func getRecipesForLabel(w http.ResponseWriter, r *http.Request) *appError {
-	return &appError{http.StatusInternalServerError, "unimplemented", nil}
+	return &appError{http.StatusInternalServerError, "unimplemented", nil, "internal_error"}
 }
 
 func login(w http.ResponseWriter, r *http.Request) *appError {
 	// 1 month expiration. TODO Decide on final scheme?
-	username := r.FormValue("username")
-	password := r.FormValue("password")
+	var req loginRequest
+	if appErr := bindRequest(w, r, &req); appErr != nil {
+		return appErr
+	}
+	username := stringValue(req.Username)
+	password := stringValue(req.Password)
+	ip := clientIP(r)
+	now := time.Now()
+
+	// Refuse to even check the password while the username or IP is locked out
+	for _, key := range lockoutKeys(username, ip) {
+		lockout, err := lockoutFor(r.Context(), key[0], key[1])
+		if err != nil {
+			return &appError{http.StatusInternalServerError, "problem checking login lockout", err, "internal_error"}
+		}
+		if lockout.Locked(now) {
+			retryAfter := lockout.LockedUntil - now.Unix()
+			w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			countLogin("password", "locked")
+			return &appError{http.StatusTooManyRequests, "too many failed login attempts; try again later", nil, "too_many_attempts"}
+		}
+	}
 
-	user, err := userByName(username)
+	user, err := userByName(r.Context(), username)
 	if err != nil {
-		return &appError{http.StatusForbidden, "login invalid", err}
+		loginFailed(r.Context(), username, ip, 0, "unknown user", now)
+		return &appError{http.StatusForbidden, "login invalid", err, "invalid_credentials"}
 	}
 	err = user.CheckPassword(password)
 	if err != nil {
-		return &appError{http.StatusForbidden, "login invalid", err}
+		loginFailed(r.Context(), username, ip, user.ID, "bad password", now)
+		return &appError{http.StatusForbidden, "login invalid", err, "invalid_credentials"}
 	}
 
-	tokenStr, err := jwtGenerate(user.ID, user.Administrator)
+	// A successful login wipes the slate clean for this username. The IP's
+	// count stands, or anyone with an account could reset it between rounds
+	// of guessing other users' passwords
+	subject := strings.ToLower(username)
+	if err := clearLockout(r.Context(), lockoutScopeUser, subject); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		requestLog(r).Warn("could not clear login lockout", "scope", lockoutScopeUser, "subject", subject, "error", err)
+	}
+
+	// Upgrade weak or outdated hashes while we have the cleartext in hand
+	if passwordNeedsRehash(user.HashedPassword) {
+		if hash, err := hashPassword(password); err != nil {
+			requestLog(r).Warn("could not rehash password", "user_id", user.ID, "error", err)
+		} else if err := setUserPassword(r.Context(), user.ID, hash); err != nil {
+			requestLog(r).Warn("could not store rehashed password", "user_id", user.ID, "error", err)
+		}
+	}
+
+	householdID, role, appErr := loginHousehold(r.Context(), user, req.Household)
+	if appErr != nil {
+		return appErr
+	}
+
+	tokenStr, err := jwtGenerate(user.ID, role, householdID)
 	if err != nil {
-		return &appError{http.StatusInternalServerError, "could not sign token", err}
+		return &appError{http.StatusInternalServerError, "could not sign token", err, "internal_error"}
 	}
+	countLogin("password", "success")
 	json.NewEncoder(w).Encode(map[string]interface{}{"token": tokenStr})
 	return nil
 }
+
+// loginHousehold picks the household the new token is scoped to: the
+// requested one, if any, or else the first household the user belongs to.
+// It also returns the user's role in that household.
+func loginHousehold(ctx context.Context, user User, requested *int) (int, Role, *appError) {
+	householdID := 0
+	if requested != nil {
+		householdID = *requested
+	} else {
+		households, err := householdsForUser(ctx, user.ID)
+		if err != nil {
+			return 0, "", &appError{http.StatusInternalServerError, "problem loading households", err, "internal_error"}
+		}
+		if len(households) == 0 {
+			return 0, "", &appError{http.StatusForbidden, "user does not belong to any household", nil, "no_household"}
+		}
+		householdID = households[0].ID
+	}
+
+	role, appErr := membershipRole(ctx, householdID, user.ID)
+	if appErr != nil {
+		return 0, "", appErr
+	}
+	return householdID, role, nil
+}
+
+// membershipRole looks up the role a token for the household should carry,
+// refusing users who aren't members of it
+func membershipRole(ctx context.Context, householdID int, userID int) (Role, *appError) {
+	role, err := householdRole(ctx, householdID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", &appError{http.StatusForbidden, "not a member of that household", err, "not_household_member"}
+		}
+		return "", &appError{http.StatusInternalServerError, "problem checking household membership", err, "internal_error"}
+	}
+	return role, nil
+}
+
+// loginFailed counts a failed login against both the username and the
+// client IP and records it in the audit log of every household the user
+// belongs to. Errors are logged rather than returned so the client always
+// sees the same "login invalid" response. Hanging up early doesn't get a
+// client out of being counted.
+func loginFailed(ctx context.Context, username string, ip string, userID int, reason string, now time.Time) {
+	ctx = context.WithoutCancel(ctx)
+	countLogin("password", "failure")
+	details := map[string]interface{}{"username": username, "ip": ip, "reason": reason}
+	for _, key := range lockoutKeys(username, ip) {
+		lockout, err := recordLoginFailure(ctx, key[0], key[1], now)
+		if err != nil {
+			slog.Warn("could not record login failure", "scope", key[0], "subject", key[1], "error", err)
+			continue
+		}
+		if lockout.Locked(now) {
+			details[key[0]+"_locked_until"] = lockout.LockedUntil
+		}
+	}
+
+	// An unknown username belongs to no household, so no audit log could
+	// show it; it still counts towards the IP lockout above
+	if userID == 0 {
+		return
+	}
+	households, err := householdsForUser(ctx, userID)
+	if err != nil {
+		slog.Error("could not record failed login in audit log", "error", err)
+		return
+	}
+	for _, household := range households {
+		if err := recordAudit(ctx, household.ID, 0, "login_failed", "user", userID, nil, details); err != nil {
+			slog.Error("could not record failed login in audit log", "household", household.ID, "error", err)
+		}
+	}
+}
+
+// lockoutKeys returns the (scope, subject) pairs a login attempt counts against
+func lockoutKeys(username string, ip string) [][2]string {
+	return [][2]string{{lockoutScopeUser, strings.ToLower(username)}, {lockoutScopeIP, ip}}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestLoginReturnsTokenWithAdminClaims(t *testing.T) {
@@ -61,6 +65,9 @@ func TestLoginReturnsTokenWithAdminClaims(t *testing.T) {
 	if claims.IsAdmin != true {
 		t.Errorf("Expected IsAdmin true for user foo, got %v", claims.IsAdmin)
 	}
+	if claims.Role != RoleAdmin {
+		t.Errorf("Expected Role admin for user foo, got %q", claims.Role)
+	}
 }
 
 func TestLoginReturnsTokenWithNonAdminClaims(t *testing.T) {
@@ -110,4 +117,225 @@ func TestLoginReturnsTokenWithNonAdminClaims(t *testing.T) {
 	if claims.IsAdmin != false {
 		t.Errorf("Expected IsAdmin false for user koko, got %v", claims.IsAdmin)
 	}
+	if claims.Role != RoleContributor {
+		t.Errorf("Expected Role contributor for user koko, got %q", claims.Role)
+	}
+}
+
+func TestLoginRehashesWeakPassword(t *testing.T) {
+	setupIntegrationTest()
+
+	// Bootstrapped users are hashed with bcrypt.MinCost
+	before, _ := userByName(context.Background(), "foo")
+	if cost, _ := bcrypt.Cost([]byte(before.HashedPassword)); cost != bcrypt.MinCost {
+		t.Fatalf("Expected bootstrapped hash cost %d, got %d", bcrypt.MinCost, cost)
+	}
+
+	form := url.Values{}
+	form.Add("username", "foo")
+	form.Add("password", "bar")
+	req := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	if err := login(w, req); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	after, _ := userByName(context.Background(), "foo")
+	if cost, _ := bcrypt.Cost([]byte(after.HashedPassword)); cost != bcrypt.DefaultCost {
+		t.Errorf("Expected password to be rehashed at cost %d, got %d", bcrypt.DefaultCost, cost)
+	}
+	if err := after.CheckPassword("bar"); err != nil {
+		t.Errorf("Rehashed password no longer matches: %v", err)
+	}
+
+	// Switching to argon2id upgrades on the next login
+	conf.PasswordScheme = "argon2id"
+	req = httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	if err := login(w, req); err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	after, _ = userByName(context.Background(), "foo")
+	if !strings.HasPrefix(after.HashedPassword, argon2idPrefix) {
+		t.Errorf("Expected argon2id hash after login, got %q", after.HashedPassword)
+	}
+	if err := after.CheckPassword("bar"); err != nil {
+		t.Errorf("argon2id password no longer matches: %v", err)
+	}
+}
+
+// attemptLogin posts credentials to the login handler from the given address
+func attemptLogin(username string, password string, remoteAddr string) (*httptest.ResponseRecorder, *appError) {
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("password", password)
+	req := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	return w, login(w, req)
+}
+
+func TestLoginLockoutByUsername(t *testing.T) {
+	setupIntegrationTest()
+	conf.LoginMaxFailures = 3
+
+	// Failures up to the threshold are plain 403s
+	for i := 0; i < 3; i++ {
+		_, appErr := attemptLogin("koko", "wrong", "192.0.2.1:1234")
+		if appErr == nil || appErr.Code != http.StatusForbidden {
+			t.Fatalf("Attempt %d: expected 403, got %v", i+1, appErr)
+		}
+	}
+
+	// The next failure locks the username out
+	attemptLogin("koko", "wrong", "192.0.2.1:1234")
+
+	// Even the right password is refused while locked, from any address
+	w, appErr := attemptLogin("koko", "cooking for mama", "198.51.100.7:1234")
+	if appErr == nil || appErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 while locked out, got %v", appErr)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on 429 response")
+	}
+
+	// Other users are unaffected from a different address
+	if _, appErr := attemptLogin("foo", "bar", "198.51.100.7:1234"); appErr != nil {
+		t.Errorf("Unrelated user should still be able to log in, got %v", appErr)
+	}
+
+	// Once the lockout expires the correct password works and resets the count
+	db.Exec("UPDATE login_lockout SET locked_until = 0")
+	if _, appErr := attemptLogin("koko", "cooking for mama", "192.0.2.1:1234"); appErr != nil {
+		t.Fatalf("Expected login to succeed after lockout expired, got %v", appErr)
+	}
+	lockout, _ := lockoutFor(context.Background(), lockoutScopeUser, "koko")
+	if lockout.Failures != 0 {
+		t.Errorf("Expected failures to reset after successful login, got %d", lockout.Failures)
+	}
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	setupIntegrationTest()
+	conf.LoginMaxFailuresPerIP = 2
+
+	// Spread failures across usernames so only the IP trips
+	for _, username := range []string{"koko", "ashai", "nobody"} {
+		attemptLogin(username, "wrong", "203.0.113.5:5555")
+	}
+
+	_, appErr := attemptLogin("foo", "bar", "203.0.113.5:5555")
+	if appErr == nil || appErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for locked out IP, got %v", appErr)
+	}
+
+	if _, appErr := attemptLogin("foo", "bar", "192.0.2.99:5555"); appErr != nil {
+		t.Errorf("Expected login from another IP to succeed, got %v", appErr)
+	}
+}
+
+func TestLoginSuccessKeepsIPFailures(t *testing.T) {
+	setupIntegrationTest()
+	conf.LoginMaxFailuresPerIP = 2
+
+	attemptLogin("koko", "wrong", "203.0.113.5:5555")
+	if _, appErr := attemptLogin("foo", "bar", "203.0.113.5:5555"); appErr != nil {
+		t.Fatalf("Expected login to succeed, got %v", appErr)
+	}
+	attemptLogin("ashai", "wrong", "203.0.113.5:5555")
+
+	_, appErr := attemptLogin("foo", "bar", "203.0.113.5:5555")
+	if appErr == nil || appErr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a successful login not to reset the IP's failures, got %v", appErr)
+	}
+}
+
+func TestLoginFailureIsAudited(t *testing.T) {
+	setupIntegrationTest()
+	household, _ := createHousehold(context.Background(), "Cabin", 2)
+
+	attemptLogin("koko", "wrong", "192.0.2.1:1234")
+	attemptLogin("nobody", "wrong", "192.0.2.1:1234")
+
+	var entries []AuditEntry
+	db.Select(&entries, "SELECT * FROM audit_log WHERE action = 'login_failed' ORDER BY household_id")
+	if len(entries) != 2 {
+		t.Fatalf("Expected a login_failed entry in each of koko's 2 households, got %d", len(entries))
+	}
+	if entries[0].HouseholdID != 1 || entries[1].HouseholdID != household.ID {
+		t.Errorf("Expected entries in households 1 and %d, got %d and %d", household.ID, entries[0].HouseholdID, entries[1].HouseholdID)
+	}
+	if entries[0].EntityID != 2 {
+		t.Errorf("Expected entry to reference user 2, got %d", entries[0].EntityID)
+	}
+	if !strings.Contains(entries[0].After, "192.0.2.1") {
+		t.Errorf("Expected audit entry to record the client IP, got %q", entries[0].After)
+	}
+
+	// Household admins can see failed logins for their members
+	claims := &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1}
+	req := withClaims(httptest.NewRequest("GET", "/admin/audit/?action=login_failed", nil), claims)
+	rr := httptest.NewRecorder()
+	if appErr := getAuditLog(rr, req); appErr != nil {
+		t.Fatalf("getAuditLog() returned appError: %v", appErr)
+	}
+	var page struct{ Total int }
+	json.NewDecoder(rr.Body).Decode(&page)
+	if page.Total != 1 {
+		t.Errorf("Expected the failed login in household 1's audit log, got %d entries", page.Total)
+	}
+}
+
+func TestLoginSelectsHousehold(t *testing.T) {
+	setupIntegrationTest()
+	household, _ := createHousehold(context.Background(), "Cabin", 2)
+
+	loginWith := func(requested string) (*httptest.ResponseRecorder, *appError) {
+		form := url.Values{}
+		form.Add("username", "koko")
+		form.Add("password", "cooking for mama")
+		if requested != "" {
+			form.Add("household", requested)
+		}
+		req := httptest.NewRequest("POST", "/login/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		return w, login(w, req)
+	}
+	claimsOf := func(w *httptest.ResponseRecorder) *CustomClaims {
+		var response map[string]string
+		json.NewDecoder(w.Body).Decode(&response)
+		claims, err := jwtExtractClaims(response["token"])
+		if err != nil {
+			t.Fatalf("login returned invalid token: %v", err)
+		}
+		return claims
+	}
+
+	// Defaults to the first household the user belongs to, with the role
+	// the user has there
+	w, appErr := loginWith("")
+	if appErr != nil {
+		t.Fatalf("login failed: %v", appErr)
+	}
+	if got := claimsOf(w); got.HouseholdID != 1 || got.Role != RoleContributor {
+		t.Errorf("Expected contributor in default household 1, got %+v", got)
+	}
+
+	w, appErr = loginWith(strconv.Itoa(household.ID))
+	if appErr != nil {
+		t.Fatalf("login failed: %v", appErr)
+	}
+	if got := claimsOf(w); got.HouseholdID != household.ID || got.Role != RoleAdmin {
+		t.Errorf("Expected admin in household %d, got %+v", household.ID, got)
+	}
+
+	_, appErr = loginWith("9999")
+	if appErr == nil || appErr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a household the user is not in, got %v", appErr)
+	}
 }
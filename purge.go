@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// trashRetention is how long deleted recipes stay in the trash
+func trashRetention() time.Duration {
+	days := conf.TrashRetentionDays
+	if days == 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// purgeAt is when a recipe deleted at deletedAt will be purged, or 0 if it
+// never will be
+func purgeAt(deletedAt int64) int64 {
+	if deletedAt == 0 {
+		return 0
+	}
+	return deletedAt + int64(trashRetention()/time.Second)
+}
+
+// purgeExpiredTrash permanently deletes recipes that have been in the trash
+// longer than the retention period, recording each in the audit log
+func purgeExpiredTrash(ctx context.Context, now time.Time) (int, error) {
+	purged, err := purgeTrash(ctx, now.Add(-trashRetention()).Unix())
+	if err != nil {
+		return 0, err
+	}
+	for _, recipe := range purged {
+		if err := recordAudit(ctx, recipe.HouseholdID, 0, "recipe_purged", "recipe", recipe.ID, recipe, nil); err != nil {
+			slog.Error("could not record purge in audit log", "recipe_id", recipe.ID, "error", err)
+		}
+	}
+	return len(purged), nil
+}
+
+// purgeTrashEvery purges the trash now and then every interval until ctx is
+// cancelled
+func purgeTrashEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := purgeExpiredTrash(ctx, time.Now()); err != nil {
+			if ctx.Err() == nil {
+				slog.Error("could not purge trash", "error", err)
+			}
+		} else if n > 0 {
+			slog.Info("purged trash", "recipes", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+	now := time.Now()
+
+	// Recipe 1 was deleted just now, recipe 3 forty days ago, and recipe 4
+	// before deletions were dated
+	if err := softDeleteRecipe(ctx, 1, 1, 0); err != nil {
+		t.Fatalf("softDeleteRecipe() returned error: %v", err)
+	}
+	db.Exec("UPDATE recipe SET deleted = 1, deleted_at = ? WHERE recipe_id = 3", now.Add(-40*24*time.Hour).Unix())
+
+	conf.TrashRetentionDays = 50
+	if n, err := purgeExpiredTrash(ctx, now); err != nil || n != 0 {
+		t.Errorf("Expected nothing purged with 50 days' retention, got %d, %v", n, err)
+	}
+
+	conf.TrashRetentionDays = 0 // the default, 30 days
+	if n, err := purgeExpiredTrash(ctx, now); err != nil || n != 1 {
+		t.Fatalf("Expected 1 recipe purged, got %d, %v", n, err)
+	}
+	if _, err := recipeByID(ctx, 1, 3, false); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected recipe 3 to be purged, got %v", err)
+	}
+	var links int
+	db.QueryRow("SELECT COUNT(*) FROM recipe_label WHERE recipe_id = 3").Scan(&links)
+	if links != 0 {
+		t.Errorf("Expected recipe 3's labels to be purged with it, %d remain", links)
+	}
+	for _, id := range []int{1, 4} {
+		if _, err := recipeByID(ctx, 1, id, false); err != nil {
+			t.Errorf("Expected recipe %d to stay in the trash, got %v", id, err)
+		}
+	}
+
+	entries, _, err := auditEntries(ctx, AuditFilter{Action: "recipe_purged", Limit: 10})
+	if err != nil || len(entries) != 1 || entries[0].EntityID != 3 {
+		t.Errorf("Expected one audit entry for purging recipe 3, got %+v, %v", entries, err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	setupIntegrationTest()
+	ctx := context.Background()
+	call := func(handler func(http.ResponseWriter, *http.Request) *appError, method string, id string) (*httptest.ResponseRecorder, *appError) {
+		req := mux.SetURLVars(jsonRequest(method, "/admin/trash/", ""), map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		return rr, handler(rr, req)
+	}
+
+	for name, handler := range map[string]func(http.ResponseWriter, *http.Request) *appError{
+		"deleteRecipeSoft": deleteRecipeSoft,
+		"recipeRestore":    recipeRestore,
+		"deleteFromTrash":  deleteFromTrash,
+	} {
+		if _, appErr := call(handler, "PUT", "999"); appErr == nil || appErr.Code != http.StatusNotFound {
+			t.Errorf("Expected %s() to return 404 for an unknown recipe, got %v", name, appErr)
+		}
+	}
+
+	if _, appErr := call(deleteRecipeSoft, "DELETE", "1"); appErr != nil {
+		t.Fatalf("deleteRecipeSoft() returned appError: %v", appErr)
+	}
+	rr, appErr := call(getTrash, "GET", "")
+	if appErr != nil {
+		t.Fatalf("getTrash() returned appError: %v", appErr)
+	}
+	var trash []TrashedRecipe
+	if err := json.Unmarshal(rr.Body.Bytes(), &trash); err != nil {
+		t.Fatalf("Could not decode trash %q: %v", rr.Body.String(), err)
+	}
+	if len(trash) != 3 || trash[0].ID != 1 || trash[1].ID != 4 || trash[2].ID != 13 {
+		t.Fatalf("Expected recipes 1, 4 and 13 in the trash, got %+v", trash)
+	}
+	if trash[0].DeletedAt == 0 || trash[0].PurgeAt != trash[0].DeletedAt+30*24*60*60 {
+		t.Errorf("Expected recipe 1 to be purged 30 days after it was deleted, got %+v", trash[0])
+	}
+	if trash[1].PurgeAt != 0 {
+		t.Errorf("Expected an undated deletion never to be purged, got %d", trash[1].PurgeAt)
+	}
+
+	// Only recipes in the trash can be deleted from it
+	if _, appErr := call(deleteFromTrash, "DELETE", "2"); appErr == nil || appErr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a recipe that isn't in the trash, got %v", appErr)
+	}
+	if _, appErr := call(deleteFromTrash, "DELETE", "4"); appErr != nil {
+		t.Errorf("deleteFromTrash() returned appError: %v", appErr)
+	}
+	if _, err := recipeByID(ctx, 1, 4, false); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected recipe 4 to be deleted, got %v", err)
+	}
+
+	if _, appErr := call(recipeRestore, "PUT", "1"); appErr != nil {
+		t.Fatalf("recipeRestore() returned appError: %v", appErr)
+	}
+	if recipe, _ := recipeByID(ctx, 1, 1, false); recipe.Deleted || recipe.DeletedAt != 0 {
+		t.Errorf("Expected recipe 1 to be restored, got %+v", recipe)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxRequestBodyBytes caps the body of every request that reads one
+const maxRequestBodyBytes = 1 << 20
+
+// Request bodies. Every field is a pointer so handlers can tell a field the
+// client left out from one it sent empty. The json tag names the field in
+// both JSON bodies and forms; `form:"-"` fields can only be sent as JSON.
+
+type recipeRequest struct {
+	Title      *string   `json:"title"`
+	Body       *string   `json:"body"`
+	ActiveTime *int      `json:"activeTime"`
+	TotalTime  *int      `json:"totalTime"`
+	New        *bool     `json:"new"`
+	Labels     *[]string `json:"labels"`
+	Notes      *[]string `json:"notes" form:"-"`
+
+	null map[string]bool // fields a JSON body set to null
+}
+
+func (req *recipeRequest) setNull(field string) {
+	if req.null == nil {
+		req.null = make(map[string]bool)
+	}
+	req.null[field] = true
+}
+
+// nullable request structs want to know which fields a JSON body set to
+// null, which JSON Merge Patch uses to mean "remove"
+type nullable interface {
+	setNull(field string)
+}
+
+type noteRequest struct {
+	Text *string `json:"text"`
+}
+
+type labelRequest struct {
+	Label    *string `json:"label"`
+	Icon     *string `json:"icon"`
+	Type     *string `json:"type"`
+	ParentID *int    `json:"parentId"`
+}
+
+type labelTypeRequest struct {
+	Name         *string `json:"name"`
+	Icon         *string `json:"icon"`
+	DisplayOrder *int    `json:"displayOrder"`
+	MultiSelect  *bool   `json:"multiSelect"`
+}
+
+// apply returns labelType with the fields the request sent
+func (req labelTypeRequest) apply(labelType LabelType) LabelType {
+	if req.Name != nil {
+		labelType.Name = *req.Name
+	}
+	if req.Icon != nil {
+		labelType.Icon = *req.Icon
+	}
+	if req.DisplayOrder != nil {
+		labelType.DisplayOrder = *req.DisplayOrder
+	}
+	if req.MultiSelect != nil {
+		labelType.MultiSelect = *req.MultiSelect
+	}
+	return labelType
+}
+
+type loginRequest struct {
+	Username  *string `json:"username"`
+	Password  *string `json:"password"`
+	Household *int    `json:"household"`
+}
+
+type passwordRequest struct {
+	CurrentPassword *string `json:"currentPassword"`
+	NewPassword     *string `json:"newPassword"`
+}
+
+type settingsRequest struct {
+	UnitSystem      *string `json:"unitSystem"`
+	DefaultServings *int    `json:"defaultServings"`
+}
+
+type roleRequest struct {
+	Role *string `json:"role"`
+}
+
+type apiKeyRequest struct {
+	Name          *string `json:"name"`
+	Scope         *string `json:"scope"`
+	ExpiresInDays *int    `json:"expiresInDays"`
+}
+
+type householdRequest struct {
+	Name *string `json:"name"`
+}
+
+type joinRequest struct {
+	Code *string `json:"code"`
+}
+
+// bindRequest fills dst, a pointer to one of the request structs above, from
+// the request body. JSON bodies are decoded strictly: unknown fields and
+// trailing data are rejected. Any other body is read as form values. Both
+// paths report bad values as the same field-level validation errors.
+func bindRequest(w http.ResponseWriter, r *http.Request, dst interface{}) *appError {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	}
+	if isJSONRequest(r) {
+		return bindJSON(r, dst)
+	}
+	return bindForm(r, dst)
+}
+
+// isJSONRequest reports whether the Content-Type says the body is JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func bindJSON(r *http.Request, dst interface{}) *appError {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return jsonBodyError(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return jsonBodyError(err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return &appError{http.StatusBadRequest, "request body must be a single JSON object", err, "invalid_request"}
+	}
+
+	if n, ok := dst.(nullable); ok {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return jsonBodyError(err)
+		}
+		for name, value := range fields {
+			if string(value) == "null" {
+				n.setNull(name)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonBodyError turns a decoding error into the error a client can act on
+func jsonBodyError(err error) *appError {
+	var tooLarge *http.MaxBytesError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &appError{http.StatusRequestEntityTooLarge, "request body too large", err, "body_too_large"}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return invalidField(typeErr.Field, fmt.Sprintf("%s must be %s", typeErr.Field, describeKind(typeErr.Type.Kind())))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		msg := fmt.Sprintf("unknown field %q", field)
+		return &appError{http.StatusBadRequest, msg, validationErrors{{field, msg}}, "unknown_field"}
+	case errors.Is(err, io.EOF):
+		return &appError{http.StatusBadRequest, "request body is required", err, "invalid_request"}
+	default:
+		return &appError{http.StatusBadRequest, "invalid JSON body", err, "invalid_request"}
+	}
+}
+
+func describeKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int64:
+		return "an integer"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice:
+		return "a list"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	default:
+		return "a " + kind.String()
+	}
+}
+
+// bindForm sets each field of dst whose name appears in the form. Booleans
+// follow checkbox rules: any non-empty value is true.
+func bindForm(r *http.Request, dst interface{}) *appError {
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(maxRequestBodyBytes)
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &appError{http.StatusRequestEntityTooLarge, "request body too large", err, "body_too_large"}
+		}
+		return &appError{http.StatusBadRequest, "invalid form data", err, "invalid_request"}
+	}
+
+	var invalid validationErrors
+	v := reflect.ValueOf(dst).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if !field.IsExported() || field.Tag.Get("form") == "-" || !r.Form.Has(name) {
+			continue
+		}
+		value := reflect.New(field.Type.Elem())
+		switch value.Elem().Kind() {
+		case reflect.String:
+			value.Elem().SetString(r.Form.Get(name))
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(r.Form.Get(name)))
+			if err != nil {
+				invalid.add(name, name+" must be an integer")
+				continue
+			}
+			value.Elem().SetInt(int64(n))
+		case reflect.Bool:
+			value.Elem().SetBool(r.Form.Get(name) != "")
+		case reflect.Slice:
+			value.Elem().Set(reflect.ValueOf(r.Form[name]))
+		default:
+			panic(fmt.Sprintf("bindForm: unsupported field type %v", field.Type))
+		}
+		v.Field(i).Set(value)
+	}
+	return invalid.appError()
+}
+
+// stringValue dereferences an optional string, defaulting to ""
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// validate checks the fields recipe create and update share, reporting every
+// invalid one in field order, along with any bindErr already found. Label
+// names are normalized like addLabel's.
+func (req *recipeRequest) validate(bindErr *appError) *appError {
+	var invalid validationErrors
+	if bindErr != nil {
+		if bindErr.ErrCode != "validation_failed" {
+			return bindErr
+		}
+		errors.As(bindErr.Error, &invalid)
+	}
+	if stringValue(req.Title) == "" {
+		invalid.add("title", "title is required")
+	}
+	if req.ActiveTime == nil && !invalid.has("activeTime") {
+		invalid.add("activeTime", "activeTime must be an integer")
+	}
+	if req.TotalTime == nil && !invalid.has("totalTime") {
+		invalid.add("totalTime", "totalTime must be an integer")
+	}
+	req.validateLists(&invalid)
+	invalid.sortBy(reflect.TypeOf(*req))
+	return invalid.appError()
+}
+
+// validatePatch is validate for partial updates: only the fields sent are
+// checked, and the required ones can't be removed
+func (req *recipeRequest) validatePatch(bindErr *appError) *appError {
+	var invalid validationErrors
+	if bindErr != nil {
+		if bindErr.ErrCode != "validation_failed" {
+			return bindErr
+		}
+		errors.As(bindErr.Error, &invalid)
+	}
+	if req.null["title"] || (req.Title != nil && *req.Title == "") {
+		invalid.add("title", "title is required")
+	}
+	for _, field := range []string{"activeTime", "totalTime"} {
+		if req.null[field] {
+			invalid.add(field, field+" must be an integer")
+		}
+	}
+	if req.Notes != nil || req.null["notes"] {
+		invalid.add("notes", "notes can only be sent when creating a recipe")
+	}
+	req.validateLists(&invalid)
+	invalid.sortBy(reflect.TypeOf(*req))
+	return invalid.appError()
+}
+
+// validateLists checks labels and notes, normalizing label names like
+// addLabel does and dropping duplicates
+func (req *recipeRequest) validateLists(invalid *validationErrors) {
+	if req.Labels != nil {
+		seen := make(map[string]bool)
+		labels := []string{}
+		for _, name := range *req.Labels {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				invalid.add("labels", "labels must not be empty")
+				break
+			}
+			if !seen[name] {
+				seen[name] = true
+				labels = append(labels, name)
+			}
+		}
+		req.Labels = &labels
+	}
+	if req.Notes != nil {
+		for _, text := range *req.Notes {
+			if strings.TrimSpace(text) == "" {
+				invalid.add("notes", "notes must not be empty")
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBindFormMatchesJSON(t *testing.T) {
+	form := url.Values{
+		"title":      {"Toast"},
+		"activeTime": {"2"},
+		"totalTime":  {"5"},
+		"new":        {"on"},
+		"labels":     {"breakfast", "quick"},
+		"notes":      {"ignored: JSON only"},
+	}
+	formReq := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	formReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var fromForm recipeRequest
+	if appErr := bindRequest(httptest.NewRecorder(), formReq, &fromForm); appErr != nil {
+		t.Fatalf("bindRequest() with form returned appError: %v", appErr)
+	}
+
+	jsonReq := httptest.NewRequest("POST", "/", strings.NewReader(`{"title": "Toast", "activeTime": 2, "totalTime": 5, "new": true, "labels": ["breakfast", "quick"]}`))
+	jsonReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var fromJSON recipeRequest
+	if appErr := bindRequest(httptest.NewRecorder(), jsonReq, &fromJSON); appErr != nil {
+		t.Fatalf("bindRequest() with JSON returned appError: %v", appErr)
+	}
+
+	for _, req := range []recipeRequest{fromForm, fromJSON} {
+		if *req.Title != "Toast" || *req.ActiveTime != 2 || *req.TotalTime != 5 || !*req.New {
+			t.Errorf("Unexpected scalar fields: %+v", req)
+		}
+		if len(*req.Labels) != 2 || (*req.Labels)[1] != "quick" {
+			t.Errorf("Unexpected labels: %v", *req.Labels)
+		}
+		if req.Body != nil || req.Notes != nil {
+			t.Errorf("Fields not sent should stay nil, got body %v notes %v", req.Body, req.Notes)
+		}
+	}
+}
+
+func TestBindFormReportsEveryBadInteger(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", strings.NewReader("activeTime=soon&totalTime=later"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var dst recipeRequest
+	appErr := dst.validate(bindRequest(httptest.NewRecorder(), req, &dst))
+	if appErr == nil || appErr.ErrCode != "validation_failed" {
+		t.Fatalf("Expected validation_failed, got %v", appErr)
+	}
+	fields := appErr.Error.(validationErrors)
+	if len(fields) != 3 || fields[0].Field != "title" || fields[1].Field != "activeTime" || fields[2].Field != "totalTime" {
+		t.Errorf("Expected title, activeTime and totalTime in order, got %v", fields)
+	}
+}
+
+func TestIsJSONRequest(t *testing.T) {
+	tests := map[string]bool{
+		"":                                  false,
+		"application/x-www-form-urlencoded": false,
+		"multipart/form-data; boundary=x":   false,
+		"application/json":                  true,
+		"application/json; charset=utf-8":   true,
+		"application/merge-patch+json":      true,
+	}
+	for contentType, want := range tests {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.Header.Set("Content-Type", contentType)
+		if got := isJSONRequest(req); got != want {
+			t.Errorf("isJSONRequest(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestBindMultipartForm(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("text", "sent by curl -F")
+	mw.Close()
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var dst noteRequest
+	if appErr := bindRequest(httptest.NewRecorder(), req, &dst); appErr != nil {
+		t.Fatalf("bindRequest() returned appError: %v", appErr)
+	}
+	if dst.Text == nil || *dst.Text != "sent by curl -F" {
+		t.Errorf("Expected text from multipart form, got %v", dst.Text)
+	}
+}
@@ -0,0 +1,23 @@
+-- Migration: Add personal API keys
+-- Date: 2026-10-19
+-- Purpose: Long-lived, revocable credentials for scripts and integrations.
+--          Only a SHA-256 hash of each key is stored.
+
+CREATE TABLE IF NOT EXISTS `api_key` (
+    `key_id` bigint(20) NOT NULL AUTO_INCREMENT,
+    `user_id` bigint(20) NOT NULL,
+    `household_id` int(11) NOT NULL,
+    `name` varchar(63) NOT NULL,
+    `prefix` varchar(15) NOT NULL,
+    `key_hash` char(64) NOT NULL,
+    `scope` varchar(10) NOT NULL,
+    `created` bigint(20) NOT NULL,
+    `expires` bigint(20) NOT NULL DEFAULT 0,
+    `last_used` bigint(20) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`key_id`),
+    UNIQUE KEY `key_hash` (`key_hash`),
+    KEY `user` (`user_id`)
+);
+
+-- Verification query (run after migration to confirm)
+-- SELECT key_id, user_id, name, prefix, scope, expires, last_used FROM api_key;
@@ -0,0 +1,46 @@
+-- Migration: Scope the audit log to households
+-- Date: 2026-10-19
+-- Purpose: GET /admin/audit/ showed every household's entries, including
+--          the before/after state of other households' recipes. Entries now
+--          record the household they belong to, and admins only see their
+--          own household's. Brings the schema to version 6.
+--          Existing entries are assigned to the household that owns the
+--          recipe, label, note or label type they touched, where it still
+--          exists; the rest (e.g. deleted recipes, users, failed logins)
+--          stay at household 0 and are no longer shown by the API.
+
+-- Add household_id column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'audit_log'
+  AND COLUMN_NAME = 'household_id';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE audit_log ADD COLUMN household_id int(11) NOT NULL DEFAULT 0 AFTER audit_id, ADD KEY household (household_id, audit_id)',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+UPDATE audit_log JOIN recipe ON recipe.recipe_id = audit_log.entity_id
+SET audit_log.household_id = recipe.household_id
+WHERE audit_log.household_id = 0 AND audit_log.entity_type = 'recipe';
+
+UPDATE audit_log JOIN label ON label.label_id = audit_log.entity_id
+SET audit_log.household_id = label.household_id
+WHERE audit_log.household_id = 0 AND audit_log.entity_type = 'label';
+
+UPDATE audit_log JOIN note ON note.note_id = audit_log.entity_id
+SET audit_log.household_id = note.household_id
+WHERE audit_log.household_id = 0 AND audit_log.entity_type = 'note';
+
+UPDATE audit_log JOIN label_type ON label_type.label_type_id = audit_log.entity_id
+SET audit_log.household_id = label_type.household_id
+WHERE audit_log.household_id = 0 AND audit_log.entity_type = 'label_type';
+
+UPDATE schema_version SET version = 6 WHERE version < 6;
+
+-- Verification query (run after migration to confirm)
+-- SELECT household_id, entity_type, COUNT(*) FROM audit_log GROUP BY household_id, entity_type;
@@ -0,0 +1,69 @@
+-- Migration: Add foreign keys from recipe_label and note to recipe and label
+-- Date: 2026-10-19
+-- Purpose: Deleting a recipe or label cascades to its label links and notes,
+--          so they can no longer be orphaned. Run after
+--          migration_add_schema_version.sql; it brings the schema to version 2.
+--          Orphaned rows are deleted first, since MySQL won't add a foreign
+--          key that existing rows violate. `gorecipes --fsck` beforehand
+--          shows what will go.
+
+DELETE FROM recipe_label
+WHERE NOT EXISTS (SELECT 1 FROM recipe WHERE recipe.recipe_id = recipe_label.recipe_id)
+   OR NOT EXISTS (SELECT 1 FROM label WHERE label.label_id = recipe_label.label_id);
+
+DELETE FROM note
+WHERE NOT EXISTS (SELECT 1 FROM recipe WHERE recipe.recipe_id = note.recipe_id);
+
+-- Foreign key columns must match recipe.recipe_id's type exactly
+ALTER TABLE recipe_label MODIFY recipe_id int(11) NOT NULL;
+ALTER TABLE note MODIFY recipe_id int(11) NOT NULL;
+
+-- Add recipe_label -> recipe if it doesn't exist (idempotent check)
+SET @fk_exists = 0;
+SELECT COUNT(*) INTO @fk_exists
+FROM information_schema.TABLE_CONSTRAINTS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe_label'
+  AND CONSTRAINT_NAME = 'recipe_label_recipe';
+
+SET @query = IF(@fk_exists = 0,
+    'ALTER TABLE recipe_label ADD CONSTRAINT recipe_label_recipe FOREIGN KEY (recipe_id) REFERENCES recipe (recipe_id) ON DELETE CASCADE',
+    'SELECT ''Foreign key already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Add recipe_label -> label if it doesn't exist (idempotent check)
+SET @fk_exists = 0;
+SELECT COUNT(*) INTO @fk_exists
+FROM information_schema.TABLE_CONSTRAINTS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe_label'
+  AND CONSTRAINT_NAME = 'recipe_label_label';
+
+SET @query = IF(@fk_exists = 0,
+    'ALTER TABLE recipe_label ADD CONSTRAINT recipe_label_label FOREIGN KEY (label_id) REFERENCES label (label_id) ON DELETE CASCADE',
+    'SELECT ''Foreign key already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Add note -> recipe if it doesn't exist (idempotent check)
+SET @fk_exists = 0;
+SELECT COUNT(*) INTO @fk_exists
+FROM information_schema.TABLE_CONSTRAINTS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'note'
+  AND CONSTRAINT_NAME = 'note_recipe';
+
+SET @query = IF(@fk_exists = 0,
+    'ALTER TABLE note ADD CONSTRAINT note_recipe FOREIGN KEY (recipe_id) REFERENCES recipe (recipe_id) ON DELETE CASCADE',
+    'SELECT ''Foreign key already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+UPDATE schema_version SET version = 2 WHERE version < 2;
+
+-- Verification query (run after migration to confirm)
+-- SELECT CONSTRAINT_NAME, TABLE_NAME FROM information_schema.REFERENTIAL_CONSTRAINTS WHERE CONSTRAINT_SCHEMA = DATABASE();
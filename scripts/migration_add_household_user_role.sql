@@ -0,0 +1,51 @@
+-- Migration: Move user roles onto household membership
+-- Date: 2026-10-19
+-- Purpose: A user's role was stored once on the user, so an admin of one
+--          household who joined another was an admin there too. Roles now
+--          live on household_user, one per membership. Brings the schema
+--          to version 7.
+--          Existing memberships keep the role the user had; review them
+--          afterwards, since that may grant more than intended in
+--          households the user joined.
+
+-- Add role column to household_user if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'household_user'
+  AND COLUMN_NAME = 'role';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE household_user ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT ''viewer''',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Carry over existing roles, then drop the old column
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'user'
+  AND COLUMN_NAME = 'role';
+
+SET @query = IF(@col_exists = 1,
+    'UPDATE household_user JOIN user USING (user_id) SET household_user.role = user.role',
+    'SELECT ''Column already dropped'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @query = IF(@col_exists = 1,
+    'ALTER TABLE user DROP COLUMN role',
+    'SELECT ''Column already dropped'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+UPDATE schema_version SET version = 7 WHERE version < 7;
+
+-- Verification query (run after migration to confirm)
+-- SELECT household_id, user_id, role FROM household_user ORDER BY household_id, user_id;
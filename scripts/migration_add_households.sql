@@ -0,0 +1,93 @@
+-- Migration: Add households (multi-family tenancy)
+-- Date: 2026-10-19
+-- Purpose: Let one deployment serve several families. Recipes, labels and
+--          notes belong to a household; users belong to one or more.
+--          Everything that exists today moves into household 1.
+
+CREATE TABLE IF NOT EXISTS `household` (
+    `household_id` int(11) NOT NULL AUTO_INCREMENT,
+    `name` varchar(63) NOT NULL,
+    `invite_code` varchar(32) NOT NULL,
+    PRIMARY KEY (`household_id`),
+    UNIQUE KEY `invite_code` (`invite_code`)
+);
+
+CREATE TABLE IF NOT EXISTS `household_user` (
+    `household_id` int(11) NOT NULL,
+    `user_id` bigint(20) NOT NULL,
+    PRIMARY KEY (`household_id`, `user_id`),
+    KEY `user` (`user_id`)
+);
+
+-- The existing family becomes household 1. Rotate the invite code with
+-- PUT /admin/household/invite before handing it out.
+INSERT IGNORE INTO household (household_id, name, invite_code)
+VALUES (1, 'Home', SUBSTRING(MD5(RAND()), 1, 16));
+
+INSERT IGNORE INTO household_user (household_id, user_id)
+SELECT 1, user_id FROM user;
+
+-- Add household_id to recipe, label and note if they don't have it
+-- (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe'
+  AND COLUMN_NAME = 'household_id';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE recipe ADD COLUMN household_id INT(11) NOT NULL DEFAULT 1 AFTER recipe_id',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'label'
+  AND COLUMN_NAME = 'household_id';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE label ADD COLUMN household_id INT(11) NOT NULL DEFAULT 1 AFTER label_id',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'note'
+  AND COLUMN_NAME = 'household_id';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE note ADD COLUMN household_id INT(11) NOT NULL DEFAULT 1 AFTER note_id',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Label names only need to be unique within a household
+SET @key_exists = 0;
+SELECT COUNT(*) INTO @key_exists
+FROM information_schema.STATISTICS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'label'
+  AND INDEX_NAME = 'label'
+  AND COLUMN_NAME = 'household_id';
+
+SET @query = IF(@key_exists = 0,
+    'ALTER TABLE label DROP KEY label, ADD KEY label (household_id, label)',
+    'SELECT ''Key already updated'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Verification queries (run after migration to confirm)
+-- SELECT * FROM household;
+-- SELECT household_id, COUNT(*) FROM recipe GROUP BY household_id;
+-- SELECT household_id, COUNT(*) FROM household_user GROUP BY household_id;
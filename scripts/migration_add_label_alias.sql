@@ -0,0 +1,24 @@
+-- Migration: Add label aliases
+-- Date: 2026-10-19
+-- Purpose: Merging a label into another (POST /admin/label/{id}/merge-into/{target_id})
+--          keeps the merged label's name as an alias, so looking it up or
+--          adding it again finds the label it was merged into. Brings the
+--          schema to version 4.
+
+CREATE TABLE IF NOT EXISTS `label_alias` (
+    `household_id` int(11) NOT NULL,
+    `alias` varchar(255) NOT NULL,
+    `label_id` int(11) NOT NULL,
+    PRIMARY KEY (`household_id`, `alias`),
+    KEY `label` (`label_id`),
+    CONSTRAINT `label_alias_label` FOREIGN KEY (`label_id`) REFERENCES `label` (`label_id`) ON DELETE CASCADE
+);
+
+UPDATE schema_version SET version = 4 WHERE version < 4;
+
+-- Known duplicates and typos to merge through the API once this is deployed
+-- (see migration_add_label_icon.sql): lamp (39) into lamb (5), sauces (44)
+-- into sauce (32), and one of soup (42) and soupstew (10) into the other.
+
+-- Verification query (run after migration to confirm)
+-- SELECT label_alias.alias, label.label FROM label_alias JOIN label USING (label_id);
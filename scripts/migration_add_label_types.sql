@@ -0,0 +1,84 @@
+-- Migration: Replace free-text label types with managed label types, and add
+--            parent labels
+-- Date: 2026-10-19
+-- Purpose: label.type was free text, so "protein", "Protein" and "proteins"
+--          could all coexist. Each household's types now live in label_type
+--          (with a display order, icon and single- or multi-select flag for
+--          the filter sidebar) and labels refer to one by label.type_id.
+--          label.parent_id nests labels, e.g. chicken and turkey under
+--          poultry. Brings the schema to version 5.
+--          Existing types become label types, matched case-insensitively;
+--          check for near-duplicates like "proteins" before running:
+--          SELECT household_id, type, COUNT(*) FROM label GROUP BY household_id, type;
+
+CREATE TABLE IF NOT EXISTS `label_type` (
+    `label_type_id` int(11) NOT NULL AUTO_INCREMENT,
+    `household_id` int(11) NOT NULL DEFAULT 1,
+    `name` varchar(20) NOT NULL,
+    `icon` varchar(255) NOT NULL DEFAULT '',
+    `display_order` int(11) NOT NULL DEFAULT 0,
+    `multi_select` BOOLEAN NOT NULL DEFAULT 1,
+    `version` int(11) NOT NULL DEFAULT 1,
+    PRIMARY KEY (`label_type_id`),
+    UNIQUE KEY `name` (`household_id`, `name`)
+);
+
+-- Add type_id and parent_id columns if they don't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'label'
+  AND COLUMN_NAME = 'type_id';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE label ADD COLUMN type_id int(11) NOT NULL DEFAULT 0, ADD COLUMN parent_id int(11) NOT NULL DEFAULT 0, ADD KEY parent (parent_id)',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Turn the old type column into label types and drop it, if it's still there
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'label'
+  AND COLUMN_NAME = 'type';
+
+SET @query = IF(@col_exists = 1,
+    'INSERT IGNORE INTO label_type (household_id, name) SELECT DISTINCT household_id, LOWER(type) FROM label WHERE type != ''''',
+    'SELECT ''Types already migrated'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @query = IF(@col_exists = 1,
+    'UPDATE label JOIN label_type ON label_type.household_id = label.household_id AND label_type.name = LOWER(label.type) SET label.type_id = label_type.label_type_id',
+    'SELECT ''Types already migrated'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @query = IF(@col_exists = 1,
+    'ALTER TABLE label DROP COLUMN type',
+    'SELECT ''Types already migrated'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Sidebar order and icons for the types in migration_add_label_type.sql;
+-- adjust through PUT /admin/label-type/{id} afterwards
+UPDATE label_type SET display_order = 1, icon = '🍽️', multi_select = 0 WHERE name = 'course' AND display_order = 0;
+UPDATE label_type SET display_order = 2, icon = '🍖' WHERE name = 'protein' AND display_order = 0;
+UPDATE label_type SET display_order = 3, icon = '🥘' WHERE name = 'dish' AND display_order = 0;
+UPDATE label_type SET display_order = 4, icon = '🌍' WHERE name = 'cuisine' AND display_order = 0;
+UPDATE label_type SET display_order = 5, icon = '🥗' WHERE name = 'dietary' AND display_order = 0;
+UPDATE label_type SET display_order = 6, icon = '🧂' WHERE name = 'ingredient' AND display_order = 0;
+UPDATE label_type SET display_order = 7, icon = '🔪' WHERE name = 'preparation' AND display_order = 0;
+UPDATE label_type SET display_order = 8, icon = '⭐' WHERE name = 'attribute' AND display_order = 0;
+
+UPDATE schema_version SET version = 5 WHERE version < 5;
+
+-- Verification query (run after migration to confirm)
+-- SELECT label_type.name, COUNT(label.label_id) FROM label_type LEFT JOIN label ON label.type_id = label_type.label_type_id GROUP BY label_type.label_type_id ORDER BY label_type.display_order;
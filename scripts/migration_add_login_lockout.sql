@@ -0,0 +1,31 @@
+-- Migration: Add login lockout and audit log tables
+-- Date: 2026-10-19
+-- Purpose: Track failed logins per username/IP for brute-force protection
+--          and keep an audit trail of failed login attempts
+
+CREATE TABLE IF NOT EXISTS `login_lockout` (
+    `scope` varchar(10) NOT NULL,
+    `subject` varchar(255) NOT NULL,
+    `failures` int(11) NOT NULL DEFAULT 0,
+    `last_failure` bigint(20) NOT NULL DEFAULT 0,
+    `locked_until` bigint(20) NOT NULL DEFAULT 0,
+    PRIMARY KEY (`scope`, `subject`)
+);
+
+CREATE TABLE IF NOT EXISTS `audit_log` (
+    `audit_id` bigint(20) NOT NULL AUTO_INCREMENT,
+    `actor_id` bigint(20) NOT NULL DEFAULT 0,
+    `action` varchar(63) NOT NULL,
+    `entity_type` varchar(31) NOT NULL DEFAULT '',
+    `entity_id` bigint(20) NOT NULL DEFAULT 0,
+    `before_json` TEXT NOT NULL,
+    `after_json` TEXT NOT NULL,
+    `created` bigint(20) NOT NULL,
+    PRIMARY KEY (`audit_id`),
+    KEY `actor` (`actor_id`),
+    KEY `entity` (`entity_type`, `entity_id`),
+    KEY `created` (`created`)
+);
+
+-- Verification query (run after migration to confirm)
+-- SHOW TABLES LIKE 'login_lockout'; SHOW TABLES LIKE 'audit_log';
@@ -0,0 +1,37 @@
+-- Migration: Add created and last_cooked columns to recipe
+-- Date: 2026-10-19
+-- Purpose: Sort recipe listings by when a recipe was added or last cooked.
+--          Existing recipes get 0 (unknown) for both
+
+-- Add created column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe'
+  AND COLUMN_NAME = 'created';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE recipe ADD COLUMN created BIGINT(20) NOT NULL DEFAULT 0',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Add last_cooked column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe'
+  AND COLUMN_NAME = 'last_cooked';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE recipe ADD COLUMN last_cooked BIGINT(20) NOT NULL DEFAULT 0',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Verification query (run after migration to confirm)
+-- SELECT recipe_id, created, last_cooked FROM recipe LIMIT 5;
@@ -0,0 +1,27 @@
+-- Migration: Add deleted_at column to recipe
+-- Date: 2026-10-19
+-- Purpose: Record when a recipe went in the trash, so it can be listed and
+--          purged after the retention period. Recipes already deleted are
+--          treated as deleted now. Brings the schema to version 3.
+
+-- Add deleted_at column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe'
+  AND COLUMN_NAME = 'deleted_at';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE recipe ADD COLUMN deleted_at BIGINT(20) NOT NULL DEFAULT 0, ADD KEY trash (deleted, deleted_at)',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+UPDATE recipe SET deleted_at = UNIX_TIMESTAMP() WHERE deleted = 1 AND deleted_at = 0;
+
+UPDATE schema_version SET version = 3 WHERE version < 3;
+
+-- Verification query (run after migration to confirm)
+-- SELECT recipe_id, title, deleted_at FROM recipe WHERE deleted = 1;
@@ -0,0 +1,17 @@
+-- Migration: Add schema_version table
+-- Date: 2026-10-19
+-- Purpose: Record which schema the database has, so /readyz can report a
+--          database that still needs migrating. Run this after every other
+--          migration; later migrations update the version themselves
+
+CREATE TABLE IF NOT EXISTS `schema_version` (
+    `version` int(11) NOT NULL
+);
+
+-- Record version 1 if no version has been recorded yet (idempotent check)
+INSERT INTO schema_version (version)
+SELECT 1 FROM DUAL
+WHERE NOT EXISTS (SELECT 1 FROM schema_version);
+
+-- Verification query (run after migration to confirm)
+-- SELECT version FROM schema_version;
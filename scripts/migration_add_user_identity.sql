@@ -0,0 +1,20 @@
+-- Migration: Add user_identity table for OpenID Connect login
+-- Date: 2026-10-19
+-- Purpose: Map identities from an external provider (issuer + subject) to
+--          local users
+
+CREATE TABLE IF NOT EXISTS `user_identity` (
+    `issuer` varchar(255) NOT NULL,
+    `subject` varchar(255) NOT NULL,
+    `user_id` bigint(20) NOT NULL,
+    `created` bigint(20) NOT NULL,
+    PRIMARY KEY (`issuer`, `subject`),
+    KEY `user` (`user_id`)
+);
+
+-- To link an existing user by hand before their first SSO login:
+-- INSERT INTO user_identity (issuer, subject, user_id, created)
+-- VALUES ('https://id.example.com', '<subject from the provider>', 2, UNIX_TIMESTAMP());
+
+-- Verification query (run after migration to confirm)
+-- SELECT * FROM user_identity;
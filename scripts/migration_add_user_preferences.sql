@@ -0,0 +1,36 @@
+-- Migration: Add preference columns to user table
+-- Date: 2026-10-19
+-- Purpose: Store per-user account settings (default unit system and servings)
+
+-- Add unit_system column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'user'
+  AND COLUMN_NAME = 'unit_system';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE user ADD COLUMN unit_system VARCHAR(10) NOT NULL DEFAULT ''''',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Add default_servings column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'user'
+  AND COLUMN_NAME = 'default_servings';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE user ADD COLUMN default_servings INT(11) NOT NULL DEFAULT 0',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Verification query (run after migration to confirm)
+-- SELECT user_id, username, unit_system, default_servings FROM user;
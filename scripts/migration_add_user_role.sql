@@ -0,0 +1,47 @@
+-- Migration: Replace user.administrator flag with a role column
+-- Date: 2026-10-19
+-- Purpose: Support viewer/contributor/editor/admin roles instead of a
+--          single administrator flag
+
+-- Add role column if it doesn't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'user'
+  AND COLUMN_NAME = 'role';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE user ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT ''viewer''',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Carry over existing administrators, then drop the old flag
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'user'
+  AND COLUMN_NAME = 'administrator';
+
+SET @query = IF(@col_exists = 1,
+    'UPDATE user SET role = ''admin'' WHERE administrator = 1',
+    'SELECT ''Column already dropped'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @query = IF(@col_exists = 1,
+    'ALTER TABLE user DROP COLUMN administrator',
+    'SELECT ''Column already dropped'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Everyone else starts as a viewer; promote family members as appropriate, e.g.
+-- UPDATE user SET role = 'contributor' WHERE username = 'koko';
+
+-- Verification query (run after migration to confirm)
+-- SELECT user_id, username, role FROM user;
@@ -0,0 +1,50 @@
+-- Migration: Add version columns to recipe, label and note
+-- Date: 2026-10-19
+-- Purpose: Optimistic concurrency. Every change bumps the row's version,
+--          which clients see as its ETag and send back in If-Match
+
+-- Add version columns if they don't exist (idempotent check)
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'recipe'
+  AND COLUMN_NAME = 'version';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE recipe ADD COLUMN version INT(11) NOT NULL DEFAULT 1',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'label'
+  AND COLUMN_NAME = 'version';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE label ADD COLUMN version INT(11) NOT NULL DEFAULT 1',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @col_exists = 0;
+SELECT COUNT(*) INTO @col_exists
+FROM information_schema.COLUMNS
+WHERE TABLE_SCHEMA = DATABASE()
+  AND TABLE_NAME = 'note'
+  AND COLUMN_NAME = 'version';
+
+SET @query = IF(@col_exists = 0,
+    'ALTER TABLE note ADD COLUMN version INT(11) NOT NULL DEFAULT 1',
+    'SELECT ''Column already exists'' AS msg');
+PREPARE stmt FROM @query;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+-- Verification query (run after migration to confirm)
+-- SELECT recipe_id, version FROM recipe LIMIT 5;
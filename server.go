@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenAddress returns where to listen: conf.Listen is a TCP address like
+// ":8080" or "127.0.0.1:8080", or "unix:" and the path of a socket
+func listenAddress() (network string, address string) {
+	if conf.Listen == "" {
+		return "tcp", ":8080"
+	}
+	if path, ok := strings.CutPrefix(conf.Listen, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", conf.Listen
+}
+
+// listen opens the configured listener. A Unix socket left behind by a
+// crash is replaced, and the new one is made group-writable (or
+// conf.UnixSocketMode) so a reverse proxy can connect.
+func listen() (net.Listener, error) {
+	network, address := listenAddress()
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil || network != "unix" {
+		return listener, err
+	}
+	mode, err := unixSocketMode()
+	if err == nil {
+		err = os.Chmod(address, mode)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func unixSocketMode() (os.FileMode, error) {
+	if conf.UnixSocketMode == "" {
+		return 0660, nil
+	}
+	mode, err := strconv.ParseUint(conf.UnixSocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("UnixSocketMode must be an octal file mode like \"0660\"")
+	}
+	return os.FileMode(mode), nil
+}
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  secondsOr(conf.ReadTimeoutSeconds, 15),
+		WriteTimeout: secondsOr(conf.WriteTimeoutSeconds, 30),
+		IdleTimeout:  secondsOr(conf.IdleTimeoutSeconds, 120),
+	}
+}
+
+// requestDeadline cancels a request's context, and so any query it's
+// running, after RequestTimeoutSeconds. The client hanging up cancels it
+// sooner.
+func requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), secondsOr(conf.RequestTimeoutSeconds, 20))
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// secondsOr converts a configured number of seconds, using fallback for 0
+func secondsOr(seconds int, fallback int) time.Duration {
+	if seconds == 0 {
+		seconds = fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// minutesOr is secondsOr for minutes
+func minutesOr(minutes int, fallback int) time.Duration {
+	if minutes == 0 {
+		minutes = fallback
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func tlsEnabled() bool {
+	return conf.TLSCertFile != "" || conf.TLSKeyFile != ""
+}
+
+// serve handles requests, and purges the trash, until the server fails or
+// stop receives a signal. Then it stops accepting connections, lets
+// in-flight requests finish for up to ShutdownTimeoutSeconds, and closes
+// the database.
+func serve(handler http.Handler, stop <-chan os.Signal) error {
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+	server := newServer(handler)
+
+	purging, stopPurging := context.WithCancel(context.Background())
+	defer stopPurging()
+	purged := make(chan bool)
+	go func() {
+		purgeTrashEvery(purging, minutesOr(conf.TrashPurgeIntervalMinutes, 60))
+		close(purged)
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		network, address := listenAddress()
+		slog.Info("listening", "network", network, "address", address, "tls", tlsEnabled())
+		if tlsEnabled() {
+			failed <- server.ServeTLS(listener, conf.TLSCertFile, conf.TLSKeyFile)
+		} else {
+			failed <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secondsOr(conf.ShutdownTimeoutSeconds, 30))
+	defer cancel()
+	err = server.Shutdown(ctx)
+	stopPurging()
+	<-purged
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+	return err
+}
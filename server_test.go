@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := map[string][2]string{
+		"":                   {"tcp", ":8080"},
+		"127.0.0.1:9000":     {"tcp", "127.0.0.1:9000"},
+		"unix:/run/rcp.sock": {"unix", "/run/rcp.sock"},
+		"unix:relative.sock": {"unix", "relative.sock"},
+		"[::1]:8443":         {"tcp", "[::1]:8443"},
+	}
+	for listen, want := range tests {
+		conf = configuration{Listen: listen}
+		if network, address := listenAddress(); network != want[0] || address != want[1] {
+			t.Errorf("listenAddress() for %q = %s %s, want %s %s", listen, network, address, want[0], want[1])
+		}
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "gorecipes.sock")
+	conf = configuration{DbDialect: "sqlite3", DbDSN: ":memory:", Listen: "unix:" + socket}
+	if db != nil {
+		db.Close()
+		db = nil
+	}
+	connect()
+
+	started := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- serve(handler, stop) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var info os.FileInfo
+	for i := 0; i < 100; i++ {
+		if stat, err := os.Stat(socket); err == nil && stat.Mode().Perm() == 0660 {
+			info = stat
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info == nil {
+		t.Fatalf("Expected a socket with mode 0660 at %s", socket)
+	}
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := client.Get("http://gorecipes/anything")
+		if err != nil {
+			responses <- "error: " + err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	if body := <-responses; body != "done" {
+		t.Errorf("Expected the in-flight request to finish, got %q", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() returned error: %v", err)
+	}
+	if db != nil {
+		t.Errorf("Expected serve() to close the database")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	setupIntegrationTest()
+
+	conf.RequestTimeoutSeconds = 5
+	var deadline time.Time
+	requestDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if left := time.Until(deadline); left <= 4*time.Second || left > 5*time.Second {
+		t.Errorf("Expected a deadline 5s away, got %v", left)
+	}
+
+	// A query that would never finish is abandoned at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := db.ExecContext(ctx, "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c")
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("Expected the query to be interrupted, got %v after %v", err, time.Since(start))
+	}
+
+	// ...and so is a model call for a client that has gone away
+	gone, hangUp := context.WithCancel(context.Background())
+	hangUp()
+	if _, _, err := recipeList(gone, 1, RecipeListOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// A handler that runs out of time says so
+	req := withClaims(httptest.NewRequest("GET", "/priv/recipes/", nil), &CustomClaims{UserID: 1, Role: RoleAdmin, HouseholdID: 1})
+	req.Header.Set("Accept", "application/json")
+	expired, stop := context.WithDeadline(req.Context(), time.Now().Add(-time.Second))
+	defer stop()
+	rr := httptest.NewRecorder()
+	wrappedHandler(getAllRecipes).ServeHTTP(rr, req.WithContext(expired))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), `"timeout"`) {
+		t.Errorf("Expected 503 timeout, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// preflight sends a CORS preflight for a PUT with the given request headers
+// and returns the headers the browser would be allowed to send
+func preflight(handler http.Handler, headers string) string {
+	req := httptest.NewRequest("OPTIONS", "/admin/recipe/1", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", headers)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Header().Get("Access-Control-Allow-Headers")
+}
+
+func TestCORSHeaders(t *testing.T) {
+	setupIntegrationTest()
+	conf.Origins = []string{"https://app.example.com"}
+	handler := newHandler()
+
+	for _, headers := range []string{"x-access-token", "authorization", "content-type", "if-match", "if-none-match", "x-request-id"} {
+		if allowed := preflight(handler, headers); !strings.EqualFold(allowed, headers) {
+			t.Errorf("Expected browsers to be allowed to send %s, got %q", headers, allowed)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	exposed := strings.Split(rr.Header().Get("Access-Control-Expose-Headers"), ", ")
+	for _, header := range []string{"Etag", "Link", "Retry-After", "X-Request-Id"} {
+		if !slices.Contains(exposed, header) {
+			t.Errorf("Expected %s to be exposed to browsers, got %v", header, exposed)
+		}
+	}
+}
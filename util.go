@@ -1,46 +1,178 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rivo/uniseg"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	ErrIconValidation = errors.New("icon validation failed")
-	ErrLabelConflict  = errors.New("label name conflict")
-	ErrTypeValidation = errors.New("type validation failed")
+	ErrIconValidation       = errors.New("icon validation failed")
+	ErrLabelConflict        = errors.New("label name conflict")
+	ErrTypeValidation       = errors.New("type validation failed")
+	ErrParentValidation     = errors.New("parent validation failed")
+	ErrLabelTypeConflict    = errors.New("label type name conflict")
+	ErrPasswordValidation   = errors.New("password validation failed")
+	ErrPreferenceValidation = errors.New("preference validation failed")
+	ErrPasswordMismatch     = errors.New("password does not match")
+	ErrRoleValidation       = errors.New("role validation failed")
+	ErrHouseholdValidation  = errors.New("household validation failed")
+	ErrAPIKeyValidation     = errors.New("API key validation failed")
+	ErrVersionConflict      = errors.New("version conflict")
 )
 
+// Password hashing schemes. Stored hashes are self-describing: argon2id
+// hashes use the PHC string format and start with argon2idPrefix, anything
+// else is treated as bcrypt.
+const (
+	schemeBcrypt   = "bcrypt"
+	schemeArgon2id = "argon2id"
+	argon2idPrefix = "$argon2id$"
+)
+
+// argon2id parameters for newly hashed passwords (RFC 9106 second
+// recommended option)
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+const (
+	minPasswordLength      = 8
+	maxDefaultServings     = 100
+	maxHouseholdNameLength = 63
+)
+
+// API keys look like "gr_" followed by random URL-safe characters. Only a
+// SHA-256 hash of the key is stored; the prefix (the first few characters)
+// is kept in the clear so users can tell their keys apart.
+const (
+	apiKeyPrefix        = "gr_"
+	apiKeyDisplayLength = 10
+	apiKeyScopeRead     = "read"
+	apiKeyScopeAdmin    = "admin"
+	maxAPIKeyNameLength = 63
+)
+
+// defaultHouseholdID is the household every pre-existing recipe, label, note
+// and user was migrated into
+const defaultHouseholdID = 1
+
+// Role - what a user is allowed to do. Roles are ordered: each one can do
+// everything the roles before it can.
+type Role string
+
+const (
+	RoleViewer      Role = "viewer"      // read recipes, labels and notes
+	RoleContributor Role = "contributor" // add notes and mark recipes cooked
+	RoleEditor      Role = "editor"      // edit recipes, labels and notes
+	RoleAdmin       Role = "admin"       // manage users, hard delete
+)
+
+// Permission - the minimum capability a route requires
+type Permission int
+
+const (
+	PermRead Permission = iota
+	PermContribute
+	PermEdit
+	PermAdmin
+)
+
+var roleGrants = map[Role]Permission{
+	RoleViewer:      PermRead,
+	RoleContributor: PermContribute,
+	RoleEditor:      PermEdit,
+	RoleAdmin:       PermAdmin,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleGrants[r]
+	return ok
+}
+
+// Can reports whether the role grants the permission
+func (r Role) Can(p Permission) bool {
+	granted, ok := roleGrants[r]
+	return ok && granted >= p
+}
+
+// minimumRole returns the least-privileged role that grants the permission
+func (p Permission) minimumRole() Role {
+	for _, role := range []Role{RoleViewer, RoleContributor, RoleEditor, RoleAdmin} {
+		if role.Can(p) {
+			return role
+		}
+	}
+	return RoleAdmin
+}
+
 type CustomClaims struct {
-	UserID  int  `json:"user_id"`
-	IsAdmin bool `json:"is_admin"`
+	UserID      int  `json:"user_id"`
+	Role        Role `json:"role"`
+	HouseholdID int  `json:"household_id"`
+	IsAdmin     bool `json:"is_admin"` // Kept for clients that predate roles
+	APIKeyID    int  `json:"-"`        // Set when the request authenticated with an API key
 	jwt.RegisteredClaims
 }
 
-func readConfiguration(c *configuration, configFilename string) error {
-	file, err := os.Open(configFilename)
-	if err != nil {
-		return err
+// EffectiveRole returns the role the token grants. Tokens issued before roles
+// existed only carry is_admin.
+func (c *CustomClaims) EffectiveRole() Role {
+	if c.Role != "" {
+		return c.Role
+	}
+	if c.IsAdmin {
+		return RoleAdmin
 	}
-	defer file.Close()
+	return RoleViewer
+}
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(&c)
+// EffectiveHouseholdID returns the household the token is scoped to. Tokens
+// issued before households existed belong to the default household.
+func (c *CustomClaims) EffectiveHouseholdID() int {
+	if c.HouseholdID != 0 {
+		return c.HouseholdID
+	}
+	return defaultHouseholdID
 }
 
-func jwtGenerate(userID int, isAdmin bool) (string, error) {
+// sessionAudience is the audience of the session tokens jwtGenerate issues.
+// Only tokens carrying it are accepted, so nothing else signed with the same
+// secret can pass for one.
+const sessionAudience = "gorecipes"
+
+func jwtGenerate(userID int, role Role, householdID int) (string, error) {
 	// 1 month expiration. TODO Decide on final scheme?
 	claims := &CustomClaims{
-		UserID:  userID,
-		IsAdmin: isAdmin,
+		UserID:      userID,
+		Role:        role,
+		HouseholdID: householdID,
+		IsAdmin:     role == RoleAdmin,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{sessionAudience},
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24 * 30)),
 		},
 	}
@@ -51,11 +183,7 @@ func jwtGenerate(userID int, isAdmin bool) (string, error) {
 		return "", err
 	}
 
-	if conf.Debug {
-		fmt.Println("Generated Token:")
-		fmt.Println(token)
-		fmt.Println(tokenStr)
-	}
+	slog.Debug("generated token", "user_id", userID, "role", role, "household_id", householdID)
 
 	return tokenStr, nil
 }
@@ -67,25 +195,202 @@ func jwtExtractClaims(tokenString string) (*CustomClaims, error) {
 
 	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(conf.JwtSecret), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(sessionAudience))
 
 	if err != nil {
 		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
+		if claims.UserID == 0 {
+			return nil, errors.New("auth token has no user")
+		}
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token claims")
 }
 
+// passwordScheme returns the configured scheme for new password hashes
+func passwordScheme() string {
+	if conf.PasswordScheme == "" {
+		return schemeBcrypt
+	}
+	return strings.ToLower(conf.PasswordScheme)
+}
+
+// bcryptCost returns the configured bcrypt cost for new password hashes
+func bcryptCost() int {
+	if conf.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return conf.BcryptCost
+}
+
 func hashPassword(password string) (string, error) {
+	if passwordScheme() == schemeArgon2id {
+		return hashArgon2id(password)
+	}
 	var pwBytes = []byte(password)
-	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.MinCost)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcryptCost())
 	return string(hashedBytes), err
 }
 
+// checkPasswordHash compares a cleartext password against a stored hash of
+// either scheme. It returns nil on a match.
+func checkPasswordHash(hash string, password string) error {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		return checkArgon2id(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// passwordNeedsRehash reports whether a stored hash is weaker than (or of a
+// different scheme from) what hashPassword would produce today
+func passwordNeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		if passwordScheme() != schemeArgon2id {
+			return true
+		}
+		memory, iterations, threads, _, _, err := decodeArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		return memory < argon2Memory || iterations < argon2Time || threads < argon2Threads
+	}
+
+	if passwordScheme() != schemeBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < bcryptCost()
+}
+
+func hashArgon2id(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkArgon2id(hash string, password string) error {
+	memory, iterations, threads, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	candidate := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// decodeArgon2id parses a PHC-format argon2id hash:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func decodeArgon2id(hash string) (memory uint32, iterations uint32, threads uint8, salt []byte, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != schemeArgon2id {
+		err = errors.New("malformed argon2id hash")
+		return
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return
+	}
+	if version != argon2.Version {
+		err = fmt.Errorf("unsupported argon2 version %d", version)
+		return
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	return
+}
+
+// Login lockout scopes: failures are tracked per username and per client IP
+const (
+	lockoutScopeUser = "username"
+	lockoutScopeIP   = "ip"
+)
+
+func loginMaxFailures(scope string) int {
+	if scope == lockoutScopeIP {
+		if conf.LoginMaxFailuresPerIP == 0 {
+			return 20
+		}
+		return conf.LoginMaxFailuresPerIP
+	}
+	if conf.LoginMaxFailures == 0 {
+		return 5
+	}
+	return conf.LoginMaxFailures
+}
+
+func loginLockoutBase() time.Duration {
+	if conf.LoginLockoutSeconds == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(conf.LoginLockoutSeconds) * time.Second
+}
+
+func loginLockoutMax() time.Duration {
+	if conf.LoginLockoutMaxSeconds == 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.LoginLockoutMaxSeconds) * time.Second
+}
+
+// lockoutDuration returns how long to lock out a username or IP after its
+// nth consecutive failure: nothing until the threshold, then the base
+// duration doubling with each further failure up to the maximum.
+func lockoutDuration(scope string, failures int) time.Duration {
+	over := failures - loginMaxFailures(scope)
+	if over < 0 {
+		return 0
+	}
+	d := loginLockoutBase()
+	for i := 0; i < over && d < loginLockoutMax(); i++ {
+		d *= 2
+	}
+	if d > loginLockoutMax() {
+		d = loginLockoutMax()
+	}
+	return d
+}
+
+// clientIP returns the address a request came from, honoring
+// X-Forwarded-For only when configured to trust a reverse proxy. Only the
+// rightmost entry is used: that's the one our proxy appended, while anything
+// to its left came from the client and can't be trusted
+func clientIP(r *http.Request) string {
+	if conf.TrustProxyHeaders {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func validateIcon(icon string) error {
 	if icon == "" {
 		return nil // Empty is valid
@@ -108,3 +413,124 @@ func validateType(labelType string) error {
 	}
 	return nil
 }
+
+// validateParent checks that parentID can be the parent of labelID: it's
+// another of labels and isn't below labelID, which would make a loop
+func validateParent(labels []Label, labelID int, parentID int) error {
+	if parentID == labelID {
+		return fmt.Errorf("a label can't be its own parent: %w", ErrParentValidation)
+	}
+	found := false
+	for _, label := range labels {
+		found = found || label.ID == parentID
+	}
+	if !found {
+		return fmt.Errorf("parent label %d does not exist: %w", parentID, ErrParentValidation)
+	}
+	for _, id := range labelFamily(labels, labelID) {
+		if id == parentID {
+			return fmt.Errorf("parent label %d is below this label: %w", parentID, ErrParentValidation)
+		}
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters: %w", minPasswordLength, ErrPasswordValidation)
+	}
+	return nil
+}
+
+func validateUnitSystem(unitSystem string) error {
+	switch strings.ToLower(unitSystem) {
+	case "", "metric", "imperial":
+		return nil
+	}
+	return fmt.Errorf("unit system must be 'metric' or 'imperial', got %q: %w", unitSystem, ErrPreferenceValidation)
+}
+
+func validateServings(servings int) error {
+	if servings < 0 || servings > maxDefaultServings {
+		return fmt.Errorf("default servings must be between 0 and %d, got %d: %w", maxDefaultServings, servings, ErrPreferenceValidation)
+	}
+	return nil
+}
+
+func validateRole(role Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("role must be one of viewer, contributor, editor or admin, got %q: %w", role, ErrRoleValidation)
+	}
+	return nil
+}
+
+func validateHouseholdName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("household name is required: %w", ErrHouseholdValidation)
+	}
+	if len(name) > maxHouseholdNameLength {
+		return fmt.Errorf("household name must be at most %d characters, got %d: %w", maxHouseholdNameLength, len(name), ErrHouseholdValidation)
+	}
+	return nil
+}
+
+// newInviteCode returns a random, URL-safe code that lets someone join a
+// household
+func newInviteCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newAPIKey returns a random API key and the hash to store for it
+func newAPIKey() (key string, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+// hashAPIKey returns the hex SHA-256 of an API key. Keys are long and random
+// so a fast, unsalted hash is enough to make a leaked table useless.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateAPIKeyScope(scope string) error {
+	if scope != apiKeyScopeRead && scope != apiKeyScopeAdmin {
+		return fmt.Errorf("scope must be %q or %q, got %q: %w", apiKeyScopeRead, apiKeyScopeAdmin, scope, ErrAPIKeyValidation)
+	}
+	return nil
+}
+
+func validateAPIKeyName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("API key name is required: %w", ErrAPIKeyValidation)
+	}
+	if len(name) > maxAPIKeyNameLength {
+		return fmt.Errorf("API key name must be at most %d characters, got %d: %w", maxAPIKeyNameLength, len(name), ErrAPIKeyValidation)
+	}
+	return nil
+}
+
+// parseDateParam parses a date filter given as YYYY-MM-DD (midnight UTC) or
+// RFC 3339. With endOfDay, a bare date means the end of that day, so an
+// "until" of 2026-10-19 includes everything on the 19th.
+func parseDateParam(value string, endOfDay bool) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a date (YYYY-MM-DD) or RFC 3339 timestamp", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.Unix(), nil
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func setupJwtConfig() {
@@ -19,7 +23,7 @@ func setupJwtConfig() {
 func TestJwtGenerate(t *testing.T) {
 	setupJwtConfig()
 
-	token, err := jwtGenerate(1, true)
+	token, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Errorf("jwtGenerate() returned error: %v", err)
 	}
@@ -45,7 +49,7 @@ func TestJwtGenerate(t *testing.T) {
 func TestJwtGenerateHasExpirationClaim(t *testing.T) {
 	setupJwtConfig()
 
-	tokenString, err := jwtGenerate(1, true)
+	tokenString, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("jwtGenerate() returned error: %v", err)
 	}
@@ -106,6 +110,143 @@ func TestHashPassword(t *testing.T) {
 	}
 }
 
+func TestHashPasswordUsesConfiguredCost(t *testing.T) {
+	setupJwtConfig()
+
+	hashed, err := hashPassword("testPassword123")
+	if err != nil {
+		t.Fatalf("hashPassword() returned error: %v", err)
+	}
+	cost, _ := bcrypt.Cost([]byte(hashed))
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("Expected default bcrypt cost %d when unconfigured, got %d", bcrypt.DefaultCost, cost)
+	}
+
+	conf.BcryptCost = 11
+	hashed, err = hashPassword("testPassword123")
+	if err != nil {
+		t.Fatalf("hashPassword() returned error: %v", err)
+	}
+	cost, _ = bcrypt.Cost([]byte(hashed))
+	if cost != 11 {
+		t.Errorf("Expected configured bcrypt cost 11, got %d", cost)
+	}
+}
+
+func TestArgon2idPasswordHash(t *testing.T) {
+	setupJwtConfig()
+	conf.PasswordScheme = "argon2id"
+
+	hashed, err := hashPassword("testPassword123")
+	if err != nil {
+		t.Fatalf("hashPassword() returned error: %v", err)
+	}
+	if !strings.HasPrefix(hashed, argon2idPrefix) {
+		t.Fatalf("Expected argon2id hash, got %q", hashed)
+	}
+
+	if err := checkPasswordHash(hashed, "testPassword123"); err != nil {
+		t.Errorf("checkPasswordHash() rejected the correct password: %v", err)
+	}
+	if err := checkPasswordHash(hashed, "wrongPassword"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("checkPasswordHash() with wrong password: expected ErrPasswordMismatch, got %v", err)
+	}
+	if err := checkPasswordHash("$argon2id$v=19$garbage", "testPassword123"); err == nil {
+		t.Error("checkPasswordHash() accepted a malformed argon2id hash")
+	}
+
+	// bcrypt hashes keep working after switching schemes
+	user := User{HashedPassword: "$2a$04$QT4huVz9vGnC0cnHEd9C0uXS4/pgCyWC/whDhJocMmrc8S5xdhREG"}
+	if err := user.CheckPassword("bar"); err != nil {
+		t.Errorf("bcrypt hash rejected under argon2id scheme: %v", err)
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	setupJwtConfig()
+
+	weak, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	current, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.DefaultCost)
+
+	if !passwordNeedsRehash(string(weak)) {
+		t.Error("Expected MinCost bcrypt hash to need rehash")
+	}
+	if passwordNeedsRehash(string(current)) {
+		t.Error("Expected DefaultCost bcrypt hash not to need rehash")
+	}
+
+	// A stronger-than-configured hash is left alone
+	conf.BcryptCost = bcrypt.MinCost
+	if passwordNeedsRehash(string(current)) {
+		t.Error("Expected hash above the configured cost not to need rehash")
+	}
+
+	// Switching schemes upgrades everything of the old scheme
+	conf.PasswordScheme = "argon2id"
+	if !passwordNeedsRehash(string(current)) {
+		t.Error("Expected bcrypt hash to need rehash under argon2id scheme")
+	}
+	argonHash, _ := hashPassword("pw")
+	if passwordNeedsRehash(argonHash) {
+		t.Error("Expected fresh argon2id hash not to need rehash")
+	}
+	weakArgon := "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$aGFzaGhhc2hoYXNo"
+	if !passwordNeedsRehash(weakArgon) {
+		t.Error("Expected weak argon2id hash to need rehash")
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	setupJwtConfig()
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{7, 2 * time.Minute},
+		{20, time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := lockoutDuration(lockoutScopeUser, tt.failures)
+		if got != tt.want {
+			t.Errorf("lockoutDuration(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// IPs get a higher threshold since households share an address
+	if d := lockoutDuration(lockoutScopeIP, 5); d != 0 {
+		t.Errorf("Expected no IP lockout after 5 failures, got %v", d)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	setupJwtConfig()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+
+	if ip := clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("Expected remote address when proxy headers are untrusted, got %q", ip)
+	}
+
+	conf.TrustProxyHeaders = true
+	if ip := clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("Expected the proxy's (last) X-Forwarded-For address, got %q", ip)
+	}
+
+	// A client can't pick its address by sending its own header
+	req.Header.Add("X-Forwarded-For", "198.51.100.7")
+	if ip := clientIP(req); ip != "198.51.100.7" {
+		t.Errorf("Expected the last X-Forwarded-For header to win, got %q", ip)
+	}
+}
+
 func TestValidateIcon(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -156,6 +297,110 @@ func TestValidateType(t *testing.T) {
 	}
 }
 
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"empty is invalid", "", true},
+		{"too short", "1234567", true},
+		{"minimum length", "12345678", false},
+		{"passphrase", "cooking for mama", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePassword(tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePassword(%q) error = %v, wantErr %v", tt.password, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateUnitSystem(t *testing.T) {
+	tests := []struct {
+		name       string
+		unitSystem string
+		wantErr    bool
+	}{
+		{"empty string is valid", "", false},
+		{"metric", "metric", false},
+		{"imperial", "imperial", false},
+		{"mixed case", "Imperial", false},
+		{"unknown", "cubits", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUnitSystem(tt.unitSystem)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateUnitSystem(%q) error = %v, wantErr %v", tt.unitSystem, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleViewer, PermRead, true},
+		{RoleViewer, PermContribute, false},
+		{RoleContributor, PermContribute, true},
+		{RoleContributor, PermEdit, false},
+		{RoleEditor, PermEdit, true},
+		{RoleEditor, PermAdmin, false},
+		{RoleAdmin, PermAdmin, true},
+		{Role("overlord"), PermRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.perm); got != tt.want {
+			t.Errorf("Role(%q).Can(%d) = %v, want %v", tt.role, tt.perm, got, tt.want)
+		}
+	}
+
+	if role := PermEdit.minimumRole(); role != RoleEditor {
+		t.Errorf("Expected editor to be the minimum role for PermEdit, got %q", role)
+	}
+}
+
+func TestEffectiveRoleForLegacyTokens(t *testing.T) {
+	if role := (&CustomClaims{IsAdmin: true}).EffectiveRole(); role != RoleAdmin {
+		t.Errorf("Expected legacy admin token to be admin, got %q", role)
+	}
+	if role := (&CustomClaims{}).EffectiveRole(); role != RoleViewer {
+		t.Errorf("Expected legacy non-admin token to be viewer, got %q", role)
+	}
+	if role := (&CustomClaims{Role: RoleEditor}).EffectiveRole(); role != RoleEditor {
+		t.Errorf("Expected role claim to win, got %q", role)
+	}
+}
+
+func TestEffectiveHouseholdID(t *testing.T) {
+	if id := (&CustomClaims{}).EffectiveHouseholdID(); id != defaultHouseholdID {
+		t.Errorf("Expected legacy token to use the default household, got %d", id)
+	}
+	if id := (&CustomClaims{HouseholdID: 3}).EffectiveHouseholdID(); id != 3 {
+		t.Errorf("Expected household claim to win, got %d", id)
+	}
+}
+
+func TestValidateHouseholdName(t *testing.T) {
+	if err := validateHouseholdName("The Smiths"); err != nil {
+		t.Errorf("validateHouseholdName() returned error for valid name: %v", err)
+	}
+	for _, name := range []string{"", "   ", strings.Repeat("x", maxHouseholdNameLength+1)} {
+		if err := validateHouseholdName(name); !errors.Is(err, ErrHouseholdValidation) {
+			t.Errorf("validateHouseholdName(%q) = %v, want ErrHouseholdValidation", name, err)
+		}
+	}
+}
+
 func TestCustomClaimsStructure(t *testing.T) {
 	claims := &CustomClaims{
 		UserID:  1,
@@ -178,7 +423,7 @@ func TestJwtGenerateWithUserInfo(t *testing.T) {
 	conf.JwtSecret = "test-secret-key-for-testing"
 
 	// Test admin user
-	tokenStr, err := jwtGenerate(1, true)
+	tokenStr, err := jwtGenerate(1, RoleAdmin, 1)
 	if err != nil {
 		t.Fatalf("jwtGenerate failed: %v", err)
 	}
@@ -207,7 +452,7 @@ func TestJwtGenerateWithUserInfo(t *testing.T) {
 	}
 
 	// Test non-admin user
-	tokenStr2, err := jwtGenerate(2, false)
+	tokenStr2, err := jwtGenerate(2, RoleViewer, 1)
 	if err != nil {
 		t.Fatalf("jwtGenerate failed for non-admin: %v", err)
 	}
@@ -229,7 +474,7 @@ func TestJwtExtractClaimsValid(t *testing.T) {
 	conf.JwtSecret = "test-secret-key-for-testing"
 
 	// Generate a valid token
-	tokenStr, _ := jwtGenerate(1, true)
+	tokenStr, _ := jwtGenerate(1, RoleAdmin, 1)
 
 	// Extract claims
 	claims, err := jwtExtractClaims(tokenStr)
@@ -283,3 +528,80 @@ func TestJwtExtractClaimsExpired(t *testing.T) {
 		t.Error("Expected error for expired token")
 	}
 }
+
+func TestJwtExtractClaimsRejectsOtherTokens(t *testing.T) {
+	conf.JwtSecret = "test-secret-key-for-testing"
+	expires := jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		method jwt.SigningMethod
+		claims *CustomClaims
+	}{
+		{"no user", jwt.SigningMethodHS256, &CustomClaims{Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+			Audience: jwt.ClaimStrings{sessionAudience}, ExpiresAt: expires}}},
+		{"no audience", jwt.SigningMethodHS256, &CustomClaims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: expires}}},
+		{"wrong audience", jwt.SigningMethodHS256, &CustomClaims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{
+			Audience: jwt.ClaimStrings{oidcStateAudience}, ExpiresAt: expires}}},
+		{"wrong algorithm", jwt.SigningMethodHS512, &CustomClaims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{
+			Audience: jwt.ClaimStrings{sessionAudience}, ExpiresAt: expires}}},
+	}
+	for _, tt := range tests {
+		tokenStr, _ := jwt.NewWithClaims(tt.method, tt.claims).SignedString([]byte(conf.JwtSecret))
+		if _, err := jwtExtractClaims(tokenStr); err == nil {
+			t.Errorf("%s: expected the token to be rejected", tt.name)
+		}
+	}
+}
+
+func TestNewAPIKey(t *testing.T) {
+	key, hash, err := newAPIKey()
+	if err != nil {
+		t.Fatalf("newAPIKey() returned error: %v", err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Errorf("Expected key to start with %q, got %q", apiKeyPrefix, key)
+	}
+	if hash != hashAPIKey(key) || hash == key {
+		t.Error("Expected returned hash to be the hash of the key")
+	}
+
+	other, _, _ := newAPIKey()
+	if other == key {
+		t.Error("Expected newAPIKey() to return a different key each time")
+	}
+}
+
+func TestValidateAPIKeyScope(t *testing.T) {
+	for _, scope := range []string{apiKeyScopeRead, apiKeyScopeAdmin} {
+		if err := validateAPIKeyScope(scope); err != nil {
+			t.Errorf("validateAPIKeyScope(%q) returned error: %v", scope, err)
+		}
+	}
+	if err := validateAPIKeyScope("write"); !errors.Is(err, ErrAPIKeyValidation) {
+		t.Errorf("validateAPIKeyScope(write) = %v, want ErrAPIKeyValidation", err)
+	}
+}
+
+func TestParseDateParam(t *testing.T) {
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		endOfDay bool
+		want     int64
+	}{
+		{"2026-10-19", false, day.Unix()},
+		{"2026-10-19", true, day.AddDate(0, 0, 1).Unix()},
+		{"2026-10-19T08:30:00Z", true, day.Add(8*time.Hour + 30*time.Minute).Unix()},
+	}
+	for _, tt := range tests {
+		got, err := parseDateParam(tt.value, tt.endOfDay)
+		if err != nil || got != tt.want {
+			t.Errorf("parseDateParam(%q, %v) = %d, %v; want %d", tt.value, tt.endOfDay, got, err, tt.want)
+		}
+	}
+	if _, err := parseDateParam("last tuesday", false); err == nil {
+		t.Error("Expected error for unparseable date")
+	}
+}